@@ -8,7 +8,8 @@ import (
 
 type (
 	Opts struct {
-		DryRun bool `long:"dry-run"           env:"DRYRUN"  description:"Dry run (no delete)"`
+		DryRun bool   `long:"dry-run"           env:"DRYRUN"  description:"Dry run (no delete)"`
+		Config string `long:"config"            env:"CONFIG"  description:"Path to policy file (yaml or json) with janitor rules for resources and resourcegroups"`
 
 		// logger
 		Logger struct {
@@ -23,6 +24,12 @@ type (
 		Azure struct {
 			Environment  *string  `long:"azure.environment"    env:"AZURE_ENVIRONMENT"                     description:"Azure environment name" default:"AZUREPUBLICCLOUD"`
 			Subscription []string `long:"azure.subscription"   env:"AZURE_SUBSCRIPTION_ID"  env-delim:" "  description:"Azure subscription ID (space delimiter)"`
+
+			SubscriptionManagementGroup []string `long:"azure.subscription.managementgroup"  env:"AZURE_SUBSCRIPTION_MANAGEMENTGROUP"  env-delim:" "  description:"Only use subscriptions below these management groups (recursive, space delimiter)"`
+			SubscriptionTag             []string `long:"azure.subscription.tag"              env:"AZURE_SUBSCRIPTION_TAG"              env-delim:" "  description:"Only use subscriptions with these tags (name or name=value, space delimiter)"`
+			SubscriptionName            *string  `long:"azure.subscription.name"             env:"AZURE_SUBSCRIPTION_NAME"                            description:"Only use subscriptions with matching display name (regexp)"`
+			SubscriptionNameRegExp      *regexp.Regexp
+
 			ResourceTags []string `long:"azure.resource-tag"   env:"AZURE_RESOURCE_TAG"     env-delim:" "  description:"Azure Resource tags (space delimiter)"     default:"owner"`
 		}
 
@@ -33,22 +40,91 @@ type (
 			Tag       string        `long:"janitor.tag"         env:"JANITOR_TAG"         description:"Janitor azure tag (string)"  default:"ttl"`
 			TagTarget string        `long:"janitor.tag.target"  env:"JANITOR_TAG_TARGET"  description:"Janitor azure tag (string)"  default:"ttl_expiry"`
 
+			TagExtend struct {
+				Name string        `long:"janitor.tag.extend"      env:"JANITOR_TAG_EXTEND"      description:"Janitor azure tag for extending the expiry time (duration, removed after it has been applied)"  default:"ttl_extend"`
+				Max  time.Duration `long:"janitor.tag.extend.max"  env:"JANITOR_TAG_EXTEND_MAX"  description:"Maximum total extension of the original expiry time (time.duration, 0 = unlimited)"              default:"720h"`
+			}
+
+			DefaultTtl struct {
+				Grace time.Duration `long:"janitor.defaultttl.grace"  env:"JANITOR_DEFAULTTTL_GRACE"  description:"Minimum time between writing a computed default ttl and deleting the resource (time.duration)"  default:"24h"`
+			}
+
+			Concurrency struct {
+				Subscriptions int `long:"janitor.concurrency.subscriptions"  env:"JANITOR_CONCURRENCY_SUBSCRIPTIONS"  description:"Number of subscriptions processed in parallel"                 default:"5"`
+				Tasks         int `long:"janitor.concurrency.tasks"          env:"JANITOR_CONCURRENCY_TASKS"          description:"Number of tasks processed in parallel (per subscription)"     default:"2"`
+				Deletions     int `long:"janitor.concurrency.deletions"      env:"JANITOR_CONCURRENCY_DELETIONS"      description:"Number of delete operations running in parallel (overall)"     default:"10"`
+			}
+
+			Delete struct {
+				Async        bool          `long:"janitor.delete.async"         env:"JANITOR_DELETE_ASYNC"         description:"Track delete operations in background instead of waiting for them inside the janitor run"`
+				Timeout      time.Duration `long:"janitor.delete.timeout"       env:"JANITOR_DELETE_TIMEOUT"       description:"Timeout for waiting on delete operations (time.duration)"        default:"30m"`
+				PollInterval time.Duration `long:"janitor.delete.pollinterval"  env:"JANITOR_DELETE_POLLINTERVAL"  description:"Poll interval for delete operations (time.duration, min 1s)"     default:"15s"`
+
+				ShutdownTimeout time.Duration `long:"janitor.delete.shutdowntimeout"  env:"JANITOR_DELETE_SHUTDOWNTIMEOUT"  description:"Maximum time to wait for delete operations tracked in background on shutdown (time.duration)"  default:"30s"`
+			}
+
+			Protection struct {
+				Tag              string `long:"janitor.protection.tag"                 env:"JANITOR_PROTECTION_TAG"                 description:"Resources with this tag are never deleted or modified (tag value \"false\" disables the protection)"  default:"donotdelete"`
+				DisableLockCheck bool   `long:"janitor.protection.disable-lockcheck"   env:"JANITOR_PROTECTION_DISABLE_LOCKCHECK"   description:"Do not check for management locks (CanNotDelete, ReadOnly) before deleting"`
+			}
+
+			Notification struct {
+				Window    []time.Duration `long:"janitor.notification.window"     env:"JANITOR_NOTIFICATION_WINDOW"  env-delim:" "  description:"Send expiry warning when resource expires within this window (time.duration, eg 24h 1h, space delimiter)"`
+				OwnerTag  string          `long:"janitor.notification.ownertag"   env:"JANITOR_NOTIFICATION_OWNERTAG"               description:"Azure tag containing the owner of the resource (added to the expiry warning)"  default:"owner"`
+				Webhook   string          `long:"janitor.notification.webhook"    env:"JANITOR_NOTIFICATION_WEBHOOK"                description:"Send expiry warnings as json to this webhook url"`
+				Slack     string          `long:"janitor.notification.slack"      env:"JANITOR_NOTIFICATION_SLACK"                  description:"Send expiry warnings to this Slack (compatible) incoming webhook url"`
+				Teams     string          `long:"janitor.notification.teams"      env:"JANITOR_NOTIFICATION_TEAMS"                  description:"Send expiry warnings to this Microsoft Teams incoming webhook url"`
+				Timeout   time.Duration   `long:"janitor.notification.timeout"    env:"JANITOR_NOTIFICATION_TIMEOUT"                description:"Timeout for sending notifications (time.duration)"  default:"30s"`
+				StateFile string          `long:"janitor.notification.statefile"  env:"JANITOR_NOTIFICATION_STATEFILE"              description:"Store sent notifications in this file (to not send warnings again after restart)"`
+			}
+
+			Audit struct {
+				File    string        `long:"janitor.audit.file"     env:"JANITOR_AUDIT_FILE"     description:"Append audit events (deletions, tag updates and skips) as json lines to this file"`
+				Stdout  bool          `long:"janitor.audit.stdout"   env:"JANITOR_AUDIT_STDOUT"   description:"Write audit events as json lines to stdout"`
+				Webhook string        `long:"janitor.audit.webhook"  env:"JANITOR_AUDIT_WEBHOOK"  description:"Send audit events as json to this webhook url"`
+				Timeout time.Duration `long:"janitor.audit.timeout"  env:"JANITOR_AUDIT_TIMEOUT"  description:"Timeout for sending audit events to webhook (time.duration)"  default:"30s"`
+			}
+
+			ApiVersion struct {
+				Refresh   time.Duration `long:"janitor.apiversion.refresh"   env:"JANITOR_APIVERSION_REFRESH"                 description:"Refresh interval for api-versions of resource providers (time.duration, 0 = only at startup and for unknown resource types)"  default:"24h"`
+				Override  []string      `long:"janitor.apiversion.override"  env:"JANITOR_APIVERSION_OVERRIDE"  env-delim:" "  description:"Use this api-version for a resource type (eg: Microsoft.Web/sites=2022-03-01, space delimiter)"`
+				Overrides map[string]string
+			}
+
+			Discovery struct {
+				Backend string `long:"janitor.discovery"  env:"JANITOR_DISCOVERY"  description:"Discovery backend for resources, resourcegroups and roleassignments (arm: list APIs per subscription, resourcegraph: one Azure Resource Graph query for all subscriptions)" choice:"arm" choice:"resourcegraph" default:"arm"` // nolint:staticcheck // multiple choices are ok
+			}
+
+			Plan struct {
+				File string `long:"janitor.plan.file"  env:"JANITOR_PLAN_FILE"  description:"Write plan (deletions and tag updates) of each run as json to this file"`
+			}
+
 			ResourceGroups struct {
-				Enable           bool    `long:"janitor.resourcegroups"         env:"JANITOR_RESOURCEGROUPS_ENABLE"  description:"Enable Azure ResourceGroups cleanup"`
-				AdditionalFilter *string `long:"janitor.resourcegroups.filter"  env:"JANITOR_RESOURCEGROUPS_FILTER"  description:"Additional $filter for Azure REST API for ResourceGroups"`
-				Filter           string
+				Enable           bool     `long:"janitor.resourcegroups"                  env:"JANITOR_RESOURCEGROUPS_ENABLE"                         description:"Enable Azure ResourceGroups cleanup"`
+				AdditionalFilter *string  `long:"janitor.resourcegroups.filter"           env:"JANITOR_RESOURCEGROUPS_FILTER"                         description:"Additional $filter for Azure REST API for ResourceGroups"`
+				FilterTag        string   `long:"janitor.resourcegroups.filter.tag"       env:"JANITOR_RESOURCEGROUPS_FILTER_TAG"                     description:"Only process ResourceGroups with this tag"`
+				FilterLocation   []string `long:"janitor.resourcegroups.filter.location"  env:"JANITOR_RESOURCEGROUPS_FILTER_LOCATION"  env-delim:" "  description:"Only process ResourceGroups in these locations (space delimiter)"`
 			}
 
 			Resources struct {
-				Enable           bool    `long:"janitor.resources"          env:"JANITOR_RESOURCES_ENABLE"  description:"Enable Azure Resources cleanup"`
-				AdditionalFilter *string `long:"janitor.resources.filter"   env:"JANITOR_RESOURCES_FILTER"  description:"Additional $filter for Azure REST API for Resources"`
-				Filter           string
+				Enable             bool     `long:"janitor.resources"                       env:"JANITOR_RESOURCES_ENABLE"                              description:"Enable Azure Resources cleanup"`
+				AdditionalFilter   *string  `long:"janitor.resources.filter"                env:"JANITOR_RESOURCES_FILTER"                              description:"Additional $filter for Azure REST API for Resources"`
+				FilterTag          string   `long:"janitor.resources.filter.tag"            env:"JANITOR_RESOURCES_FILTER_TAG"                          description:"Only process Resources with this tag"`
+				FilterResourceType []string `long:"janitor.resources.filter.resourcetype"   env:"JANITOR_RESOURCES_FILTER_RESOURCETYPE"  env-delim:" "   description:"Only process Resources of these resource types (space delimiter)"`
+				FilterLocation     []string `long:"janitor.resources.filter.location"       env:"JANITOR_RESOURCES_FILTER_LOCATION"      env-delim:" "   description:"Only process Resources in these locations (space delimiter)"`
+				Selector           string   `long:"janitor.resources.selector"              env:"JANITOR_RESOURCES_SELECTOR"                            description:"Client side selector for Resources (eg: type=Microsoft.Compute/* rg~^rg-dev- !tag:keep)"`
 			}
 
 			Deployments struct {
-				Enable bool          `long:"janitor.deployments"         env:"JANITOR_DEPLOYMENTS_ENABLE"  description:"Enable Azure Deployments cleanup"`
-				Ttl    time.Duration `long:"janitor.deployments.ttl"     env:"JANITOR_DEPLOYMENTS_TTL"     description:"Janitor deployment ttl (time.duration)"  default:"8760h"`
-				Limit  int64         `long:"janitor.deployments.limit"   env:"JANITOR_DEPLOYMENTS_LIMIT"   description:"Janitor deployment limit count (int)"    default:"700"`
+				Enable           bool          `long:"janitor.deployments"                 env:"JANITOR_DEPLOYMENTS_ENABLE"          description:"Enable Azure Deployments cleanup"`
+				Ttl              time.Duration `long:"janitor.deployments.ttl"             env:"JANITOR_DEPLOYMENTS_TTL"             description:"Janitor deployment ttl (time.duration)"  default:"8760h"`
+				Limit            int64         `long:"janitor.deployments.limit"           env:"JANITOR_DEPLOYMENTS_LIMIT"           description:"Janitor deployment limit count (int)"    default:"700"`
+				KeepSucceeded    int           `long:"janitor.deployments.keep.succeeded"  env:"JANITOR_DEPLOYMENTS_KEEP_SUCCEEDED"  description:"Always keep the last N succeeded deployments per deployment name prefix (int)"  default:"1"`
+				KeepFailed       int           `long:"janitor.deployments.keep.failed"     env:"JANITOR_DEPLOYMENTS_KEEP_FAILED"     description:"Always keep the last N failed (or canceled) deployments per deployment name prefix (int)"  default:"0"`
+				Prefix           *string       `long:"janitor.deployments.prefix"          env:"JANITOR_DEPLOYMENTS_PREFIX"          description:"Regexp for detecting the prefix of deployment names (first capture group, default: name without trailing numbers)"`
+				ManagementGroups []string      `long:"janitor.deployments.managementgroup" env:"JANITOR_DEPLOYMENTS_MANAGEMENTGROUP" env-delim:" " description:"Cleanup deployments on ManagementGroup scope (ManagementGroup IDs, space delimiter)"`
+				Tenant           bool          `long:"janitor.deployments.tenant"          env:"JANITOR_DEPLOYMENTS_TENANT"          description:"Cleanup deployments on Tenant scope"`
+				PrefixRegExp     *regexp.Regexp
 			}
 
 			RoleAssignments struct {
@@ -59,6 +135,18 @@ type (
 				Filter               string
 				DescriptionTtl       *string `long:"janitor.roleassignments.descriptionttl"           env:"JANITOR_ROLEASSIGNMENTS_DESCRIPTIONTTL"                  description:"Regexp for detecting ttl inside description of RoleAssignment"`
 				DescriptionTtlRegExp *regexp.Regexp
+				Scopes               []string `long:"janitor.roleassignments.scope"                    env:"JANITOR_ROLEASSIGNMENTS_SCOPE"           env-delim:" " description:"Only cleanup RoleAssignments of these scopes (subscription, resourceGroup or ManagementGroup IDs, default: all subscriptions) (space delimiter)"`
+				AtScope              bool     `long:"janitor.roleassignments.atscope"                  env:"JANITOR_ROLEASSIGNMENTS_ATSCOPE"                         description:"Only cleanup RoleAssignments made directly at the listed scope (not inherited from parent or child scopes)"`
+				PrincipalTypes       []string `long:"janitor.roleassignments.principaltype"            env:"JANITOR_ROLEASSIGNMENTS_PRINCIPALTYPE"   env-delim:" " description:"Only cleanup RoleAssignments of these principal types (eg. ServicePrincipal, User, Group) (space delimiter)"`
+				PrincipalIds         []string `long:"janitor.roleassignments.principalid"              env:"JANITOR_ROLEASSIGNMENTS_PRINCIPALID"     env-delim:" " description:"Only cleanup RoleAssignments of these principal IDs (space delimiter)"`
+				PrincipalIdsExcluded []string `long:"janitor.roleassignments.principalid.exclude"      env:"JANITOR_ROLEASSIGNMENTS_PRINCIPALID_EXCLUDE" env-delim:" " description:"Never cleanup RoleAssignments of these principal IDs (space delimiter)"`
+			}
+
+			RoleAssignmentsOrphaned struct {
+				Enable        bool          `long:"janitor.roleassignments.orphaned"                env:"JANITOR_ROLEASSIGNMENTS_ORPHANED_ENABLE"         description:"Detect RoleAssignments whose principal does not exist anymore (resolved via Microsoft Graph)"`
+				Delete        bool          `long:"janitor.roleassignments.orphaned.delete"         env:"JANITOR_ROLEASSIGNMENTS_ORPHANED_DELETE"         description:"Delete orphaned RoleAssignments (otherwise only reported)"`
+				MinAge        time.Duration `long:"janitor.roleassignments.orphaned.minage"         env:"JANITOR_ROLEASSIGNMENTS_ORPHANED_MINAGE"         description:"Minimum age of RoleAssignments before they are checked (principals might not be replicated yet) (time.duration)"  default:"1h"`
+				GraphEndpoint string        `long:"janitor.roleassignments.orphaned.graphendpoint"  env:"JANITOR_ROLEASSIGNMENTS_ORPHANED_GRAPHENDPOINT"  description:"Microsoft Graph endpoint for resolving principals"  default:"https://graph.microsoft.com"`
 			}
 		}
 
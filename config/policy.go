@@ -0,0 +1,192 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	PolicyActionDelete = "delete"
+	PolicyActionReport = "report"
+
+	PolicyDefaultRuleName = "default"
+)
+
+type (
+	// Policy contains the janitor rules for resources and resourceGroups, first matching rule wins.
+	// Deployments and roleAssignments are not covered by the policy (configured by flags only).
+	Policy struct {
+		Rules []*PolicyRule `yaml:"rules" json:"rules"`
+	}
+
+	PolicyRule struct {
+		Name  string          `yaml:"name"       json:"name"`
+		Scope PolicyRuleScope `yaml:"scope"      json:"scope"`
+
+		// ttl tag names
+		Tag       string `yaml:"tag"        json:"tag"`
+		TagTarget string `yaml:"tagTarget"  json:"tagTarget"`
+
+		// ttl for resources without ttl tag (duration)
+		DefaultTtl string `yaml:"defaultTtl" json:"defaultTtl,omitempty"`
+
+		// maximum age (based on creation time) and maximum idle time (based on last change time) of resources (duration)
+		MaxAge  string `yaml:"maxAge"     json:"maxAge,omitempty"`
+		MaxIdle string `yaml:"maxIdle"    json:"maxIdle,omitempty"`
+
+		// action for expired resources (delete or report)
+		Action string `yaml:"action"     json:"action"`
+	}
+
+	PolicyRuleScope struct {
+		Subscriptions  []string `yaml:"subscriptions"   json:"subscriptions,omitempty"`
+		ResourceGroups []string `yaml:"resourceGroups"  json:"resourceGroups,omitempty"`
+		ResourceTypes  []string `yaml:"resourceTypes"   json:"resourceTypes,omitempty"`
+		Locations      []string `yaml:"locations"       json:"locations,omitempty"`
+	}
+)
+
+// LoadPolicyFile loads policy from yaml or json file
+func LoadPolicyFile(path string) (*Policy, error) {
+	content, err := os.ReadFile(path) // #nosec G304 -- path is set by configuration
+	if err != nil {
+		return nil, fmt.Errorf(`unable to read policy file "%s": %w`, path, err)
+	}
+
+	policy := Policy{}
+	// yaml is a superset of json, so both formats are supported
+	if err := yaml.Unmarshal(content, &policy); err != nil {
+		return nil, fmt.Errorf(`unable to parse policy file "%s": %w`, path, err)
+	}
+
+	return &policy, nil
+}
+
+// NewImplicitPolicy builds the policy (one rule without scope) from the janitor flags
+func NewImplicitPolicy(tag, tagTarget string) *Policy {
+	return &Policy{
+		Rules: []*PolicyRule{
+			{
+				Name:      PolicyDefaultRuleName,
+				Tag:       tag,
+				TagTarget: tagTarget,
+				Action:    PolicyActionDelete,
+			},
+		},
+	}
+}
+
+// ApplyDefaults sets tag names and action for rules without explicit settings
+func (p *Policy) ApplyDefaults(tag, tagTarget string) {
+	for num, rule := range p.Rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", num+1)
+		}
+
+		if rule.Tag == "" {
+			rule.Tag = tag
+		}
+
+		if rule.TagTarget == "" {
+			rule.TagTarget = tagTarget
+		}
+
+		if rule.Action == "" {
+			rule.Action = PolicyActionDelete
+		}
+	}
+}
+
+// Validate checks all rules for valid actions, durations and scope patterns
+func (p *Policy) Validate() error {
+	if len(p.Rules) == 0 {
+		return fmt.Errorf(`policy does not contain any rules`)
+	}
+
+	for _, rule := range p.Rules {
+		switch rule.Action {
+		case PolicyActionDelete, PolicyActionReport:
+		default:
+			return fmt.Errorf(`rule "%s": invalid action "%s" (expected "%s" or "%s")`, rule.Name, rule.Action, PolicyActionDelete, PolicyActionReport)
+		}
+
+		if rule.Tag == "" || rule.TagTarget == "" {
+			return fmt.Errorf(`rule "%s": tag and tagTarget must be set`, rule.Name)
+		}
+
+		// durations are parsed by the janitor, but set durations must not be blank
+		for name, value := range map[string]string{"defaultTtl": rule.DefaultTtl, "maxAge": rule.MaxAge, "maxIdle": rule.MaxIdle} {
+			if value != "" && strings.TrimSpace(value) == "" {
+				return fmt.Errorf(`rule "%s": %s must not be empty`, rule.Name, name)
+			}
+		}
+
+		for _, pattern := range append(rule.Scope.ResourceGroups, rule.Scope.ResourceTypes...) {
+			if _, err := path.Match(strings.ToLower(pattern), ""); err != nil {
+				return fmt.Errorf(`rule "%s": invalid scope pattern "%s": %w`, rule.Name, pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Match returns the first rule matching the resource
+func (p *Policy) Match(subscriptionID, resourceGroup, resourceType, location string) *PolicyRule {
+	for _, rule := range p.Rules {
+		if rule.Scope.Matches(subscriptionID, resourceGroup, resourceType, location) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// Matches checks if resource is inside the scope (empty scope lists match everything)
+func (s *PolicyRuleScope) Matches(subscriptionID, resourceGroup, resourceType, location string) bool {
+	if len(s.Subscriptions) > 0 && !policyMatchExact(s.Subscriptions, subscriptionID) {
+		return false
+	}
+
+	if len(s.ResourceGroups) > 0 && !policyMatchPattern(s.ResourceGroups, resourceGroup) {
+		return false
+	}
+
+	if !s.MatchesResourceType(resourceType) {
+		return false
+	}
+
+	if len(s.Locations) > 0 && !policyMatchExact(s.Locations, location) {
+		return false
+	}
+
+	return true
+}
+
+// MatchesResourceType checks if resources of the type can be inside the scope (empty list matches everything)
+func (s *PolicyRuleScope) MatchesResourceType(resourceType string) bool {
+	return len(s.ResourceTypes) == 0 || policyMatchPattern(s.ResourceTypes, resourceType)
+}
+
+func policyMatchExact(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func policyMatchPattern(list []string, value string) bool {
+	value = strings.ToLower(value)
+	for _, pattern := range list {
+		if matched, err := path.Match(strings.ToLower(pattern), value); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPolicyFile(t *testing.T) {
+	policyYaml := `
+rules:
+  - name: sandbox
+    scope:
+      subscriptions: ["00000000-0000-0000-0000-000000000001"]
+      resourceGroups: ["rg-dev-*"]
+      resourceTypes: ["Microsoft.Compute/*"]
+    tag: lifetime
+    defaultTtl: 7d
+  - name: report
+    action: report
+`
+	policyJson := `{"rules": [{"name": "json", "scope": {"locations": ["westeurope"]}}]}`
+
+	for name, content := range map[string]string{"policy.yaml": policyYaml, "policy.json": policyJson} {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		policy, err := LoadPolicyFile(path)
+		if err != nil {
+			t.Fatalf(`expected %v to be parsed w/o error, got: "%v"`, name, err)
+		}
+
+		policy.ApplyDefaults("ttl", "ttl_expiry")
+		if err := policy.Validate(); err != nil {
+			t.Fatalf(`expected %v to be valid, got: "%v"`, name, err)
+		}
+	}
+
+	policy, _ := LoadPolicyFile(writeTestPolicy(t, policyYaml))
+	policy.ApplyDefaults("ttl", "ttl_expiry")
+
+	sandbox := policy.Rules[0]
+	if sandbox.Tag != "lifetime" || sandbox.TagTarget != "ttl_expiry" || sandbox.Action != PolicyActionDelete {
+		t.Fatalf(`unexpected defaults for rule "%v": %+v`, sandbox.Name, sandbox)
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	policy := NewImplicitPolicy("ttl", "ttl_expiry")
+	policy.Rules[0].Action = "destroy"
+	if err := policy.Validate(); err == nil {
+		t.Fatal(`expected invalid action to fail validation`)
+	}
+
+	policy = NewImplicitPolicy("ttl", "ttl_expiry")
+	policy.Rules[0].Scope.ResourceGroups = []string{"rg-[dev"}
+	if err := policy.Validate(); err == nil {
+		t.Fatal(`expected invalid pattern to fail validation`)
+	}
+
+	policy = NewImplicitPolicy("ttl", "ttl_expiry")
+	policy.Rules[0].DefaultTtl = "  "
+	if err := policy.Validate(); err == nil {
+		t.Fatal(`expected blank defaultTtl to fail validation`)
+	}
+
+	if err := (&Policy{}).Validate(); err == nil {
+		t.Fatal(`expected empty policy to fail validation`)
+	}
+}
+
+func TestPolicyMatch(t *testing.T) {
+	policy := &Policy{
+		Rules: []*PolicyRule{
+			{
+				Name: "compute",
+				Scope: PolicyRuleScope{
+					ResourceGroups: []string{"rg-dev-*"},
+					ResourceTypes:  []string{"Microsoft.Compute/*"},
+				},
+			},
+			{
+				Name: "westeurope",
+				Scope: PolicyRuleScope{
+					Subscriptions: []string{"SUB-1"},
+					Locations:     []string{"westeurope"},
+				},
+			},
+		},
+	}
+
+	testCases := []struct {
+		subscription, resourceGroup, resourceType, location string
+		expected                                            string
+	}{
+		{"sub-1", "RG-DEV-FOO", "microsoft.compute/virtualMachines", "northeurope", "compute"},
+		{"sub-1", "rg-prod", "microsoft.compute/virtualMachines", "westeurope", "westeurope"},
+		{"sub-2", "rg-prod", "microsoft.compute/virtualMachines", "westeurope", ""},
+		{"sub-1", "rg-dev-foo", "Microsoft.Network/networkInterfaces", "northeurope", ""},
+	}
+
+	for _, testCase := range testCases {
+		rule := policy.Match(testCase.subscription, testCase.resourceGroup, testCase.resourceType, testCase.location)
+		ruleName := ""
+		if rule != nil {
+			ruleName = rule.Name
+		}
+
+		if ruleName != testCase.expected {
+			t.Fatalf(`expected rule "%v" for %+v, got: "%v"`, testCase.expected, testCase, ruleName)
+		}
+	}
+}
+
+func writeTestPolicy(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,136 @@
+package janitor
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armsubscriptions"
+	"github.com/webdevops/go-common/azuresdk/armclient"
+	"github.com/webdevops/go-common/log/slogger"
+	"github.com/webdevops/go-common/utils/to"
+
+	"github.com/webdevops/azure-janitor/config"
+)
+
+const (
+	// resource listings are expanded by these timestamps (used for default ttl, maxAge and maxIdle)
+	resourceTimestampsExpand = "createdTime,changedTime"
+)
+
+type (
+	// resourceTimestamps contains the creation and last change time of a resource (or resourceGroup)
+	resourceTimestamps struct {
+		CreatedTime *time.Time
+		ChangedTime *time.Time
+	}
+)
+
+// checkAzureResourceAge calculates the expiry time based on maxAge (creation time) and maxIdle (last change time)
+// of the rule, the earliest expiry time is returned with its plan reason (nil if the rule has no age limits).
+// Resources without creation time use the first seen time, resources without change time their creation time.
+func (j *Janitor) checkAzureResourceAge(logger *slogger.Logger, rule *config.PolicyRule, resourceId string, timestamps resourceTimestamps) (expiryTime *time.Time, reason string) {
+	if rule.MaxAge == "" && rule.MaxIdle == "" {
+		return nil, ""
+	}
+
+	createdTime := timestamps.CreatedTime
+	if createdTime == nil || createdTime.IsZero() {
+		firstSeen := j.firstSeen.get(resourceId)
+		createdTime = &firstSeen
+	}
+
+	changedTime := timestamps.ChangedTime
+	if changedTime == nil || changedTime.IsZero() {
+		changedTime = createdTime
+	}
+
+	for _, limit := range []struct {
+		value    string
+		baseTime time.Time
+		reason   string
+	}{
+		{value: rule.MaxAge, baseTime: *createdTime, reason: PlanReasonResourceAge},
+		{value: rule.MaxIdle, baseTime: *changedTime, reason: PlanReasonResourceIdle},
+	} {
+		if limit.value == "" {
+			continue
+		}
+
+		duration, err := j.parseExpiryDuration(limit.value)
+		if err != nil || duration == nil {
+			logger.Errorf("unable to parse %s limit: %v", limit.reason, err)
+			continue
+		}
+
+		limitExpiryTime := limit.baseTime.Add(*duration)
+		if expiryTime == nil || limitExpiryTime.Before(*expiryTime) {
+			expiryTime = &limitExpiryTime
+			reason = limit.reason
+		}
+	}
+
+	return expiryTime, reason
+}
+
+// policyUsesResourceTimestamps checks if any policy rule needs the creation or change time of resources
+func (j *Janitor) policyUsesResourceTimestamps() bool {
+	for _, rule := range j.Policy.Rules {
+		if rule.DefaultTtl != "" || rule.MaxAge != "" || rule.MaxIdle != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// policyUsesResourceGroupAge checks if any policy rule for resourceGroups has age limits, only these need the
+// timestamps of resourceGroups (defaultTtl of resourceGroups is based on the first seen time)
+func (j *Janitor) policyUsesResourceGroupAge() bool {
+	for _, rule := range j.Policy.Rules {
+		if (rule.MaxAge != "" || rule.MaxIdle != "") && rule.Scope.MatchesResourceType("Microsoft.Resources/resourceGroups") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fetchResourceGroupTimestamps builds the timestamps of all resourceGroups (by lowercase name) from their resources,
+// as ARM does not return them for resourceGroups: the oldest creation time (resourceGroup must be older)
+// and the latest change time of the contained resources. Empty resourceGroups are not included.
+func (j *Janitor) fetchResourceGroupTimestamps(ctx context.Context, subscription *armsubscriptions.Subscription) (map[string]resourceTimestamps, error) {
+	client, err := armresources.NewClient(*subscription.SubscriptionID, j.Azure.ClientProvider.GetCred(), j.Azure.ClientProvider.NewArmClientOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	ret := map[string]resourceTimestamps{}
+	pager := client.NewListPager(&armresources.ClientListOptions{Expand: to.StringPtr(resourceTimestampsExpand)})
+	for pager.More() {
+		result, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, resource := range result.Value {
+			azureResource, err := armclient.ParseResourceId(to.String(resource.ID))
+			if err != nil {
+				continue
+			}
+
+			resourceGroup := strings.ToLower(azureResource.ResourceGroup)
+			timestamps := ret[resourceGroup]
+			if resource.CreatedTime != nil && (timestamps.CreatedTime == nil || resource.CreatedTime.Before(*timestamps.CreatedTime)) {
+				timestamps.CreatedTime = resource.CreatedTime
+			}
+			if resource.ChangedTime != nil && (timestamps.ChangedTime == nil || resource.ChangedTime.After(*timestamps.ChangedTime)) {
+				timestamps.ChangedTime = resource.ChangedTime
+			}
+			ret[resourceGroup] = timestamps
+		}
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,156 @@
+package janitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/webdevops/azure-janitor/config"
+)
+
+func TestResourceAge(t *testing.T) {
+	contextLogger := buildTestLogger()
+
+	j := buildJanitorObj()
+	rule := &config.PolicyRule{
+		Name:    "sandbox",
+		MaxAge:  "30d",
+		MaxIdle: "7d",
+	}
+
+	createdTime := time.Now().Add(-20 * 24 * time.Hour)
+	changedTime := time.Now().Add(-1 * 24 * time.Hour)
+
+	testCases := map[string]struct {
+		timestamps resourceTimestamps
+		expiryTime time.Time
+		reason     string
+	}{
+		"recently changed": {
+			timestamps: resourceTimestamps{CreatedTime: &createdTime, ChangedTime: &changedTime},
+			expiryTime: changedTime.Add(7 * 24 * time.Hour),
+			reason:     PlanReasonResourceIdle,
+		},
+		"never changed": {
+			timestamps: resourceTimestamps{CreatedTime: &createdTime},
+			expiryTime: createdTime.Add(7 * 24 * time.Hour),
+			reason:     PlanReasonResourceIdle,
+		},
+	}
+
+	for name, testCase := range testCases {
+		expiryTime, reason := j.checkAzureResourceAge(contextLogger, rule, name, testCase.timestamps)
+		assumeNotNil(t, "age expiry time", expiryTime)
+		if !expiryTime.Equal(testCase.expiryTime) || reason != testCase.reason {
+			t.Fatalf(`%v: expected expiry "%v" (%v), got: "%v" (%v)`, name, testCase.expiryTime, testCase.reason, expiryTime, reason)
+		}
+	}
+
+	// maxAge wins if it expires first
+	rule.MaxIdle = "60d"
+	expiryTime, reason := j.checkAzureResourceAge(contextLogger, rule, "old", resourceTimestamps{CreatedTime: &createdTime, ChangedTime: &changedTime})
+	assumeNotNil(t, "age expiry time", expiryTime)
+	if !expiryTime.Equal(createdTime.Add(30*24*time.Hour)) || reason != PlanReasonResourceAge {
+		t.Fatalf(`expected maxAge expiry, got: "%v" (%v)`, expiryTime, reason)
+	}
+
+	// without limits no expiry
+	expiryTime, _ = j.checkAzureResourceAge(contextLogger, &config.PolicyRule{Name: "nolimits"}, "old", resourceTimestamps{CreatedTime: &createdTime})
+	assumeNil(t, "age expiry time", expiryTime)
+}
+
+func TestRunResourceAge(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-sandbox", nil)
+	server.AddResourceGroup(testSubscriptionId, "rg-sandbox-idle", nil)
+
+	oldId := server.AddResource(testSubscriptionId, "rg-sandbox", "Microsoft.Storage/storageAccounts", "old", nil)
+	server.SetCreatedTime(oldId, time.Now().Add(-40*24*time.Hour))
+	server.SetChangedTime(oldId, time.Now().Add(-1*time.Hour))
+
+	newId := server.AddResource(testSubscriptionId, "rg-sandbox", "Microsoft.Storage/storageAccounts", "new", nil)
+	server.SetCreatedTime(newId, time.Now().Add(-1*24*time.Hour))
+
+	// long ttl tag does not prevent age based cleanup
+	idleId := server.AddResource(testSubscriptionId, "rg-sandbox-idle", "Microsoft.Storage/storageAccounts", "idle", map[string]string{
+		"ttl": time.Now().Add(365 * 24 * time.Hour).Format(time.RFC3339),
+	})
+	server.SetCreatedTime(idleId, time.Now().Add(-20*24*time.Hour))
+	server.SetChangedTime(idleId, time.Now().Add(-14*24*time.Hour))
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.DryRun = true
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.ResourceGroups.Enable = true
+	j.Policy = &config.Policy{
+		Rules: []*config.PolicyRule{
+			{
+				Name: "sandbox",
+				Scope: config.PolicyRuleScope{
+					ResourceGroups: []string{"rg-sandbox*"},
+				},
+				MaxAge:  "30d",
+				MaxIdle: "7d",
+			},
+		},
+	}
+	j.Policy.ApplyDefaults("ttl", "ttl_expiry")
+	j.initFilters()
+	j.runJanitor(context.Background(), j.Logger)
+
+	reasons := map[string]string{}
+	for _, item := range j.GetPlan().ItemsByAction(PlanActionDelete) {
+		reasons[item.ResourceID] = item.Reason
+	}
+
+	expected := map[string]string{
+		oldId:  PlanReasonResourceAge,
+		idleId: PlanReasonResourceIdle,
+		// resourceGroup timestamps are built from the contained resources
+		"/subscriptions/" + testSubscriptionId + "/resourceGroups/rg-sandbox":      PlanReasonResourceAge,
+		"/subscriptions/" + testSubscriptionId + "/resourceGroups/rg-sandbox-idle": PlanReasonResourceIdle,
+	}
+	for resourceId, reason := range expected {
+		if reasons[resourceId] != reason {
+			t.Fatalf(`expected planned deletion of "%v" with reason "%v", got: %v`, resourceId, reason, reasons)
+		}
+	}
+
+	if _, exists := reasons[newId]; exists {
+		t.Fatalf(`expected no planned deletion of "%v", got: %v`, newId, reasons)
+	}
+}
+
+func TestRunResourceGroupTimestampsOnlyForAgeLimits(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-sandbox", nil)
+	oldId := server.AddResource(testSubscriptionId, "rg-sandbox", "Microsoft.Storage/storageAccounts", "old", nil)
+	server.SetCreatedTime(oldId, time.Now().Add(-40*24*time.Hour))
+
+	resourcesPath := "/subscriptions/" + testSubscriptionId + "/resources"
+	testCases := map[string]struct {
+		rule     *config.PolicyRule
+		expected int
+	}{
+		"defaultTtl":               {rule: &config.PolicyRule{Name: "default", DefaultTtl: "7d"}, expected: 0},
+		"maxAge of resources":      {rule: &config.PolicyRule{Name: "compute", MaxAge: "30d", Scope: config.PolicyRuleScope{ResourceTypes: []string{"Microsoft.Compute/*"}}}, expected: 0},
+		"maxAge of resourceGroups": {rule: &config.PolicyRule{Name: "sandbox", MaxAge: "30d"}, expected: 1},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			j := buildFakeJanitor(t, server)
+			j.Conf.DryRun = true
+			j.Conf.Janitor.ResourceGroups.Enable = true
+			j.Policy = &config.Policy{Rules: []*config.PolicyRule{testCase.rule}}
+			j.Policy.ApplyDefaults("ttl", "ttl_expiry")
+
+			before := countRequests(server, resourcesPath)
+			j.runJanitor(context.Background(), j.Logger)
+
+			// resources are only listed for resourceGroup timestamps if a rule for resourceGroups has age limits
+			if val := countRequests(server, resourcesPath) - before; val != testCase.expected {
+				t.Fatalf(`expected %v resource listings, got: %v`, testCase.expected, val)
+			}
+		})
+	}
+}
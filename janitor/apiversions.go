@@ -0,0 +1,417 @@
+package janitor
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armsubscriptions"
+	"github.com/webdevops/go-common/log/slogger"
+	"github.com/webdevops/go-common/utils/to"
+)
+
+const (
+	ApiVersionNoLocation = "UNDEFINED"
+
+	// minimum time between two lazy refreshes of the same resource provider namespace (per subscription)
+	apiVersionNamespaceRefreshInterval = 10 * time.Minute
+)
+
+type (
+	// apiVersionCache contains the api-versions of all resource types by subscription (lowercase id),
+	// safe for concurrent use
+	apiVersionCache struct {
+		lock          sync.RWMutex
+		subscriptions map[string]*subscriptionApiVersions
+
+		// fetchLock serializes lazy refreshes of single resource provider namespaces
+		fetchLock sync.Mutex
+	}
+
+	subscriptionApiVersions struct {
+		// updateTime is the time of the last full refresh (zero if only namespaces have been fetched)
+		updateTime time.Time
+
+		// apiVersions by "location::resourcetype" (lowercase)
+		apiVersions map[string]string
+
+		// locations translates location display names to location names
+		locations map[string]string
+
+		// namespaces contains the time of the last lazy refresh by namespace (lowercase)
+		namespaces map[string]time.Time
+	}
+
+	// ApiVersionsInfo contains the api-versions of one subscription (debug endpoint)
+	ApiVersionsInfo struct {
+		UpdateTime  *time.Time        `json:"updateTime"`
+		ApiVersions map[string]string `json:"apiVersions"`
+	}
+)
+
+func newApiVersionCache() *apiVersionCache {
+	return &apiVersionCache{
+		subscriptions: map[string]*subscriptionApiVersions{},
+	}
+}
+
+// get returns the api-version of the resource type in the location, the location independent api-version is used as fallback
+func (c *apiVersionCache) get(subscriptionId, location, resourceType string) (string, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	subscription, exists := c.subscriptions[strings.ToLower(subscriptionId)]
+	if !exists {
+		return "", false
+	}
+
+	for _, key := range []string{apiVersionKey(location, resourceType), apiVersionKey(ApiVersionNoLocation, resourceType)} {
+		if val, ok := subscription.apiVersions[key]; ok {
+			return val, true
+		}
+	}
+
+	return "", false
+}
+
+// updateTime returns the time of the last full refresh of the subscription (zero if never refreshed)
+func (c *apiVersionCache) updateTime(subscriptionId string) time.Time {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if subscription, exists := c.subscriptions[strings.ToLower(subscriptionId)]; exists {
+		return subscription.updateTime
+	}
+	return time.Time{}
+}
+
+// set replaces the api-versions of the subscription (full refresh)
+func (c *apiVersionCache) set(subscriptionId string, locations, apiVersions map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.subscriptions[strings.ToLower(subscriptionId)] = &subscriptionApiVersions{
+		updateTime:  time.Now(),
+		apiVersions: apiVersions,
+		locations:   locations,
+		namespaces:  map[string]time.Time{},
+	}
+}
+
+// snapshot returns a copy of all api-versions by subscription
+func (c *apiVersionCache) snapshot() map[string]ApiVersionsInfo {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	ret := map[string]ApiVersionsInfo{}
+	for subscriptionId, subscription := range c.subscriptions {
+		info := ApiVersionsInfo{ApiVersions: maps.Clone(subscription.apiVersions)}
+		if !subscription.updateTime.IsZero() {
+			updateTime := subscription.updateTime
+			info.UpdateTime = &updateTime
+		}
+		ret[subscriptionId] = info
+	}
+	return ret
+}
+
+func (j *Janitor) initAzureApiVersions() {
+	ctx := context.Background()
+
+	j.apiVersions.Store(newApiVersionCache())
+
+	if err := j.updateSubscriptions(ctx, j.Logger); err != nil {
+		j.recordRunError(j.Logger, "", "subscriptions", "Microsoft.Resources/subscriptions", err)
+	}
+
+	j.updateAzureApiVersions(ctx, j.Logger)
+}
+
+// updateAzureApiVersions fetches the api-versions of all subscriptions without api-versions (eg. new subscriptions)
+// or with api-versions older than the refresh interval
+func (j *Janitor) updateAzureApiVersions(ctx context.Context, logger *slogger.Logger) {
+	j.forEachSubscription(func(subscription *armsubscriptions.Subscription) {
+		subscriptionId := to.String(subscription.SubscriptionID)
+
+		updateTime := j.apiVersions.Load().updateTime(subscriptionId)
+		if !updateTime.IsZero() && (j.Conf.Janitor.ApiVersion.Refresh <= 0 || time.Since(updateTime) < j.Conf.Janitor.ApiVersion.Refresh) {
+			return
+		}
+
+		contextLogger := logger.With(slog.String("subscriptionID", subscriptionId))
+		if err := j.fetchAzureApiVersions(ctx, contextLogger, subscription); err != nil {
+			j.recordRunError(contextLogger, subscriptionId, "apiVersions", "Microsoft.Resources/providers", err)
+		}
+	})
+}
+
+// fetchAzureApiVersions fetches the available api-versions of all resource providers of one subscription
+func (j *Janitor) fetchAzureApiVersions(ctx context.Context, logger *slogger.Logger, subscription *armsubscriptions.Subscription) error {
+	logger.Infof(`fetch Azure available api-versions`)
+
+	// fetch location translation map
+	subscriptionClient, err := armsubscriptions.NewClient(j.Azure.ClientProvider.GetCred(), j.Azure.ClientProvider.NewArmClientOptions())
+	if err != nil {
+		return err
+	}
+
+	locationPager := subscriptionClient.NewListLocationsPager(*subscription.SubscriptionID, nil)
+	locationMap := map[string]string{}
+	for locationPager.More() {
+		result, err := locationPager.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, location := range result.Value {
+			locationDisplayName := to.String(location.DisplayName)
+			locationName := to.String(location.Name)
+			locationMap[locationDisplayName] = locationName
+		}
+	}
+
+	providersClient, err := armresources.NewProvidersClient(*subscription.SubscriptionID, j.Azure.ClientProvider.GetCred(), j.Azure.ClientProvider.NewArmClientOptions())
+	if err != nil {
+		return err
+	}
+
+	providerPager := providersClient.NewListPager(nil)
+	apiVersionMap := map[string]string{}
+	for providerPager.More() {
+		result, err := providerPager.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, provider := range result.Value {
+			addProviderApiVersions(apiVersionMap, locationMap, provider)
+		}
+	}
+
+	j.apiVersions.Load().set(to.String(subscription.SubscriptionID), locationMap, apiVersionMap)
+
+	return nil
+}
+
+// refreshAzureApiVersionsForNamespace fetches the api-versions of one resource provider namespace (eg. after it has been
+// registered) and adds them to the api-versions of the subscription. Each namespace is fetched at most once within
+// apiVersionNamespaceRefreshInterval.
+func (j *Janitor) refreshAzureApiVersionsForNamespace(ctx context.Context, logger *slogger.Logger, subscriptionId, namespace string) error {
+	c := j.apiVersions.Load()
+	c.fetchLock.Lock()
+	defer c.fetchLock.Unlock()
+
+	subscriptionKey := strings.ToLower(subscriptionId)
+	namespaceKey := strings.ToLower(namespace)
+
+	c.lock.Lock()
+	subscription, exists := c.subscriptions[subscriptionKey]
+	if !exists {
+		// initial fetch failed, full refresh is done with next run
+		subscription = &subscriptionApiVersions{
+			apiVersions: map[string]string{},
+			locations:   map[string]string{},
+			namespaces:  map[string]time.Time{},
+		}
+		c.subscriptions[subscriptionKey] = subscription
+	}
+	lastRefresh := subscription.namespaces[namespaceKey]
+	if time.Since(lastRefresh) < apiVersionNamespaceRefreshInterval {
+		c.lock.Unlock()
+		return nil
+	}
+	subscription.namespaces[namespaceKey] = time.Now()
+	locationMap := subscription.locations
+	c.lock.Unlock()
+
+	logger.Infof(`fetch Azure available api-versions for namespace "%s"`, namespace)
+
+	providersClient, err := armresources.NewProvidersClient(subscriptionId, j.Azure.ClientProvider.GetCred(), j.Azure.ClientProvider.NewArmClientOptions())
+	if err != nil {
+		return err
+	}
+
+	result, err := providersClient.Get(ctx, namespace, nil)
+	if err != nil {
+		return err
+	}
+
+	apiVersionMap := map[string]string{}
+	addProviderApiVersions(apiVersionMap, locationMap, &result.Provider)
+
+	c.lock.Lock()
+	maps.Copy(subscription.apiVersions, apiVersionMap)
+	c.lock.Unlock()
+
+	return nil
+}
+
+// getAzureApiVersionForResourceType returns the api-version for the resource type (configured override first),
+// the resource provider namespace is fetched again if the resource type is unknown (eg. newly registered resource provider)
+func (j *Janitor) getAzureApiVersionForResourceType(ctx context.Context, logger *slogger.Logger, subscriptionId, location, resourceType string) string {
+	if apiVersion, ok := j.Conf.Janitor.ApiVersion.Overrides[strings.ToLower(resourceType)]; ok {
+		return apiVersion
+	}
+
+	if apiVersion, ok := j.apiVersions.Load().get(subscriptionId, location, resourceType); ok {
+		return apiVersion
+	}
+
+	namespace, _, _ := strings.Cut(resourceType, "/")
+	if err := j.refreshAzureApiVersionsForNamespace(ctx, logger, subscriptionId, namespace); err != nil {
+		logger.Warnf(`unable to fetch api-versions for namespace "%s": %v`, namespace, err.Error())
+	}
+
+	apiVersion, _ := j.apiVersions.Load().get(subscriptionId, location, resourceType)
+	return apiVersion
+}
+
+// GetApiVersions returns a copy of the api-versions of all subscriptions
+func (j *Janitor) GetApiVersions() map[string]ApiVersionsInfo {
+	apiVersions := j.apiVersions.Load()
+	if apiVersions == nil {
+		return map[string]ApiVersionsInfo{}
+	}
+	return apiVersions.snapshot()
+}
+
+// addProviderApiVersions adds the api-versions of all resource types of the provider (by location and without location)
+func addProviderApiVersions(apiVersionMap, locationMap map[string]string, provider *armresources.Provider) {
+	if provider.ResourceTypes == nil {
+		return
+	}
+
+	for _, resourceType := range provider.ResourceTypes {
+		if resourceType.APIVersions == nil {
+			continue
+		}
+
+		resourceTypeName := fmt.Sprintf(
+			"%s/%s",
+			strings.ToLower(to.String(provider.Namespace)),
+			strings.ToLower(to.String(resourceType.ResourceType)),
+		)
+
+		apiVersions := []string{}
+		for _, val := range resourceType.APIVersions {
+			if val != nil {
+				apiVersions = append(apiVersions, *val)
+			}
+		}
+		providerApiVersion := selectApiVersion(apiVersions)
+		if providerApiVersion == "" {
+			continue
+		}
+
+		// add all locations (if available)
+		for _, val := range resourceType.Locations {
+			if val == nil {
+				continue
+			}
+			location := to.String(val)
+
+			// try to translate location to internal type
+			if val, ok := locationMap[location]; ok {
+				location = val
+			}
+
+			apiVersionMap[apiVersionKey(location, resourceTypeName)] = providerApiVersion
+		}
+
+		// add no location fallback
+		apiVersionMap[apiVersionKey(ApiVersionNoLocation, resourceTypeName)] = providerApiVersion
+	}
+}
+
+// selectApiVersion returns the newest stable api-version or the newest preview api-version if no stable api-version is available
+func selectApiVersion(apiVersions []string) string {
+	stableApiVersion := ""
+	previewApiVersion := ""
+	for _, apiVersion := range apiVersions {
+		apiVersion = strings.TrimSpace(apiVersion)
+		if apiVersion == "" {
+			continue
+		}
+
+		if _, suffix, ok := parseApiVersion(apiVersion); ok && suffix == "" {
+			if stableApiVersion == "" || compareApiVersions(apiVersion, stableApiVersion) > 0 {
+				stableApiVersion = apiVersion
+			}
+		} else {
+			if previewApiVersion == "" || compareApiVersions(apiVersion, previewApiVersion) > 0 {
+				previewApiVersion = apiVersion
+			}
+		}
+	}
+
+	if stableApiVersion != "" {
+		return stableApiVersion
+	}
+	return previewApiVersion
+}
+
+// compareApiVersions compares two api-versions by date, at the same date stable is newer than preview
+// and preview is newer than other suffixes (eg. alpha, beta, privatepreview). Api-versions without date are the oldest.
+func compareApiVersions(a, b string) int {
+	aDate, aSuffix, aOk := parseApiVersion(a)
+	bDate, bSuffix, bOk := parseApiVersion(b)
+
+	switch {
+	case aOk && !bOk:
+		return 1
+	case !aOk && bOk:
+		return -1
+	case !aOk && !bOk:
+		return strings.Compare(a, b)
+	}
+
+	if val := aDate.Compare(bDate); val != 0 {
+		return val
+	}
+
+	if val := cmp.Compare(apiVersionSuffixRank(aSuffix), apiVersionSuffixRank(bSuffix)); val != 0 {
+		return val
+	}
+
+	return strings.Compare(aSuffix, bSuffix)
+}
+
+// parseApiVersion splits an api-version (eg. 2023-01-01-preview) into date and lowercase suffix (without leading dash)
+func parseApiVersion(apiVersion string) (time.Time, string, bool) {
+	if len(apiVersion) < len(time.DateOnly) {
+		return time.Time{}, "", false
+	}
+
+	date, err := time.Parse(time.DateOnly, apiVersion[:len(time.DateOnly)])
+	if err != nil {
+		return time.Time{}, "", false
+	}
+
+	suffix := apiVersion[len(time.DateOnly):]
+	if suffix != "" && !strings.HasPrefix(suffix, "-") {
+		return time.Time{}, "", false
+	}
+
+	return date, strings.ToLower(strings.TrimPrefix(suffix, "-")), true
+}
+
+func apiVersionSuffixRank(suffix string) int {
+	switch suffix {
+	case "":
+		return 2
+	case "preview":
+		return 1
+	default:
+		return 0
+	}
+}
+
+func apiVersionKey(location, resourceType string) string {
+	return strings.ToLower(fmt.Sprintf("%s::%s", location, resourceType))
+}
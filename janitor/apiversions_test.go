@@ -0,0 +1,154 @@
+package janitor
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countRequests returns the number of GET requests with the path suffix (case insensitive)
+func countRequests(server *fakeArmServer, suffix string) int {
+	count := 0
+	for _, request := range server.Requests("GET") {
+		if strings.HasSuffix(strings.ToLower(request), strings.ToLower(suffix)) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestRunApiVersionLazyRefresh(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+
+	// resource provider registered after startup
+	server.AddProvider(testSubscriptionId, "Microsoft.Compute", "disks", "2023-01-01")
+	expiredId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Compute/disks", "expired", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+	unknownId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Unknown/things", "expired", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+
+	j.runJanitor(context.Background(), j.Logger)
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "expired resource exists", false, server.Exists(expiredId))
+	assumeState(t, "resource with unknown provider exists", true, server.Exists(unknownId))
+
+	// unknown namespaces are fetched only once within the refresh interval
+	if val := countRequests(server, "/providers/Microsoft.Unknown"); val != 1 {
+		t.Fatalf(`expected one request for unknown namespace, got: %v`, val)
+	}
+	if val := countRequests(server, "/providers/Microsoft.Compute"); val != 1 {
+		t.Fatalf(`expected one request for new namespace, got: %v`, val)
+	}
+
+	apiVersions := j.GetApiVersions()[testSubscriptionId].ApiVersions
+	if val := apiVersions[apiVersionKey(ApiVersionNoLocation, "Microsoft.Compute/disks")]; val != "2023-01-01" {
+		t.Fatalf(`expected api-version of new namespace, got: %v`, apiVersions)
+	}
+}
+
+func TestApiVersionsConcurrentInit(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	j := buildFakeJanitor(t, server)
+
+	// debug endpoint might be called while the janitor is still initializing
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			j.GetApiVersions()
+		}
+	}()
+	j.initAzureApiVersions()
+	wg.Wait()
+
+	if _, exists := j.GetApiVersions()[testSubscriptionId]; !exists {
+		t.Fatalf(`expected api-versions of subscription, got: %v`, j.GetApiVersions())
+	}
+}
+
+func TestRunApiVersionRefresh(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	providersPath := "/subscriptions/" + testSubscriptionId + "/providers"
+
+	// no refresh within the interval
+	j.Conf.Janitor.ApiVersion.Refresh = time.Hour
+	j.runJanitor(context.Background(), j.Logger)
+	if val := countRequests(server, providersPath); val != 1 {
+		t.Fatalf(`expected api-versions fetched only at startup, got %v requests`, val)
+	}
+
+	// refresh after the interval
+	j.Conf.Janitor.ApiVersion.Refresh = time.Nanosecond
+	j.runJanitor(context.Background(), j.Logger)
+	if val := countRequests(server, providersPath); val != 2 {
+		t.Fatalf(`expected api-versions refreshed, got %v requests`, val)
+	}
+
+	info := j.GetApiVersions()[testSubscriptionId]
+	if info.UpdateTime == nil || time.Since(*info.UpdateTime) > time.Minute {
+		t.Fatalf(`expected recent update time, got: %v`, info.UpdateTime)
+	}
+}
+
+func TestSelectApiVersion(t *testing.T) {
+	testCases := map[string]struct {
+		apiVersions []string
+		expected    string
+	}{
+		"empty":                 {apiVersions: nil, expected: ""},
+		"newest stable":         {apiVersions: []string{"2019-06-01", "2023-01-01", "2021-04-01"}, expected: "2023-01-01"},
+		"stable before preview": {apiVersions: []string{"2024-01-01-preview", "2022-09-01", "2023-05-01-preview"}, expected: "2022-09-01"},
+		"newest preview":        {apiVersions: []string{"2021-01-01-preview", "2023-01-01-beta", "2022-01-01-preview"}, expected: "2023-01-01-beta"},
+		"preview before beta":   {apiVersions: []string{"2023-01-01-beta", "2023-01-01-preview", "2023-01-01-alpha"}, expected: "2023-01-01-preview"},
+		"without date":          {apiVersions: []string{"1.0", "2015-01-01-preview"}, expected: "2015-01-01-preview"},
+		"only without date":     {apiVersions: []string{"1.0", "2.0", ""}, expected: "2.0"},
+	}
+
+	for name, testCase := range testCases {
+		if val := selectApiVersion(testCase.apiVersions); val != testCase.expected {
+			t.Fatalf(`%s: expected api-version "%v", got "%v"`, name, testCase.expected, val)
+		}
+	}
+}
+
+func TestRunApiVersionOverride(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+	server.AddProvider(testSubscriptionId, "Microsoft.Compute", "disks", "2019-07-01", "2023-04-02", "2024-03-01-preview", "2021-12-01")
+	server.AddProvider(testSubscriptionId, "Microsoft.Web", "sites", "2022-03-01", "2023-12-01")
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.ApiVersion.Overrides = map[string]string{
+		"microsoft.web/sites": "2020-06-01",
+	}
+
+	expiredTags := map[string]string{"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339)}
+	diskId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Compute/disks", "expired", expiredTags)
+	siteId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Web/sites", "expired", expiredTags)
+
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "expired disk exists", false, server.Exists(diskId))
+	assumeState(t, "expired site exists", false, server.Exists(siteId))
+
+	if val := server.ApiVersions("DELETE", diskId); len(val) != 1 || val[0] != "2023-04-02" {
+		t.Fatalf(`expected newest stable api-version for disk, got: %v`, val)
+	}
+	if val := server.ApiVersions("DELETE", siteId); len(val) != 1 || val[0] != "2020-06-01" {
+		t.Fatalf(`expected override api-version for site, got: %v`, val)
+	}
+}
@@ -0,0 +1,149 @@
+package janitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/webdevops/go-common/log/slogger"
+	"github.com/webdevops/go-common/utils/to"
+)
+
+const (
+	AuditResultSuccess = "success"
+	AuditResultFailed  = "failed"
+	AuditResultTimeout = "timeout"
+	AuditResultSkipped = "skipped"
+
+	AuditSkipReasonDryRun          = "dry run"
+	AuditSkipReasonReportOnly      = "report only"
+	AuditSkipReasonDeletionPending = "deletion pending"
+	AuditSkipReasonProtected       = "protected"
+)
+
+type (
+	// AuditEvent is a durable record of one delete, tag rewrite or skipped action of the janitor
+	AuditEvent struct {
+		Time time.Time `json:"time"`
+		PlanItem
+		Tags    map[string]string `json:"tags,omitempty"`
+		DryRun  bool              `json:"dryRun"`
+		Result  string            `json:"result"`
+		Message string            `json:"message,omitempty"`
+	}
+
+	// AuditSink writes audit events to one output
+	AuditSink interface {
+		Name() string
+		Write(ctx context.Context, event AuditEvent) error
+	}
+
+	// jsonlAuditSink writes audit events as json lines (file or stdout)
+	jsonlAuditSink struct {
+		name   string
+		writer io.Writer
+		lock   sync.Mutex
+	}
+
+	// webhookAuditSink posts each audit event as json to a webhook
+	webhookAuditSink struct {
+		url    string
+		client *http.Client
+	}
+)
+
+func (j *Janitor) initAudit() {
+	j.auditSinks = []AuditSink{}
+
+	if j.Conf.Janitor.Audit.File != "" {
+		file, err := os.OpenFile(j.Conf.Janitor.Audit.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			j.Logger.Fatalf(`unable to open audit file "%s": %v`, j.Conf.Janitor.Audit.File, err.Error())
+		}
+		j.auditSinks = append(j.auditSinks, &jsonlAuditSink{name: "file", writer: file})
+	}
+
+	if j.Conf.Janitor.Audit.Stdout {
+		j.auditSinks = append(j.auditSinks, &jsonlAuditSink{name: "stdout", writer: os.Stdout})
+	}
+
+	if j.Conf.Janitor.Audit.Webhook != "" {
+		j.auditSinks = append(j.auditSinks, &webhookAuditSink{
+			url:    j.Conf.Janitor.Audit.Webhook,
+			client: &http.Client{Timeout: j.Conf.Janitor.Audit.Timeout},
+		})
+	}
+}
+
+// writeAuditEvent writes the audit event for the plan item to all audit sinks, failed sinks are logged only
+func (j *Janitor) writeAuditEvent(ctx context.Context, logger *slogger.Logger, item PlanItem, tags map[string]*string, result, message string) {
+	if len(j.auditSinks) == 0 {
+		return
+	}
+
+	event := AuditEvent{
+		Time:     time.Now(),
+		PlanItem: item,
+		Tags:     to.StringMap(tags),
+		DryRun:   j.Conf.DryRun,
+		Result:   result,
+		Message:  message,
+	}
+
+	for _, sink := range j.auditSinks {
+		if err := sink.Write(ctx, event); err != nil {
+			logger.Errorf(`unable to write audit event to "%s": %v`, sink.Name(), err.Error())
+		}
+	}
+}
+
+func (s *jsonlAuditSink) Name() string {
+	return s.name
+}
+
+func (s *jsonlAuditSink) Write(ctx context.Context, event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err = s.writer.Write(append(line, '\n'))
+	return err
+}
+
+func (s *webhookAuditSink) Name() string {
+	return "webhook"
+}
+
+func (s *webhookAuditSink) Write(ctx context.Context, event AuditEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %v", resp.StatusCode)
+	}
+
+	return nil
+}
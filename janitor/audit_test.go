@@ -0,0 +1,116 @@
+package janitor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAuditFile(t *testing.T, path string) []AuditEvent {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf(`unable to open audit file: %v`, err)
+	}
+	defer file.Close() // nolint:errcheck
+
+	events := []AuditEvent{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		event := AuditEvent{}
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf(`unable to parse audit line "%s": %v`, scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+
+	return events
+}
+
+func findAuditEvent(events []AuditEvent, resourceId, action string) *AuditEvent {
+	for _, event := range events {
+		if strings.EqualFold(event.ResourceID, resourceId) && event.Action == action {
+			return &event
+		}
+	}
+	return nil
+}
+
+func TestRunAuditLog(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+	expiredId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "expired", map[string]string{
+		"ttl":   time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+		"owner": "alice",
+	})
+	relativeId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "relative", map[string]string{
+		"ttl": "5d",
+	})
+	failedId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "failed", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+	server.LongRunningDelete(failedId, 0, true)
+
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+
+	j := buildJanitorObj()
+	j.Conf.Janitor.Audit.File = auditFile
+	j = buildFakeJanitorFromObj(t, server, j)
+	j.Conf.Janitor.Resources.Enable = true
+	j.runJanitor(context.Background(), j.Logger)
+
+	events := readAuditFile(t, auditFile)
+	if len(events) != 3 {
+		t.Fatalf(`expected 3 audit events, got: %v`, events)
+	}
+
+	if event := findAuditEvent(events, expiredId, PlanActionDelete); event == nil || event.Result != AuditResultSuccess || event.Tags["owner"] != "alice" || event.Rule != "default" || event.ExpiryTime == nil || event.DryRun {
+		t.Fatalf(`expected successful delete audit event for "%v", got: %v`, expiredId, event)
+	}
+
+	if event := findAuditEvent(events, failedId, PlanActionDelete); event == nil || event.Result != AuditResultFailed || event.Message == "" {
+		t.Fatalf(`expected failed delete audit event for "%v", got: %v`, failedId, event)
+	}
+
+	if event := findAuditEvent(events, relativeId, PlanActionUpdateTags); event == nil || event.Result != AuditResultSuccess || event.Tags["ttl_expiry"] == "" {
+		t.Fatalf(`expected tag update audit event for "%v", got: %v`, relativeId, event)
+	}
+}
+
+func TestRunAuditLogSkipped(t *testing.T) {
+	receiver := newTestNotificationReceiver(t)
+
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+	server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "expired", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+	server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "relative", map[string]string{
+		"ttl": "5d",
+	})
+
+	j := buildJanitorObj()
+	j.Conf.DryRun = true
+	j.Conf.Janitor.Audit.Webhook = receiver.server.URL + "/audit"
+	j.Conf.Janitor.Audit.Timeout = 10 * time.Second
+	j = buildFakeJanitorFromObj(t, server, j)
+	j.Conf.Janitor.Resources.Enable = true
+	j.runJanitor(context.Background(), j.Logger)
+
+	payloads := receiver.Payloads("/audit")
+	if len(payloads) != 2 {
+		t.Fatalf(`expected 2 audit events, got: %v`, payloads)
+	}
+
+	for _, payload := range payloads {
+		if payload["result"] != AuditResultSkipped || payload["message"] != AuditSkipReasonDryRun || payload["dryRun"] != true {
+			t.Fatalf(`expected skipped dry run audit event, got: %v`, payload)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package janitor
+
+import (
+	"context"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armsubscriptions"
+)
+
+type (
+	// AzureClientProvider provides credentials, client options and subscriptions for all Azure SDK clients
+	// used by the janitor (implemented by armclient.ArmClient)
+	AzureClientProvider interface {
+		GetCred() azcore.TokenCredential
+		NewArmClientOptions() *arm.ClientOptions
+		ListSubscriptions(ctx context.Context) (map[string]*armsubscriptions.Subscription, error)
+	}
+)
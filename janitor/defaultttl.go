@@ -0,0 +1,72 @@
+package janitor
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTtlBaseCreatedTime   = "creation time"
+	DefaultTtlBaseFirstSeenTime = "first seen time"
+)
+
+type (
+	// firstSeenCache remembers when a resource without ttl tag was seen first (across runs),
+	// used as base for the default ttl if the creation time of the resource is not available.
+	// The cache is process-local, resources not seen in a complete run are evicted.
+	firstSeenCache struct {
+		times map[string]time.Time
+		lock  sync.Mutex
+
+		// seen contains the resources seen in the current run
+		seen map[string]struct{}
+	}
+)
+
+// defaultTtlBaseTime returns the base time for the default ttl of a resource without ttl tag,
+// the creation time of the resource is preferred and the first seen time is used otherwise
+func (j *Janitor) defaultTtlBaseTime(resourceId string, resourceCreatedTime *time.Time) (time.Time, string) {
+	if resourceCreatedTime != nil && !resourceCreatedTime.IsZero() {
+		return *resourceCreatedTime, DefaultTtlBaseCreatedTime
+	}
+
+	return j.firstSeen.get(resourceId), DefaultTtlBaseFirstSeenTime
+}
+
+// get returns the first seen time of the resource, the current time is stored if the resource is seen for the first time
+func (c *firstSeenCache) get(resourceId string) time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.times == nil {
+		c.times = map[string]time.Time{}
+		c.seen = map[string]struct{}{}
+	}
+
+	resourceId = strings.ToLower(resourceId)
+	c.seen[resourceId] = struct{}{}
+	if firstSeen, exists := c.times[resourceId]; exists {
+		return firstSeen
+	}
+
+	firstSeen := time.Now()
+	c.times[resourceId] = firstSeen
+	return firstSeen
+}
+
+// finishRun removes the resources not seen in the current run (only for complete runs, resources of failed
+// subscriptions or tasks would lose their first seen time otherwise) and starts tracking of the next run
+func (c *firstSeenCache) finishRun(complete bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if complete {
+		for resourceId := range c.times {
+			if _, exists := c.seen[resourceId]; !exists {
+				delete(c.times, resourceId)
+			}
+		}
+	}
+	c.seen = map[string]struct{}{}
+}
@@ -0,0 +1,161 @@
+package janitor
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/webdevops/go-common/log/slogger"
+)
+
+const (
+	// number of retries of dependents which are still in use after their parents have been deleted
+	// (eg. network interfaces are reserved for a short time after the virtual machine has been deleted)
+	deleteInUseRetries = 3
+)
+
+var (
+	// resourceDeleteDependencies contains the known dependencies between resource types (lowercase),
+	// dependents are deleted after all expired resources of the parent type are gone
+	resourceDeleteDependencies = map[string][]string{
+		"microsoft.compute/virtualmachines": {
+			"microsoft.network/networkinterfaces",
+			"microsoft.compute/disks",
+		},
+		"microsoft.network/networkinterfaces": {
+			"microsoft.network/publicipaddresses",
+			"microsoft.network/networksecuritygroups",
+		},
+	}
+
+	// resourceInUseErrorCodes contains (lowercase) Azure error codes for resources still used by other resources
+	resourceInUseErrorCodes = []string{
+		"nicinuse",
+		"nicreservedforanothervm",
+		"inusesubnetcannotbedeleted",
+		"inusenetworksecuritygroupcannotbedeleted",
+		"publicipaddressinuse",
+	}
+)
+
+type (
+	// orderedDeletion is a delete operation which is executed after the listing in dependency order
+	orderedDeletion struct {
+		logger   *slogger.Logger
+		deletion deletion
+	}
+
+	// deletionLevelOptions are applied to all delete operations of one level (see deletion)
+	deletionLevelOptions struct {
+		wait       bool
+		retryInUse bool
+	}
+)
+
+// resourceDeleteLevel returns the position of the resource type in the delete order (parents first):
+// 0 for resource types without known parents, otherwise the longest path from a parent without parents
+func resourceDeleteLevel(resourceType string) int {
+	return resourceDeleteLevelWithPath(strings.ToLower(resourceType), nil)
+}
+
+func resourceDeleteLevelWithPath(resourceType string, path []string) int {
+	if slices.Contains(path, resourceType) {
+		// dependency cycle, should not happen
+		return 0
+	}
+
+	level := 0
+	for parentType, dependentTypes := range resourceDeleteDependencies {
+		if slices.Contains(dependentTypes, resourceType) {
+			level = max(level, resourceDeleteLevelWithPath(parentType, append(path, resourceType))+1)
+		}
+	}
+	return level
+}
+
+// isResourceInUseError detects errors of resources which cannot be deleted because they are still in use
+// by another resource (eg. network interface attached to virtual machine)
+func isResourceInUseError(err error) bool {
+	var responseErr *azcore.ResponseError
+	if !errors.As(err, &responseErr) {
+		return false
+	}
+
+	errorCode := strings.ToLower(responseErr.ErrorCode)
+	switch {
+	case slices.Contains(resourceInUseErrorCodes, errorCode):
+		return true
+	case errorCode == "operationnotallowed":
+		// generic error code, only attached disks are in use (eg. "Disk xxx is attached to VM yyy.")
+		return strings.Contains(strings.ToLower(responseErr.Error()), "is attached to")
+	}
+
+	return false
+}
+
+// runOrderedDeletions executes the delete operations of one task run ordered by the known dependencies of their
+// resource types: each level is deleted in parallel (limited by deletion concurrency) and waited for before the next
+// level starts. Dependents failing because they are still in use are retried within the run.
+func (j *Janitor) runOrderedDeletions(ctx context.Context, items []orderedDeletion) {
+	levels := map[int][]orderedDeletion{}
+	for _, item := range items {
+		level := resourceDeleteLevel(item.deletion.resourceType)
+		levels[level] = append(levels[level], item)
+	}
+
+	levelList := slices.Sorted(maps.Keys(levels))
+
+	for num, level := range levelList {
+		pending := levels[level]
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(j.Conf.Janitor.Delete.PollInterval):
+				}
+			}
+
+			outcomes := j.runDeletionLevel(ctx, pending, deletionLevelOptions{
+				// dependents need finished delete operations of their parents
+				wait: num < len(levelList)-1,
+				// parents have been deleted in this run, dependents might still be in use for a short time
+				retryInUse: num > 0 && attempt < deleteInUseRetries,
+			})
+
+			inUse := []orderedDeletion{}
+			for itemNum, outcome := range outcomes {
+				if outcome == deletionInUse {
+					inUse = append(inUse, pending[itemNum])
+				}
+			}
+			pending = inUse
+		}
+	}
+}
+
+// runDeletionLevel executes the delete operations in parallel (limited by deletion concurrency) and returns
+// the outcome of each deletion (same order as items)
+func (j *Janitor) runDeletionLevel(ctx context.Context, items []orderedDeletion, opts deletionLevelOptions) []deletionOutcome {
+	var wg sync.WaitGroup
+
+	outcomes := make([]deletionOutcome, len(items))
+	for num, item := range items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			item.deletion.wait = opts.wait
+			item.deletion.retryInUse = opts.retryInUse
+			outcomes[num] = j.runDeletion(ctx, item.logger, item.deletion)
+		}()
+	}
+	wg.Wait()
+
+	return outcomes
+}
@@ -0,0 +1,133 @@
+package janitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestResourceDeleteLevel(t *testing.T) {
+	testCases := map[string]int{
+		"Microsoft.Storage/storageAccounts":       0,
+		"Microsoft.Compute/virtualMachines":       0,
+		"Microsoft.Compute/disks":                 1,
+		"Microsoft.Network/networkInterfaces":     1,
+		"Microsoft.Network/publicIPAddresses":     2,
+		"Microsoft.Network/networkSecurityGroups": 2,
+	}
+
+	for resourceType, expected := range testCases {
+		if val := resourceDeleteLevel(resourceType); val != expected {
+			t.Fatalf(`%s: expected delete level %v, got %v`, resourceType, expected, val)
+		}
+	}
+}
+
+func TestIsResourceInUseError(t *testing.T) {
+	newError := func(code, message string) error {
+		return &azcore.ResponseError{
+			ErrorCode:  code,
+			StatusCode: http.StatusBadRequest,
+			RawResponse: &http.Response{
+				StatusCode: http.StatusBadRequest,
+				Body:       io.NopCloser(strings.NewReader(fmt.Sprintf(`{"error":{"code":"%s","message":"%s"}}`, code, message))),
+				Request:    &http.Request{Method: http.MethodDelete, URL: &url.URL{}},
+			},
+		}
+	}
+
+	testCases := map[error]bool{
+		newError("NicInUse", "nic is in use"):                                   true,
+		newError("NicReservedForAnotherVm", "nic is reserved"):                  true,
+		newError("InUseSubnetCannotBeDeleted", "subnet is in use"):              true,
+		newError("InUseNetworkSecurityGroupCannotBeDeleted", "nsg is in use"):   true,
+		newError("PublicIPAddressInUse", "public ip is in use"):                 true,
+		newError("OperationNotAllowed", "Disk disk-1 is attached to VM vm-1."):  true,
+		newError("OperationNotAllowed", "Operation not allowed on this scope."): false,
+		newError("InUseRouteTableCannotBeDeleted", "route table is in use"):     false,
+		newError("ScopeLocked", "scope is locked"):                              false,
+		errors.New("NicInUse"): false,
+	}
+
+	for err, expected := range testCases {
+		if val := isResourceInUseError(err); val != expected {
+			t.Fatalf(`%v: expected in use %v, got %v`, err, expected, val)
+		}
+	}
+}
+
+func TestRunDeletionOrder(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+	server.AddProvider(testSubscriptionId, "Microsoft.Compute", "virtualMachines", "2023-03-01")
+	server.AddProvider(testSubscriptionId, "Microsoft.Compute", "disks", "2023-04-02")
+	server.AddProvider(testSubscriptionId, "Microsoft.Network", "networkInterfaces", "2023-09-01")
+	server.AddProvider(testSubscriptionId, "Microsoft.Network", "publicIPAddresses", "2023-09-01")
+	server.AddProvider(testSubscriptionId, "Microsoft.Network", "networkSecurityGroups", "2023-09-01")
+
+	expiredTags := func() map[string]string {
+		return map[string]string{"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339)}
+	}
+
+	// public ip and nsg are listed before the network interface, network interface and disk before the vm
+	pipId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Network/publicIPAddresses", "a-pip", expiredTags())
+	nsgId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Network/networkSecurityGroups", "a-nsg", expiredTags())
+	nicId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Network/networkInterfaces", "b-nic", expiredTags())
+	diskId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Compute/disks", "b-disk", expiredTags())
+	vmId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Compute/virtualMachines", "c-vm", expiredTags())
+
+	server.LongRunningDelete(vmId, 3, false)
+	server.AddDependency(nicId, vmId, 1)
+	server.AddDependency(diskId, vmId, 0)
+	server.AddDependency(pipId, nicId, 0)
+	server.AddDependency(nsgId, nicId, 0)
+
+	// network interface of a valid vm stays in use
+	validVmId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Compute/virtualMachines", "valid-vm", map[string]string{
+		"ttl": time.Now().Add(1 * time.Hour).Format(time.RFC3339),
+	})
+	attachedNicId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Network/networkInterfaces", "attached-nic", expiredTags())
+	server.AddDependency(attachedNicId, validVmId, 0)
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.Delete.Async = true
+	j.runJanitor(context.Background(), j.Logger)
+
+	for name, resourceId := range map[string]string{"vm": vmId, "nic": nicId, "disk": diskId, "pip": pipId, "nsg": nsgId} {
+		assumeState(t, "expired "+name+" exists", false, server.Exists(resourceId))
+	}
+	assumeState(t, "valid vm exists", true, server.Exists(validVmId))
+	assumeState(t, "attached nic exists", true, server.Exists(attachedNicId))
+
+	if requests := server.Requests("DELETE"); len(requests) == 0 || !strings.HasSuffix(requests[0], "/c-vm") {
+		t.Fatalf(`expected vm to be deleted first, got: %v`, requests)
+	}
+
+	// attached nic: initial delete and retries
+	attachedNicRequests := 0
+	for _, request := range server.Requests("DELETE") {
+		if strings.HasSuffix(request, "/attached-nic") {
+			attachedNicRequests++
+		}
+	}
+	if attachedNicRequests != deleteInUseRetries+1 {
+		t.Fatalf(`expected %v delete requests for attached nic, got: %v`, deleteInUseRetries+1, attachedNicRequests)
+	}
+
+	if val := testutil.CollectAndCount(j.Prometheus.MetricDeletedResource); val != 5 {
+		t.Fatalf(`expected deleted metrics for 5 resource types, got: %v`, val)
+	}
+	if val := testutil.CollectAndCount(j.Prometheus.MetricErrors); val != 1 {
+		t.Fatalf(`expected error metric for attached nic, got: %v`, val)
+	}
+}
@@ -0,0 +1,200 @@
+package janitor
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/webdevops/go-common/log/slogger"
+)
+
+const (
+	DeletionFailedReasonFailed  = AuditResultFailed
+	DeletionFailedReasonTimeout = AuditResultTimeout
+)
+
+const (
+	// deletionDeleted: delete operation finished successfully
+	deletionDeleted deletionOutcome = iota
+	// deletionSkipped: not deleted (locked or previous delete operation still in progress)
+	deletionSkipped
+	// deletionFailed: delete operation failed or timed out
+	deletionFailed
+	// deletionPending: delete operation started and tracked in background (async mode)
+	deletionPending
+	// deletionInUse: still in use by another resource, returned instead of deletionFailed for deletions with retryInUse
+	deletionInUse
+)
+
+type (
+	// deletionOutcome is the result of runDeletion
+	deletionOutcome int
+
+	// deletion describes one delete operation of the janitor (subscriptionID and resourceType are used as metric labels)
+	deletion struct {
+		subscriptionID string
+		resourceType   string
+
+		// planItem and tags are written to the audit log
+		planItem PlanItem
+		tags     map[string]*string
+
+		// begin starts the delete operation and returns a wait function for long-running operations (nil if already finished)
+		begin func(ctx context.Context) (wait func(ctx context.Context) error, err error)
+
+		// wait forces waiting for the delete operation also in async mode (dependents are deleted afterwards),
+		// retryInUse returns "in use" failures to the caller instead of recording them (retried after the parent is gone)
+		wait       bool
+		retryInUse bool
+	}
+)
+
+// waitForPoller returns a wait function for a long-running operation poller
+func waitForPoller[T any](j *Janitor, poller *runtime.Poller[T]) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		_, err := poller.PollUntilDone(ctx, &runtime.PollUntilDoneOptions{
+			Frequency: j.Conf.Janitor.Delete.PollInterval,
+		})
+		return err
+	}
+}
+
+// runDeletion starts a delete operation (limited by deletion concurrency) and waits until Azure has finished it,
+// in async mode the operation is tracked in background (without holding a deletion slot, the concurrency only limits
+// delete operations of the janitor run). Deletions are only counted as deleted when finished.
+// Errors are logged and counted in the error metrics, they don't abort the janitor run.
+// "In use" errors of deletions with retryInUse are only returned as outcome (without logging and counting them).
+func (j *Janitor) runDeletion(ctx context.Context, logger *slogger.Logger, item deletion) deletionOutcome {
+	if j.isDeletionPending(item.planItem.ResourceID) {
+		logger.Infof("deletion still in progress, skipping")
+		j.writeAuditEvent(ctx, logger, item.planItem, item.tags, AuditResultSkipped, AuditSkipReasonDeletionPending)
+		return deletionSkipped
+	}
+
+	j.deletionSlots <- struct{}{}
+	releaseSlot := func() {
+		<-j.deletionSlots
+	}
+
+	wait, err := item.begin(ctx)
+	if err != nil && isScopeLockedError(err) {
+		// lock was added after the management lock check, not an error
+		releaseSlot()
+		logger.Infof("protected by %s, skipping", ProtectionReasonManagementLock)
+		j.writeAuditEvent(ctx, logger, item.planItem, item.tags, AuditResultSkipped, AuditSkipReasonProtected)
+		return deletionSkipped
+	} else if err != nil && item.retryInUse && isResourceInUseError(err) {
+		releaseSlot()
+		logger.Infof("still in use, retrying later: %v", err.Error())
+		return deletionInUse
+	} else if err != nil {
+		releaseSlot()
+
+		// failed delete
+		logger.Errorf("ERROR %s", err)
+		j.writeAuditEvent(ctx, logger, item.planItem, item.tags, AuditResultFailed, err.Error())
+		j.Prometheus.MetricErrors.With(prometheus.Labels{
+			"subscriptionID": item.subscriptionID,
+			"resourceType":   item.resourceType,
+		}).Inc()
+		j.Prometheus.MetricDeleteFailed.With(prometheus.Labels{
+			"subscriptionID": item.subscriptionID,
+			"resourceType":   item.resourceType,
+			"reason":         DeletionFailedReasonFailed,
+		}).Inc()
+		return deletionFailed
+	}
+
+	finish := func() deletionOutcome {
+		// might run in background after the janitor run has finished
+		ctx := context.WithoutCancel(ctx)
+
+		if wait != nil {
+			pollCtx, cancel := context.WithTimeout(ctx, j.Conf.Janitor.Delete.Timeout)
+			defer cancel()
+			err = wait(pollCtx)
+		}
+
+		if err != nil && item.retryInUse && isResourceInUseError(err) {
+			logger.Infof("still in use, retrying later: %v", err.Error())
+			return deletionInUse
+		} else if err != nil {
+			reason := DeletionFailedReasonFailed
+			if errors.Is(err, context.DeadlineExceeded) {
+				reason = DeletionFailedReasonTimeout
+			}
+
+			logger.Errorf("delete operation %s: %s", reason, err)
+			j.writeAuditEvent(ctx, logger, item.planItem, item.tags, reason, err.Error())
+			j.Prometheus.MetricDeleteFailed.With(prometheus.Labels{
+				"subscriptionID": item.subscriptionID,
+				"resourceType":   item.resourceType,
+				"reason":         reason,
+			}).Inc()
+			return deletionFailed
+		}
+
+		// successfully deleted
+		logger.Infof("successfully deleted")
+		j.writeAuditEvent(ctx, logger, item.planItem, item.tags, AuditResultSuccess, "")
+		j.Prometheus.MetricDeletedResource.With(prometheus.Labels{
+			"subscriptionID": item.subscriptionID,
+			"resourceType":   item.resourceType,
+		}).Inc()
+		return deletionDeleted
+	}
+
+	if j.Conf.Janitor.Delete.Async && wait != nil && !item.wait && !item.retryInUse {
+		releaseSlot()
+		logger.Infof("delete operation started, tracking in background")
+		j.setDeletionPending(item.planItem.ResourceID, true)
+		j.pendingDeletionsWg.Add(1)
+		go func() {
+			defer j.pendingDeletionsWg.Done()
+			defer j.setDeletionPending(item.planItem.ResourceID, false)
+			finish()
+		}()
+		return deletionPending
+	}
+
+	defer releaseSlot()
+	return finish()
+}
+
+func (j *Janitor) isDeletionPending(resourceID string) bool {
+	j.pendingDeletionsLock.Lock()
+	defer j.pendingDeletionsLock.Unlock()
+	_, exists := j.pendingDeletions[strings.ToLower(resourceID)]
+	return exists
+}
+
+func (j *Janitor) setDeletionPending(resourceID string, pending bool) {
+	j.pendingDeletionsLock.Lock()
+	defer j.pendingDeletionsLock.Unlock()
+
+	if pending {
+		j.pendingDeletions[strings.ToLower(resourceID)] = struct{}{}
+	} else {
+		delete(j.pendingDeletions, strings.ToLower(resourceID))
+	}
+}
+
+// WaitForPendingDeletions blocks until all background delete operations are finished or the timeout is reached,
+// returns false if delete operations are still pending
+func (j *Janitor) WaitForPendingDeletions(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		j.pendingDeletionsWg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,208 @@
+package janitor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRunDeletionWaitsForOperation(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+	server.AddResourceGroup(testSubscriptionId, "rg-expired", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+
+	resourceId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "expired", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+	server.LongRunningDelete(resourceId, 3, false)
+	server.LongRunningDelete("/subscriptions/"+testSubscriptionId+"/resourceGroups/rg-expired", 2, false)
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.ResourceGroups.Enable = true
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "expired resource exists", false, server.Exists(resourceId))
+	assumeState(t, "expired resourceGroup exists", false, server.Exists("/subscriptions/"+testSubscriptionId+"/resourceGroups/rg-expired"))
+
+	if val := testutil.CollectAndCount(j.Prometheus.MetricDeletedResource); val != 2 {
+		t.Fatalf(`expected deleted metrics for resource and resourceGroup, got: %v`, val)
+	}
+
+	if val := testutil.CollectAndCount(j.Prometheus.MetricDeleteFailed); val != 0 {
+		t.Fatalf(`expected no failed deletions, got: %v`, val)
+	}
+}
+
+func TestRunDeletionFailedAndTimeout(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	failedId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "failed", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+	server.LongRunningDelete(failedId, 1, true)
+
+	timeoutId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "timeout", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+	server.LongRunningDelete(timeoutId, 1000000, false)
+
+	// delete operation cannot be started
+	beginFailedId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "begin-failed", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+	server.FailRequest(http.MethodDelete, beginFailedId, http.StatusConflict)
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.Delete.Timeout = 200 * time.Millisecond
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "failed resource exists", true, server.Exists(failedId))
+	assumeState(t, "timeout resource exists", true, server.Exists(timeoutId))
+	assumeState(t, "begin failed resource exists", true, server.Exists(beginFailedId))
+
+	if val := testutil.CollectAndCount(j.Prometheus.MetricDeletedResource); val != 0 {
+		t.Fatalf(`expected no deleted resources, got: %v`, val)
+	}
+
+	for reason, expected := range map[string]float64{DeletionFailedReasonFailed: 2, DeletionFailedReasonTimeout: 1} {
+		metric := j.Prometheus.MetricDeleteFailed.With(prometheus.Labels{
+			"subscriptionID": testSubscriptionId,
+			"resourceType":   "Microsoft.Storage/storageAccounts",
+			"reason":         reason,
+		})
+		if val := testutil.ToFloat64(metric); val != expected {
+			t.Fatalf(`expected %v failed deletions with reason "%v", got: %v`, expected, reason, val)
+		}
+	}
+}
+
+func TestRunDeletionAsync(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	resourceId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "expired", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+	server.LongRunningDelete(resourceId, 100, false)
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.Delete.Async = true
+	j.runJanitor(context.Background(), j.Logger)
+
+	if !j.isDeletionPending(resourceId) {
+		t.Fatal(`expected deletion to be tracked in background`)
+	}
+
+	// second run must not start another delete operation for the pending deletion
+	j.runJanitor(context.Background(), j.Logger)
+	if val := len(server.Requests("DELETE")); val != 1 {
+		t.Fatalf(`expected 1 delete request, got: %v`, val)
+	}
+
+	assumeState(t, "pending deletions finished", true, j.WaitForPendingDeletions(10*time.Second))
+
+	assumeState(t, "expired resource exists", false, server.Exists(resourceId))
+	assumeState(t, "deletion pending", false, j.isDeletionPending(resourceId))
+
+	if val := testutil.ToFloat64(j.Prometheus.MetricDeletedResource); val != 1 {
+		t.Fatalf(`expected 1 deleted resource, got: %v`, val)
+	}
+}
+
+func TestRunDeletionAsyncReleasesSlot(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	resourceIds := []string{}
+	for _, name := range []string{"expired1", "expired2"} {
+		resourceId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", name, map[string]string{
+			"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+		})
+		server.LongRunningDelete(resourceId, 50, false)
+		resourceIds = append(resourceIds, resourceId)
+	}
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.Delete.Async = true
+	j.deletionSlots = make(chan struct{}, 1)
+	j.runJanitor(context.Background(), j.Logger)
+
+	// background operations don't block starting the next deletion
+	for _, resourceId := range resourceIds {
+		assumeState(t, "deletion pending", true, j.isDeletionPending(resourceId))
+	}
+
+	assumeState(t, "pending deletions finished", true, j.WaitForPendingDeletions(10*time.Second))
+	for _, resourceId := range resourceIds {
+		assumeState(t, "expired resource exists", false, server.Exists(resourceId))
+	}
+}
+
+func TestRunDeletionParallelResourceGroupsAndDeployments(t *testing.T) {
+	const (
+		deletions = 4
+		polls     = 20
+	)
+
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	resourceGroupIds := []string{}
+	deploymentIds := []string{}
+	for num := range deletions {
+		resourceGroupName := fmt.Sprintf("rg-expired-%d", num)
+		server.AddResourceGroup(testSubscriptionId, resourceGroupName, map[string]string{
+			"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+		})
+		resourceGroupId := "/subscriptions/" + testSubscriptionId + "/resourceGroups/" + resourceGroupName
+		server.LongRunningDelete(resourceGroupId, polls, false)
+		resourceGroupIds = append(resourceGroupIds, resourceGroupId)
+
+		deploymentId := server.AddDeployment(testSubscriptionId, "rg-test", fmt.Sprintf("webapp-%d", num), time.Now().Add(-48*time.Hour))
+		server.LongRunningDelete(deploymentId, polls, false)
+		deploymentIds = append(deploymentIds, deploymentId)
+	}
+
+	testCases := map[string]struct {
+		resourceIds []string
+		enable      func(j *Janitor)
+	}{
+		"resourceGroups": {resourceGroupIds, func(j *Janitor) { j.Conf.Janitor.ResourceGroups.Enable = true }},
+		"deployments": {deploymentIds, func(j *Janitor) {
+			j.Conf.Janitor.Deployments.Enable = true
+			j.Conf.Janitor.Deployments.Ttl = 24 * time.Hour
+			j.Conf.Janitor.Deployments.KeepSucceeded = 0
+		}},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			j := buildFakeJanitor(t, server)
+			j.deletionSlots = make(chan struct{}, deletions)
+			testCase.enable(j)
+
+			// serial deletions would need at least the polling duration of all delete operations
+			serialDuration := deletions * polls * j.Conf.Janitor.Delete.PollInterval
+			start := time.Now()
+			j.runJanitor(context.Background(), j.Logger)
+			if duration := time.Since(start); duration >= serialDuration {
+				t.Fatalf(`expected deletions to run in parallel (less than %v), took %v`, serialDuration, duration)
+			}
+
+			for _, resourceId := range testCase.resourceIds {
+				assumeState(t, "expired resource exists", false, server.Exists(resourceId))
+			}
+		})
+	}
+}
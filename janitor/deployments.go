@@ -2,7 +2,10 @@ package janitor
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
+	"regexp"
+	"slices"
 	"strings"
 	"time"
 
@@ -14,160 +17,467 @@ import (
 	"github.com/webdevops/go-common/utils/to"
 )
 
-func (j *Janitor) runDeployments(ctx context.Context, logger *slogger.Logger, subscription *armsubscriptions.Subscription, callback chan<- func()) {
-	var deploymentCounter, deploymentFinalCounter int64
+const (
+	// states of the azurejanitor_deployment gauge
+	DeploymentStateRemaining   = "remaining"
+	DeploymentStateWouldDelete = "wouldDelete"
+)
+
+var (
+	// deploymentNamePrefixRegExp detects the prefix of deployment names (name without trailing numbers, eg. timestamps)
+	deploymentNamePrefixRegExp = regexp.MustCompile(`^(.*?)[-_.]*[0-9][0-9-_.]*$`)
+
+	// deploymentStatesInProgress contains the provisioning states of deployments which are never deleted
+	deploymentStatesInProgress = []armresources.ProvisioningState{
+		armresources.ProvisioningStateAccepted,
+		armresources.ProvisioningStateCreating,
+		armresources.ProvisioningStateDeleting,
+		armresources.ProvisioningStateRunning,
+		armresources.ProvisioningStateUpdating,
+	}
+)
+
+type (
+	// deploymentDecision is the janitor decision for one deployment: planned deletion (item) or the reason
+	// for keeping it
+	deploymentDecision struct {
+		deployment *armresources.DeploymentExtended
+		item       *PlanItem
+		keepReason string
+	}
+
+	// deploymentCounter counts the deployments of one scope by decision
+	deploymentCounter struct {
+		total       int64
+		remaining   int64
+		wouldDelete int64
+		deleted     int64
+		pending     int64
+	}
+
+	// deploymentScope contains the counter and the planned deletions of the deployments of one scope
+	// (subscription, resourceGroup, management group or tenant), name is used for logging
+	deploymentScope struct {
+		logger          *slogger.Logger
+		name            string
+		subscriptionId  string
+		managementGroup string
+		resourceGroup   string
+
+		counter   deploymentCounter
+		deletions []orderedDeletion
+	}
+
+	// deploymentMetrics contains the metric lists of azurejanitor_deployment (remaining deployments of subscription
+	// and resourceGroup scopes) and azurejanitor_deployment_state (all scopes and states)
+	deploymentMetrics struct {
+		deployment *prometheusCommon.MetricList
+		state      *prometheusCommon.MetricList
+	}
+)
+
+func (j *Janitor) runDeployments(ctx context.Context, logger *slogger.Logger, subscription *armsubscriptions.Subscription, callback chan<- func()) error {
 	contextLogger := logger.With(slog.String("task", "deployment"))
+	subscriptionId := to.String(subscription.SubscriptionID)
 
-	client, err := armresources.NewResourceGroupsClient(*subscription.SubscriptionID, j.Azure.Client.GetCred(), j.Azure.Client.NewArmClientOptions())
+	client, err := armresources.NewResourceGroupsClient(*subscription.SubscriptionID, j.Azure.ClientProvider.GetCred(), j.Azure.ClientProvider.NewArmClientOptions())
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	deploymentMetric := prometheusCommon.NewMetricsList()
-
-	deploymentClient, err := armresources.NewDeploymentsClient(*subscription.SubscriptionID, j.Azure.Client.GetCred(), j.Azure.Client.NewArmClientOptions())
+	deploymentClient, err := armresources.NewDeploymentsClient(*subscription.SubscriptionID, j.Azure.ClientProvider.GetCred(), j.Azure.ClientProvider.NewArmClientOptions())
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	resourceType := "Microsoft.Resources/deployments"
+	scopes := []*deploymentScope{}
 
 	// -------------------------------------
 	// Subscription deployments
+	deployments := []*armresources.DeploymentExtended{}
 	deploymentPager := deploymentClient.NewListAtSubscriptionScopePager(nil)
-	if err != nil {
-		panic(err)
-	}
-
-	deploymentCounter = 0
-	deploymentFinalCounter = 0
 	for deploymentPager.More() {
 		deploymentResult, err := deploymentPager.NextPage(ctx)
 		if err != nil {
-			panic(err)
+			return err
 		}
+		deployments = append(deployments, deploymentResult.Value...)
+	}
 
-		for _, deployment := range deploymentResult.Value {
-			deleteDeployment := false
-			deploymentCounter++
-
-			if deploymentCounter >= j.Conf.Janitor.Deployments.Limit {
-				// limit reached
-				deleteDeployment = true
-			} else if deployment.Properties != nil && deployment.Properties.Timestamp != nil {
-				// expire check
-				deploymentAge := time.Since(deployment.Properties.Timestamp.UTC())
-				if deploymentAge.Seconds() > j.Conf.Janitor.Deployments.Ttl.Seconds() {
-					deleteDeployment = true
-				}
+	scope := &deploymentScope{logger: contextLogger, name: "Subscription", subscriptionId: subscriptionId}
+	for _, decision := range j.decideDeployments(subscriptionId, deployments) {
+		j.processDeployment(ctx, scope, decision, func(ctx context.Context) (func(ctx context.Context) error, error) {
+			poller, err := deploymentClient.BeginDeleteAtSubscriptionScope(ctx, to.String(decision.deployment.Name), nil)
+			if err != nil {
+				return nil, err
 			}
+			return waitForPoller(j, poller), nil
+		})
+	}
+	scopes = append(scopes, scope)
 
-			if !j.Conf.DryRun && deleteDeployment {
-				if _, err := deploymentClient.BeginDeleteAtSubscriptionScope(ctx, to.String(deployment.Name), nil); err == nil {
-					// successfully deleted
-					contextLogger.Infof("%s: successfully deleted", to.String(deployment.ID))
-
-					j.Prometheus.MetricDeletedResource.With(prometheus.Labels{
-						"subscriptionID": to.StringLower(subscription.SubscriptionID),
-						"resourceType":   strings.ToLower(resourceType),
-					}).Inc()
-				} else {
-					// failed delete
-					contextLogger.Errorf("%s: ERROR %s", to.String(deployment.ID), err.Error())
-
-					j.Prometheus.MetricErrors.With(prometheus.Labels{
-						"subscriptionID": to.StringLower(subscription.SubscriptionID),
-						"resourceType":   strings.ToLower(resourceType),
-					}).Inc()
-				}
-			} else {
-				deploymentFinalCounter++
+	// -------------------------------------
+	// ResourceGroup deployments
+	resourceGroups := []*armresources.ResourceGroup{}
+	err = j.forEachResourceGroup(ctx, contextLogger, subscription, client, nil, func(resourceGroup *armresources.ResourceGroup) {
+		resourceGroups = append(resourceGroups, resourceGroup)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, resourceGroup := range resourceGroups {
+		deployments := []*armresources.DeploymentExtended{}
+		deploymentPager := deploymentClient.NewListByResourceGroupPager(*resourceGroup.Name, nil)
+		for deploymentPager.More() {
+			deploymentResult, err := deploymentPager.NextPage(ctx)
+			if err != nil {
+				return err
 			}
+			deployments = append(deployments, deploymentResult.Value...)
 		}
+
+		scope := &deploymentScope{
+			logger:         contextLogger.With(slog.String("resource", to.String(resourceGroup.ID))),
+			name:           "ResourceGroup",
+			subscriptionId: subscriptionId,
+			resourceGroup:  to.String(resourceGroup.Name),
+		}
+		for _, decision := range j.decideDeployments(subscriptionId, deployments) {
+			j.processDeployment(ctx, scope, decision, func(ctx context.Context) (func(ctx context.Context) error, error) {
+				poller, err := deploymentClient.BeginDelete(ctx, to.String(resourceGroup.Name), to.String(decision.deployment.Name), nil)
+				if err != nil {
+					return nil, err
+				}
+				return waitForPoller(j, poller), nil
+			})
+		}
+		scopes = append(scopes, scope)
 	}
 
-	deploymentMetric.Add(prometheus.Labels{
-		"subscriptionID": to.String(subscription.SubscriptionID),
-		"resourceGroup":  "",
-	}, float64(deploymentFinalCounter))
+	deploymentMetric := newDeploymentMetrics()
+	j.runDeploymentDeletions(ctx, scopes, deploymentMetric)
 
-	contextLogger.Infof("found %v deployments on Subscription scope, %v still existing, %v deleted", deploymentCounter, deploymentFinalCounter, deploymentCounter-deploymentFinalCounter)
+	callback <- func() {
+		deploymentMetric.gaugeSet(j)
+	}
 
-	// -------------------------------------
-	// ResourceGroup deployments
-	resourceGroupPager := client.NewListPager(nil)
-	for resourceGroupPager.More() {
-		resourceGroupResult, err := resourceGroupPager.NextPage(ctx)
-		if err != nil {
-			panic(err)
-		}
+	return nil
+}
 
-		for _, resourceGroup := range resourceGroupResult.Value {
-			deploymentCounter = 0
-			deploymentFinalCounter = 0
+// runScopeDeployments cleans up the deployments of the configured management groups and of the tenant
+// (once per run, independent of subscriptions). Failures are recorded per scope.
+func (j *Janitor) runScopeDeployments(ctx context.Context, logger *slogger.Logger, callback chan<- func()) {
+	conf := j.Conf.Janitor.Deployments
+	if len(conf.ManagementGroups) == 0 && !conf.Tenant {
+		return
+	}
 
-			resourceLogger := contextLogger.With(slog.String("resource", to.String(resourceGroup.ID)))
+	contextLogger := logger.With(slog.String("task", "deployment"))
+	resourceType := "Microsoft.Resources/deployments"
 
-			deploymentPager := deploymentClient.NewListByResourceGroupPager(*resourceGroup.Name, nil)
+	deploymentClient, err := armresources.NewDeploymentsClient("", j.Azure.ClientProvider.GetCred(), j.Azure.ClientProvider.NewArmClientOptions())
+	if err != nil {
+		j.recordRunError(contextLogger, "", PlanKindDeployment, resourceType, err)
+		return
+	}
+
+	scopes := []*deploymentScope{}
+
+	// -------------------------------------
+	// ManagementGroup deployments
+	for _, groupId := range conf.ManagementGroups {
+		groupLogger := contextLogger.With(slog.String("managementGroup", groupId))
+
+		deployments := []*armresources.DeploymentExtended{}
+		deploymentPager := deploymentClient.NewListAtManagementGroupScopePager(groupId, nil)
+		for deploymentPager.More() {
+			deploymentResult, err := deploymentPager.NextPage(ctx)
 			if err != nil {
-				panic(err)
+				j.recordRunError(groupLogger, "", PlanKindDeployment, resourceType, err)
+				deployments = nil
+				break
 			}
+			deployments = append(deployments, deploymentResult.Value...)
+		}
+		if deployments == nil {
+			continue
+		}
 
-			for deploymentPager.More() {
-				deploymentResult, err := deploymentPager.NextPage(ctx)
+		scope := &deploymentScope{logger: groupLogger, name: "ManagementGroup", managementGroup: groupId}
+		for _, decision := range j.decideDeployments("", deployments) {
+			j.processDeployment(ctx, scope, decision, func(ctx context.Context) (func(ctx context.Context) error, error) {
+				poller, err := deploymentClient.BeginDeleteAtManagementGroupScope(ctx, groupId, to.String(decision.deployment.Name), nil)
 				if err != nil {
-					panic(err)
+					return nil, err
 				}
+				return waitForPoller(j, poller), nil
+			})
+		}
+		scopes = append(scopes, scope)
+	}
 
-				for _, deployment := range deploymentResult.Value {
-					deleteDeployment := false
-					deploymentCounter++
-
-					if deploymentCounter >= j.Conf.Janitor.Deployments.Limit {
-						// limit reached
-						deleteDeployment = true
-					} else if deployment.Properties != nil && deployment.Properties.Timestamp != nil {
-						// expire check
-						deploymentAge := time.Since(deployment.Properties.Timestamp.UTC())
-						if deploymentAge.Seconds() > j.Conf.Janitor.Deployments.Ttl.Seconds() {
-							deleteDeployment = true
-						}
-					}
+	// -------------------------------------
+	// Tenant deployments
+	if conf.Tenant {
+		tenantLogger := contextLogger.With(slog.String("scope", "tenant"))
+
+		deployments := []*armresources.DeploymentExtended{}
+		deploymentPager := deploymentClient.NewListAtTenantScopePager(nil)
+		for deploymentPager.More() {
+			deploymentResult, err := deploymentPager.NextPage(ctx)
+			if err != nil {
+				j.recordRunError(tenantLogger, "", PlanKindDeployment, resourceType, err)
+				deployments = nil
+				break
+			}
+			deployments = append(deployments, deploymentResult.Value...)
+		}
 
-					if !j.Conf.DryRun && deleteDeployment {
-						if _, err := deploymentClient.BeginDelete(ctx, to.String(resourceGroup.Name), to.String(deployment.Name), nil); err == nil {
-							// successfully deleted
-							resourceLogger.Infof("%s: successfully deleted", to.String(deployment.ID))
-
-							j.Prometheus.MetricDeletedResource.With(prometheus.Labels{
-								"subscriptionID": to.StringLower(subscription.SubscriptionID),
-								"resourceType":   strings.ToLower(resourceType),
-							}).Inc()
-						} else {
-							// failed delete
-							resourceLogger.Errorf("%s: ERROR %s", to.String(deployment.ID), err.Error())
-
-							j.Prometheus.MetricErrors.With(prometheus.Labels{
-								"subscriptionID": to.StringLower(subscription.SubscriptionID),
-								"resourceType":   strings.ToLower(resourceType),
-							}).Inc()
-						}
-					} else {
-						deploymentFinalCounter++
+		if deployments != nil {
+			scope := &deploymentScope{logger: tenantLogger, name: "Tenant"}
+			for _, decision := range j.decideDeployments("", deployments) {
+				j.processDeployment(ctx, scope, decision, func(ctx context.Context) (func(ctx context.Context) error, error) {
+					poller, err := deploymentClient.BeginDeleteAtTenantScope(ctx, to.String(decision.deployment.Name), nil)
+					if err != nil {
+						return nil, err
 					}
-				}
+					return waitForPoller(j, poller), nil
+				})
 			}
+			scopes = append(scopes, scope)
+		}
+	}
+
+	deploymentMetric := newDeploymentMetrics()
+	j.runDeploymentDeletions(ctx, scopes, deploymentMetric)
 
-			deploymentMetric.Add(prometheus.Labels{
-				"subscriptionID": to.String(subscription.SubscriptionID),
-				"resourceGroup":  to.String(resourceGroup.Name),
-			}, float64(deploymentFinalCounter))
+	callback <- func() {
+		deploymentMetric.gaugeSet(j)
+	}
+}
 
-			resourceLogger.Infof("found %v deployments on ResourceGroup scope, %v still existing, %v deleted", deploymentCounter, deploymentFinalCounter, deploymentCounter-deploymentFinalCounter)
+// runDeploymentDeletions executes the planned deletions of all scopes in parallel (limited by deletion concurrency),
+// counts the outcomes and adds the metrics of each scope
+func (j *Janitor) runDeploymentDeletions(ctx context.Context, scopes []*deploymentScope, metrics deploymentMetrics) {
+	items := []orderedDeletion{}
+	itemScopes := []*deploymentScope{}
+	for _, scope := range scopes {
+		items = append(items, scope.deletions...)
+		for range scope.deletions {
+			itemScopes = append(itemScopes, scope)
 		}
 	}
 
-	callback <- func() {
-		deploymentMetric.GaugeSet(j.Prometheus.MetricDeployment)
+	for num, outcome := range j.runDeletionLevel(ctx, items, deletionLevelOptions{}) {
+		// failed, locked and still running deletions leave the deployment in place
+		counter := &itemScopes[num].counter
+		switch outcome {
+		case deletionDeleted:
+			counter.deleted++
+		case deletionPending:
+			counter.pending++
+		default:
+			counter.remaining++
+		}
+	}
+
+	for _, scope := range scopes {
+		counter := scope.counter
+		j.addDeploymentMetrics(metrics, scope.subscriptionId, scope.managementGroup, scope.resourceGroup, counter)
+		scope.logger.Infof("found %v deployments on %s scope, %v still existing, %v deleted, %v deletions pending, %v would be deleted", counter.total, scope.name, counter.remaining, counter.deleted, counter.pending, counter.wouldDelete)
+	}
+}
+
+// decideDeployments decides about all deployments of one scope. Deployments are sorted by timestamp (newest first,
+// name as tie-breaker), deployments in progress (eg. Running, Accepted) are never touched and the last succeeded and
+// failed deployments of each deployment name prefix are kept. All other deployments are deleted if they reach the
+// deployment limit or are older than the deployment ttl.
+func (j *Janitor) decideDeployments(subscriptionId string, deployments []*armresources.DeploymentExtended) []deploymentDecision {
+	deployments = slices.Clone(deployments)
+	slices.SortStableFunc(deployments, compareDeployments)
+
+	conf := j.Conf.Janitor.Deployments
+	retained := map[string]int{}
+
+	ret := make([]deploymentDecision, 0, len(deployments))
+	for num, deployment := range deployments {
+		decision := deploymentDecision{deployment: deployment}
+		state := deploymentProvisioningState(deployment)
+		prefix := j.deploymentNamePrefix(to.String(deployment.Name))
+
+		switch {
+		case slices.Contains(deploymentStatesInProgress, state):
+			decision.keepReason = fmt.Sprintf("provisioning state %s", state)
+		case state == armresources.ProvisioningStateSucceeded && retained[prefix+"::succeeded"] < conf.KeepSucceeded:
+			retained[prefix+"::succeeded"]++
+			decision.keepReason = fmt.Sprintf(`one of last %v succeeded deployments with prefix "%s"`, conf.KeepSucceeded, prefix)
+		case (state == armresources.ProvisioningStateFailed || state == armresources.ProvisioningStateCanceled) && retained[prefix+"::failed"] < conf.KeepFailed:
+			retained[prefix+"::failed"]++
+			decision.keepReason = fmt.Sprintf(`one of last %v failed deployments with prefix "%s"`, conf.KeepFailed, prefix)
+		default:
+			decision.item = j.decideDeployment(subscriptionId, deployment, int64(num+1))
+			if decision.item == nil {
+				decision.keepReason = fmt.Sprintf("deployment %v below limit %v, not older than %v", num+1, conf.Limit, conf.Ttl)
+			}
+		}
+
+		ret = append(ret, decision)
+	}
+
+	return ret
+}
+
+// decideDeployment decides if the deployment (position num of the sorted deployments of its scope, starting with 1)
+// has to be deleted because it reaches the deployment limit (num >= limit, so limit-1 deployments are kept)
+// or it is older than the deployment ttl.
+// Returns the plan item (action delete with reason) or nil if the deployment is kept.
+func (j *Janitor) decideDeployment(subscriptionId string, deployment *armresources.DeploymentExtended, num int64) *PlanItem {
+	item := PlanItem{
+		ResourceID:     to.String(deployment.ID),
+		Kind:           PlanKindDeployment,
+		SubscriptionID: subscriptionId,
+		Action:         PlanActionDelete,
+	}
+
+	deploymentTimestamp := deploymentTimestamp(deployment)
+	if deploymentTimestamp != nil {
+		expiryTime := deploymentTimestamp.Add(j.Conf.Janitor.Deployments.Ttl)
+		item.ExpiryTime = &expiryTime
+	}
+
+	switch {
+	case num >= j.Conf.Janitor.Deployments.Limit:
+		// limit reached
+		item.Reason = PlanReasonDeploymentLimit
+	case deploymentTimestamp != nil && time.Since(*deploymentTimestamp) > j.Conf.Janitor.Deployments.Ttl:
+		// expired
+		item.Reason = PlanReasonDeploymentAge
+	default:
+		return nil
+	}
+
+	return &item
+}
+
+// processDeployment adds planned deletions to the plan and to the deletions of the scope (unless dry run or protected)
+// and counts the decision
+func (j *Janitor) processDeployment(ctx context.Context, scope *deploymentScope, decision deploymentDecision, begin func(ctx context.Context) (func(ctx context.Context) error, error)) {
+	deployment := decision.deployment
+	scope.counter.total++
+	deploymentLogger := scope.logger.With(slog.String("resourceID", to.String(deployment.ID)))
+
+	item := decision.item
+	if item == nil {
+		deploymentLogger.Debugf("kept (%s)", decision.keepReason)
+		scope.counter.remaining++
+		return
+	}
+	j.protectPlanItem(ctx, deploymentLogger, item, deployment.Tags)
+	j.plan.Add(*item)
+
+	switch {
+	case item.Action == PlanActionProtected:
+		deploymentLogger.Infof("expired (%s), but protected by %s", item.Reason, item.Protection)
+		j.writeAuditEvent(ctx, deploymentLogger, *item, deployment.Tags, AuditResultSkipped, AuditSkipReasonProtected)
+		scope.counter.remaining++
+	case j.Conf.DryRun:
+		deploymentLogger.Infof("expired (%s), but dryrun active", item.Reason)
+		j.writeAuditEvent(ctx, deploymentLogger, *item, deployment.Tags, AuditResultSkipped, AuditSkipReasonDryRun)
+		scope.counter.wouldDelete++
+	default:
+		deploymentLogger.Infof("expired (%s), trying to delete", item.Reason)
+		scope.deletions = append(scope.deletions, orderedDeletion{logger: deploymentLogger, deletion: deletion{
+			subscriptionID: strings.ToLower(scope.subscriptionId),
+			resourceType:   "microsoft.resources/deployments",
+			planItem:       *item,
+			tags:           deployment.Tags,
+			begin:          begin,
+		}})
+	}
+}
+
+func newDeploymentMetrics() deploymentMetrics {
+	return deploymentMetrics{
+		deployment: prometheusCommon.NewMetricsList(),
+		state:      prometheusCommon.NewMetricsList(),
+	}
+}
+
+func (m deploymentMetrics) gaugeSet(j *Janitor) {
+	m.deployment.GaugeSet(j.Prometheus.MetricDeployment)
+	m.state.GaugeSet(j.Prometheus.MetricDeploymentState)
+}
+
+// addDeploymentMetrics adds the remaining and (dry run) would be deleted deployments of one scope to the metric lists
+// (tenant scope: all scope labels empty)
+func (j *Janitor) addDeploymentMetrics(metrics deploymentMetrics, subscriptionId, managementGroup, resourceGroup string, counter deploymentCounter) {
+	// deployments with pending delete operations still exist
+	remaining := counter.remaining + counter.pending
+
+	if subscriptionId != "" {
+		metrics.deployment.Add(prometheus.Labels{
+			"subscriptionID": subscriptionId,
+			"resourceGroup":  resourceGroup,
+		}, float64(remaining))
+	}
+
+	for state, value := range map[string]int64{
+		DeploymentStateRemaining:   remaining,
+		DeploymentStateWouldDelete: counter.wouldDelete,
+	} {
+		metrics.state.Add(prometheus.Labels{
+			"subscriptionID":  subscriptionId,
+			"managementGroup": managementGroup,
+			"resourceGroup":   resourceGroup,
+			"state":           state,
+		}, float64(value))
+	}
+}
+
+// deploymentNamePrefix returns the (lowercase) prefix of the deployment name for grouping deployments of one template,
+// the whole name is used if the prefix regexp doesn't match
+func (j *Janitor) deploymentNamePrefix(name string) string {
+	prefixRegExp := j.Conf.Janitor.Deployments.PrefixRegExp
+	if prefixRegExp == nil {
+		prefixRegExp = deploymentNamePrefixRegExp
+	}
+
+	if match := prefixRegExp.FindStringSubmatch(name); len(match) > 1 && match[1] != "" {
+		return strings.ToLower(match[1])
+	}
+	return strings.ToLower(name)
+}
+
+// compareDeployments sorts deployments by timestamp (newest first, without timestamp last), name and id
+func compareDeployments(a, b *armresources.DeploymentExtended) int {
+	aTimestamp, bTimestamp := deploymentTimestamp(a), deploymentTimestamp(b)
+	switch {
+	case aTimestamp != nil && bTimestamp == nil:
+		return -1
+	case aTimestamp == nil && bTimestamp != nil:
+		return 1
+	case aTimestamp != nil && bTimestamp != nil && !aTimestamp.Equal(*bTimestamp):
+		return bTimestamp.Compare(*aTimestamp)
+	}
+
+	if val := strings.Compare(to.StringLower(a.Name), to.StringLower(b.Name)); val != 0 {
+		return val
+	}
+	return strings.Compare(to.StringLower(a.ID), to.StringLower(b.ID))
+}
+
+func deploymentTimestamp(deployment *armresources.DeploymentExtended) *time.Time {
+	if deployment.Properties == nil || deployment.Properties.Timestamp == nil {
+		return nil
+	}
+	timestamp := deployment.Properties.Timestamp.UTC()
+	return &timestamp
+}
+
+func deploymentProvisioningState(deployment *armresources.DeploymentExtended) armresources.ProvisioningState {
+	if deployment.Properties == nil || deployment.Properties.ProvisioningState == nil {
+		return armresources.ProvisioningStateNotSpecified
 	}
+	return *deployment.Properties.ProvisioningState
 }
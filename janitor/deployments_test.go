@@ -0,0 +1,151 @@
+package janitor
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDeploymentNamePrefix(t *testing.T) {
+	j := buildJanitorObj()
+
+	testCases := map[string]string{
+		"webapp-20240101-1200":              "webapp",
+		"Microsoft.Template-20240101121212": "microsoft.template",
+		"vnet_2024.01.01":                   "vnet",
+		"storage":                           "storage",
+		"1234":                              "1234",
+	}
+	for name, expected := range testCases {
+		if val := j.deploymentNamePrefix(name); val != expected {
+			t.Fatalf(`%s: expected prefix "%v", got "%v"`, name, expected, val)
+		}
+	}
+
+	j.Conf.Janitor.Deployments.PrefixRegExp = regexp.MustCompile(`^([^-]+)-`)
+	if val := j.deploymentNamePrefix("app-web-1"); val != "app" {
+		t.Fatalf(`expected prefix "app" with custom regexp, got "%v"`, val)
+	}
+}
+
+func TestRunDeploymentsRetention(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	addDeployment := func(name string, age time.Duration, state armresources.ProvisioningState) string {
+		resourceId := server.AddDeployment(testSubscriptionId, "rg-test", name, time.Now().Add(-age))
+		server.SetDeploymentState(resourceId, state)
+		return resourceId
+	}
+
+	succeededOldId := addDeployment("webapp-20240101", 50*time.Hour, armresources.ProvisioningStateSucceeded)
+	succeededLastId := addDeployment("webapp-20240102", 49*time.Hour, armresources.ProvisioningStateSucceeded)
+	failedOldId := addDeployment("webapp-20240103", 48*time.Hour, armresources.ProvisioningStateFailed)
+	failedLastId := addDeployment("webapp-20240104", 47*time.Hour, armresources.ProvisioningStateCanceled)
+	otherSucceededId := addDeployment("vnet-1", 72*time.Hour, armresources.ProvisioningStateSucceeded)
+	runningId := addDeployment("aks-1", 72*time.Hour, armresources.ProvisioningStateRunning)
+	acceptedId := addDeployment("aks-2", 72*time.Hour, armresources.ProvisioningStateAccepted)
+
+	// limit is applied on deployments sorted by timestamp (not listing order)
+	limitOldId := server.AddDeployment(testSubscriptionId, "", "a-old", time.Now().Add(-3*time.Hour))
+	limitNewId := server.AddDeployment(testSubscriptionId, "", "b-new", time.Now().Add(-1*time.Hour))
+	limitMidId := server.AddDeployment(testSubscriptionId, "", "c-mid", time.Now().Add(-2*time.Hour))
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Deployments.Enable = true
+	j.Conf.Janitor.Deployments.Limit = 3
+	j.Conf.Janitor.Deployments.Ttl = 24 * time.Hour
+	j.Conf.Janitor.Deployments.KeepSucceeded = 1
+	j.Conf.Janitor.Deployments.KeepFailed = 1
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "older succeeded deployment exists", false, server.Exists(succeededOldId))
+	assumeState(t, "last succeeded deployment exists", true, server.Exists(succeededLastId))
+	assumeState(t, "older failed deployment exists", false, server.Exists(failedOldId))
+	assumeState(t, "last failed deployment exists", true, server.Exists(failedLastId))
+	assumeState(t, "only succeeded deployment of prefix exists", true, server.Exists(otherSucceededId))
+	assumeState(t, "running deployment exists", true, server.Exists(runningId))
+	assumeState(t, "accepted deployment exists", true, server.Exists(acceptedId))
+
+	assumeState(t, "oldest deployment over limit exists", false, server.Exists(limitOldId))
+	assumeState(t, "newest deployment exists", true, server.Exists(limitNewId))
+	assumeState(t, "second newest deployment exists", true, server.Exists(limitMidId))
+}
+
+func TestRunScopeDeployments(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddManagementGroup("mg-test", "")
+
+	managementGroupScope := "/providers/Microsoft.Management/managementGroups/mg-test"
+	groupExpiredId := server.AddScopeDeployment(managementGroupScope, "policy-1", time.Now().Add(-48*time.Hour))
+	groupValidId := server.AddScopeDeployment(managementGroupScope, "policy-2", time.Now().Add(-1*time.Hour))
+	tenantExpiredId := server.AddScopeDeployment("", "tenant-1", time.Now().Add(-48*time.Hour))
+	tenantValidId := server.AddScopeDeployment("", "tenant-2", time.Now().Add(-1*time.Hour))
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Deployments.Enable = true
+	j.Conf.Janitor.Deployments.Limit = 10
+	j.Conf.Janitor.Deployments.Ttl = 24 * time.Hour
+	j.Conf.Janitor.Deployments.KeepSucceeded = 0
+	j.Conf.Janitor.Deployments.ManagementGroups = []string{"mg-test"}
+	j.Conf.Janitor.Deployments.Tenant = true
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "expired managementGroup deployment exists", false, server.Exists(groupExpiredId))
+	assumeState(t, "valid managementGroup deployment exists", true, server.Exists(groupValidId))
+	assumeState(t, "expired tenant deployment exists", false, server.Exists(tenantExpiredId))
+	assumeState(t, "valid tenant deployment exists", true, server.Exists(tenantValidId))
+
+	for managementGroup, expected := range map[string]float64{"mg-test": 1, "": 1} {
+		labels := prometheus.Labels{
+			"subscriptionID":  "",
+			"managementGroup": managementGroup,
+			"resourceGroup":   "",
+			"state":           DeploymentStateRemaining,
+		}
+		if val := testutil.ToFloat64(j.Prometheus.MetricDeploymentState.With(labels)); val != expected {
+			t.Fatalf(`expected %v remaining deployments for scope "%s", got: %v`, expected, managementGroup, val)
+		}
+	}
+}
+
+func TestRunDeploymentsFailedDelete(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	failedId := server.AddDeployment(testSubscriptionId, "rg-test", "failed-1", time.Now().Add(-48*time.Hour))
+	deletedId := server.AddDeployment(testSubscriptionId, "rg-test", "deleted-1", time.Now().Add(-48*time.Hour))
+	validId := server.AddDeployment(testSubscriptionId, "rg-test", "valid-1", time.Now().Add(-1*time.Hour))
+	server.FailRequest("DELETE", failedId, http.StatusConflict)
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Deployments.Enable = true
+	j.Conf.Janitor.Deployments.Limit = 10
+	j.Conf.Janitor.Deployments.Ttl = 24 * time.Hour
+	j.Conf.Janitor.Deployments.KeepSucceeded = 0
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "failed deployment exists", true, server.Exists(failedId))
+	assumeState(t, "deleted deployment exists", false, server.Exists(deletedId))
+	assumeState(t, "valid deployment exists", true, server.Exists(validId))
+
+	// failed deletions are still remaining
+	labels := prometheus.Labels{
+		"subscriptionID":  testSubscriptionId,
+		"managementGroup": "",
+		"resourceGroup":   "rg-test",
+		"state":           DeploymentStateRemaining,
+	}
+	if val := testutil.ToFloat64(j.Prometheus.MetricDeploymentState.With(labels)); val != 2 {
+		t.Fatalf(`expected 2 remaining deployments, got: %v`, val)
+	}
+	if val := testutil.ToFloat64(j.Prometheus.MetricDeployment.WithLabelValues(testSubscriptionId, "rg-test")); val != 2 {
+		t.Fatalf(`expected 2 deployments on scope, got: %v`, val)
+	}
+}
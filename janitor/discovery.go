@@ -0,0 +1,350 @@
+package janitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	armauthorization "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resourcegraph/armresourcegraph"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armsubscriptions"
+	"github.com/webdevops/go-common/log/slogger"
+	"github.com/webdevops/go-common/utils/to"
+)
+
+const (
+	DiscoveryBackendArm           = "arm"
+	DiscoveryBackendResourceGraph = "resourcegraph"
+
+	// number of rows per Resource Graph page (maximum supported by Azure)
+	resourceGraphPageSize = 1000
+
+	resourceGraphQueryResources       = "resources"
+	resourceGraphQueryResourceGroups  = "resourcegroups"
+	resourceGraphQueryRoleAssignments = "roleassignments"
+)
+
+var (
+	// resourceGraphQueries contains the Resource Graph (KQL) queries used for discovery, each row must contain subscriptionId.
+	// RoleAssignments on ManagementGroup scope have no subscriptionId, they are listed via ARM (see runScopeRoleAssignments).
+	resourceGraphQueries = map[string]string{
+		resourceGraphQueryResources: `resources
+| project id, name, type, location, tags, sku, kind, subscriptionId, createdTime = properties.createdTime, changedTime = properties.changedTime`,
+		resourceGraphQueryResourceGroups: `resourcecontainers
+| where type =~ 'microsoft.resources/subscriptions/resourcegroups'
+| project id, name, type, location, tags, subscriptionId`,
+		resourceGraphQueryRoleAssignments: `authorizationresources
+| where type =~ 'microsoft.authorization/roleassignments'
+| where isnotempty(subscriptionId)
+| project id, name, type, properties, subscriptionId`,
+	}
+)
+
+type (
+	// ResourceGraphClient executes Azure Resource Graph queries against a list of subscriptions and returns
+	// all rows (all pages) as objects
+	ResourceGraphClient interface {
+		Query(ctx context.Context, query string, subscriptions []string) ([]map[string]any, error)
+	}
+
+	// resourceGraphClient is the Azure Resource Graph implementation of ResourceGraphClient
+	resourceGraphClient struct {
+		provider AzureClientProvider
+	}
+
+	// discoverySnapshot contains the resources, resourceGroups and roleAssignments of all subscriptions
+	// (by lowercase subscription id) discovered by one Resource Graph query per kind at the start of a run.
+	// A nil snapshot (or a kind which was not queried) means the ARM list APIs are used.
+	discoverySnapshot struct {
+		resources       map[string][]*armresources.GenericResourceExpanded
+		resourceGroups  map[string][]*armresources.ResourceGroup
+		roleAssignments map[string][]*armauthorization.RoleAssignment
+	}
+)
+
+// Query executes the query with paging (skip token) and returns all rows
+func (c *resourceGraphClient) Query(ctx context.Context, query string, subscriptions []string) ([]map[string]any, error) {
+	client, err := armresourcegraph.NewClient(c.provider.GetCred(), c.provider.NewArmClientOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	resultFormat := armresourcegraph.ResultFormatObjectArray
+	request := armresourcegraph.QueryRequest{
+		Query:         to.StringPtr(query),
+		Subscriptions: to.SlicePtr(subscriptions),
+		Options: &armresourcegraph.QueryRequestOptions{
+			ResultFormat: &resultFormat,
+			Top:          to.Int32Ptr(resourceGraphPageSize),
+		},
+	}
+
+	ret := []map[string]any{}
+	for {
+		result, err := client.Resources(ctx, request, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		rows, ok := result.Data.([]any)
+		if !ok {
+			return nil, fmt.Errorf("unexpected Resource Graph result format %T", result.Data)
+		}
+
+		for _, row := range rows {
+			if rowData, ok := row.(map[string]any); ok {
+				ret = append(ret, rowData)
+			}
+		}
+
+		if result.SkipToken == nil || *result.SkipToken == "" {
+			break
+		}
+		request.Options.SkipToken = result.SkipToken
+	}
+
+	return ret, nil
+}
+
+// initDiscovery sets the Resource Graph client if the Resource Graph discovery backend is enabled
+func (j *Janitor) initDiscovery() {
+	if j.Conf.Janitor.Discovery.Backend != DiscoveryBackendResourceGraph {
+		return
+	}
+
+	if j.Azure.ResourceGraph == nil {
+		j.Azure.ResourceGraph = &resourceGraphClient{provider: j.Azure.ClientProvider}
+	}
+
+	j.Logger.Infof("using Azure Resource Graph for discovery")
+}
+
+// runDiscovery builds the discovery snapshot for the current run (Resource Graph backend only, nil otherwise).
+// Only the kinds needed by the enabled tasks are queried, resources are limited to tagged resources
+// unless the policy also handles untagged resources (defaultTtl, maxAge or maxIdle).
+func (j *Janitor) runDiscovery(ctx context.Context, logger *slogger.Logger) (*discoverySnapshot, error) {
+	if j.Conf.Janitor.Discovery.Backend != DiscoveryBackendResourceGraph {
+		return nil, nil
+	}
+
+	subscriptions := []string{}
+	j.forEachSubscription(func(subscription *armsubscriptions.Subscription) {
+		subscriptions = append(subscriptions, to.String(subscription.SubscriptionID))
+	})
+
+	snapshot := &discoverySnapshot{}
+	if len(subscriptions) == 0 {
+		return snapshot, nil
+	}
+
+	contextLogger := logger.With(slog.String("task", "discovery"))
+
+	if j.Conf.Janitor.Resources.Enable {
+		query := resourceGraphQueries[resourceGraphQueryResources]
+		if !j.policyUsesResourceTimestamps() {
+			query += "\n| where isnotempty(tags)"
+		}
+
+		snapshot.resources = map[string][]*armresources.GenericResourceExpanded{}
+		if err := j.queryResourceGraph(ctx, contextLogger, resourceGraphQueryResources, query, subscriptions, func(subscriptionId string, data []byte) error {
+			resource := &armresources.GenericResourceExpanded{}
+			if err := json.Unmarshal(data, resource); err != nil {
+				return err
+			}
+			snapshot.resources[subscriptionId] = append(snapshot.resources[subscriptionId], resource)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if j.Conf.Janitor.ResourceGroups.Enable || j.Conf.Janitor.Deployments.Enable {
+		query := resourceGraphQueries[resourceGraphQueryResourceGroups]
+		// same tag condition as the ARM $filter, deployments are cleaned up in all resourceGroups
+		if tagName := j.resourceGroupFilter.ServerFilterTagName(); tagName != "" && !j.Conf.Janitor.Deployments.Enable {
+			query += "\n| where " + resourceGraphTagPredicate(tagName)
+		}
+
+		snapshot.resourceGroups = map[string][]*armresources.ResourceGroup{}
+		if err := j.queryResourceGraph(ctx, contextLogger, resourceGraphQueryResourceGroups, query, subscriptions, func(subscriptionId string, data []byte) error {
+			resourceGroup := &armresources.ResourceGroup{}
+			if err := json.Unmarshal(data, resourceGroup); err != nil {
+				return err
+			}
+			snapshot.resourceGroups[subscriptionId] = append(snapshot.resourceGroups[subscriptionId], resourceGroup)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	if j.Conf.Janitor.RoleAssignments.Enable || j.Conf.Janitor.RoleAssignmentsOrphaned.Enable {
+		snapshot.roleAssignments = map[string][]*armauthorization.RoleAssignment{}
+		if err := j.queryResourceGraph(ctx, contextLogger, resourceGraphQueryRoleAssignments, resourceGraphQueries[resourceGraphQueryRoleAssignments], subscriptions, func(subscriptionId string, data []byte) error {
+			roleAssignment := &armauthorization.RoleAssignment{}
+			if err := json.Unmarshal(data, roleAssignment); err != nil {
+				return err
+			}
+			if roleAssignment.Properties == nil {
+				return nil
+			}
+			snapshot.roleAssignments[subscriptionId] = append(snapshot.roleAssignments[subscriptionId], roleAssignment)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return snapshot, nil
+}
+
+// queryResourceGraph executes the query and passes each row (as json) with its lowercase subscription id to the callback
+func (j *Janitor) queryResourceGraph(ctx context.Context, logger *slogger.Logger, name, query string, subscriptions []string, callback func(subscriptionId string, data []byte) error) error {
+	rows, err := j.Azure.ResourceGraph.Query(ctx, query, subscriptions)
+	if err != nil {
+		return fmt.Errorf("resource graph query for %s failed: %w", name, err)
+	}
+
+	skipped := 0
+	for _, row := range rows {
+		subscriptionId, _ := row["subscriptionId"].(string)
+		if subscriptionId == "" {
+			skipped++
+			continue
+		}
+
+		data, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+
+		if err := callback(strings.ToLower(subscriptionId), data); err != nil {
+			return fmt.Errorf("unable to parse %s row of resource graph: %w", name, err)
+		}
+	}
+
+	logger.Infof("discovered %v %s via Azure Resource Graph", len(rows)-skipped, name)
+	if skipped > 0 {
+		logger.Warnf("skipped %v %s without subscriptionId", skipped, name)
+	}
+
+	return nil
+}
+
+// resourceGraphTagPredicate returns a KQL condition for resources with the tag (tag names are case insensitive,
+// the tags are checked as json as the keys of dynamic values are case sensitive)
+func resourceGraphTagPredicate(tagName string) string {
+	tagKey, _ := json.Marshal(tagName)
+	return fmt.Sprintf("tostring(tags) contains %s", quoteKqlString(string(tagKey)+":"))
+}
+
+// quoteKqlString quotes the value as KQL string literal
+func quoteKqlString(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
+
+// forEachResource passes all resources of the subscription to the callback, either from the discovery snapshot or
+// via the ARM list API (with $filter and fallback to client side filtering if ARM rejects the $filter)
+func (j *Janitor) forEachResource(ctx context.Context, logger *slogger.Logger, subscription *armsubscriptions.Subscription, client *armresources.Client, filter *ListFilter, callback func(resource *armresources.GenericResourceExpanded)) error {
+	if j.discovery != nil && j.discovery.resources != nil {
+		for _, resource := range j.discovery.resources[to.StringLower(subscription.SubscriptionID)] {
+			callback(resource)
+		}
+		return nil
+	}
+
+	listOptions := armresources.ClientListOptions{
+		Expand: to.StringPtr(resourceTimestampsExpand),
+		Filter: filter.ServerFilter(),
+	}
+	pager := client.NewListPager(&listOptions)
+	pageCount := 0
+	for pager.More() {
+		result, err := pager.NextPage(ctx)
+		if err != nil {
+			if pageCount == 0 && listOptions.Filter != nil && isFilterRejectedError(err) {
+				// retry this listing without $filter, next listing tries the $filter again
+				logger.Warnf(`$filter "%s" rejected by Azure, falling back to client side filtering: %v`, *listOptions.Filter, err.Error())
+				listOptions.Filter = nil
+				pager = client.NewListPager(&listOptions)
+				continue
+			}
+			return err
+		}
+		pageCount++
+
+		for _, resource := range result.Value {
+			callback(resource)
+		}
+	}
+
+	return nil
+}
+
+// forEachResourceGroup passes all resourceGroups of the subscription to the callback, either from the discovery snapshot
+// or via the ARM list API (with $filter and fallback to client side filtering if ARM rejects the $filter)
+func (j *Janitor) forEachResourceGroup(ctx context.Context, logger *slogger.Logger, subscription *armsubscriptions.Subscription, client *armresources.ResourceGroupsClient, filter *ListFilter, callback func(resourceGroup *armresources.ResourceGroup)) error {
+	if j.discovery != nil && j.discovery.resourceGroups != nil {
+		for _, resourceGroup := range j.discovery.resourceGroups[to.StringLower(subscription.SubscriptionID)] {
+			callback(resourceGroup)
+		}
+		return nil
+	}
+
+	listOptions := armresources.ResourceGroupsClientListOptions{
+		Filter: filter.ServerFilter(),
+	}
+	pager := client.NewListPager(&listOptions)
+	pageCount := 0
+	for pager.More() {
+		result, err := pager.NextPage(ctx)
+		if err != nil {
+			if pageCount == 0 && listOptions.Filter != nil && isFilterRejectedError(err) {
+				// retry this listing without $filter, next listing tries the $filter again
+				logger.Warnf(`$filter "%s" rejected by Azure, falling back to client side filtering: %v`, *listOptions.Filter, err.Error())
+				listOptions.Filter = nil
+				pager = client.NewListPager(&listOptions)
+				continue
+			}
+			return err
+		}
+		pageCount++
+
+		for _, resourceGroup := range result.Value {
+			callback(resourceGroup)
+		}
+	}
+
+	return nil
+}
+
+// forEachRoleAssignment passes all roleAssignments of the scope (inside the subscription) to the callback, either from
+// the discovery snapshot or via the ARM list API (including roleAssignments of parent and child scopes)
+func (j *Janitor) forEachRoleAssignment(ctx context.Context, subscription *armsubscriptions.Subscription, client *armauthorization.RoleAssignmentsClient, scope string, callback func(roleAssignment *armauthorization.RoleAssignment)) error {
+	if j.discovery != nil && j.discovery.roleAssignments != nil {
+		for _, roleAssignment := range j.discovery.roleAssignments[to.StringLower(subscription.SubscriptionID)] {
+			roleAssignmentScope := to.String(roleAssignment.Properties.Scope)
+			if isScopeWithin(scope, roleAssignmentScope) || isScopeWithin(roleAssignmentScope, scope) {
+				callback(roleAssignment)
+			}
+		}
+		return nil
+	}
+
+	pager := client.NewListForScopePager(scope, nil)
+	for pager.More() {
+		result, err := pager.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, roleAssignment := range result.Value {
+			callback(roleAssignment)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package janitor
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	armauthorization "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/webdevops/azure-janitor/config"
+)
+
+func TestRunResourceGraphDiscovery(t *testing.T) {
+	secondSubscriptionId := "00000000-0000-0000-0000-000000000002"
+
+	server := buildFakeArmEnvironment(t)
+	server.AddSubscription(secondSubscriptionId, "second-subscription")
+	server.AddProvider(secondSubscriptionId, "Microsoft.Storage", "storageAccounts", "2023-01-01")
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+	server.AddResourceGroup(secondSubscriptionId, "rg-test", nil)
+
+	expiredTags := func() map[string]string {
+		return map[string]string{"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339)}
+	}
+	expiredId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "expired", expiredTags())
+	secondExpiredId := server.AddResource(secondSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "expired", expiredTags())
+	untaggedId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "untagged", nil)
+	server.AddResourceGroup(testSubscriptionId, "rg-expired", expiredTags())
+	deploymentId := server.AddDeployment(testSubscriptionId, "rg-test", "old", time.Now().Add(-48*time.Hour))
+	roleAssignmentId := server.AddRoleAssignment("/subscriptions/"+testSubscriptionId, "expired", testRoleDefinitionId, armauthorization.PrincipalTypeUser, time.Now().Add(-12*time.Hour), "")
+
+	graph := &fakeResourceGraphClient{server: server}
+
+	j := buildJanitorObj()
+	j.Conf.Janitor.Discovery.Backend = DiscoveryBackendResourceGraph
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.ResourceGroups.Enable = true
+	j.Conf.Janitor.Deployments.Enable = true
+	j.Conf.Janitor.Deployments.Ttl = 24 * time.Hour
+	j.Conf.Janitor.Deployments.Limit = 700
+	j.Conf.Janitor.RoleAssignments.Enable = true
+	j.Conf.Janitor.RoleAssignments.Ttl = 6 * time.Hour
+	j.Conf.Janitor.RoleAssignments.RoleDefintionIds = []string{testRoleDefinitionId}
+	j.Azure.ResourceGraph = graph
+	j = buildFakeJanitorFromObj(t, server, j)
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "expired resource exists", false, server.Exists(expiredId))
+	assumeState(t, "expired resource (second subscription) exists", false, server.Exists(secondExpiredId))
+	assumeState(t, "untagged resource exists", true, server.Exists(untaggedId))
+	assumeState(t, "expired resourceGroup exists", false, server.Exists("/subscriptions/"+testSubscriptionId+"/resourceGroups/rg-expired"))
+	assumeState(t, "old deployment exists", false, server.Exists(deploymentId))
+	assumeState(t, "expired roleAssignment exists", false, server.Exists(roleAssignmentId))
+
+	// one query per kind for all subscriptions, only tagged resources
+	queries := graph.Queries()
+	if len(queries) != 3 || !strings.Contains(queries[0], "isnotempty(tags)") {
+		t.Fatalf(`expected three Resource Graph queries (tagged resources first), got: %v`, queries)
+	}
+
+	// no ARM list requests for discovered kinds
+	for _, request := range server.Requests("GET") {
+		request = strings.ToLower(request)
+		if strings.HasSuffix(request, "/resources") || strings.HasSuffix(request, "/resourcegroups") || strings.HasSuffix(request, fakeArmProviderRoleAssignments) {
+			t.Fatalf(`expected no ARM list request, got: %v`, request)
+		}
+	}
+
+	if failureCount := j.GetRunStatus().FailureCount(); failureCount != 0 {
+		t.Fatalf(`expected no failures, got: %v`, failureCount)
+	}
+}
+
+func TestRunResourceGraphDiscoveryFallback(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	expiredId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "expired", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+
+	j := buildJanitorObj()
+	j.Conf.Janitor.Discovery.Backend = DiscoveryBackendResourceGraph
+	j.Conf.Janitor.Resources.Enable = true
+	j.Azure.ResourceGraph = &fakeResourceGraphClient{server: server, err: errors.New("injected failure")}
+	j = buildFakeJanitorFromObj(t, server, j)
+	j.runJanitor(context.Background(), j.Logger)
+
+	// discovery failure is reported, resources are processed via ARM list API
+	assumeState(t, "expired resource exists", false, server.Exists(expiredId))
+	if failures := j.GetRunStatus().Failures; len(failures) != 1 || failures[0].Task != "discovery" {
+		t.Fatalf(`expected discovery failure, got: %v`, failures)
+	}
+}
+
+func TestRunResourceGraphDiscoveryTimestamps(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	oldId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "old", nil)
+	server.SetCreatedTime(oldId, time.Now().Add(-60*24*time.Hour))
+	newId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "new", nil)
+	server.SetCreatedTime(newId, time.Now().Add(-1*time.Hour))
+
+	j := buildJanitorObj()
+	j.Conf.Janitor.Discovery.Backend = DiscoveryBackendResourceGraph
+	j.Conf.Janitor.Resources.Enable = true
+	j.Policy = &config.Policy{
+		Rules: []*config.PolicyRule{
+			{Name: "sandbox", MaxAge: "30d"},
+		},
+	}
+	j.Policy.ApplyDefaults("ttl", "ttl_expiry")
+	j.Azure.ResourceGraph = &fakeResourceGraphClient{server: server}
+	j = buildFakeJanitorFromObj(t, server, j)
+	j.runJanitor(context.Background(), j.Logger)
+
+	// creation time is projected from the properties (first seen time would not expire the resource)
+	assumeState(t, "old resource exists", false, server.Exists(oldId))
+	assumeState(t, "new resource exists", true, server.Exists(newId))
+}
+
+func TestRunResourceGraphDiscoveryResourceGroupTag(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-untagged", nil)
+	server.AddResourceGroup(testSubscriptionId, "rg-expired", map[string]string{
+		"TTL": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+
+	graph := &fakeResourceGraphClient{server: server}
+
+	j := buildJanitorObj()
+	j.Conf.Janitor.Discovery.Backend = DiscoveryBackendResourceGraph
+	j.Conf.Janitor.ResourceGroups.Enable = true
+	j.Conf.Janitor.ResourceGroups.FilterTag = "ttl"
+	j.Azure.ResourceGraph = graph
+	j = buildFakeJanitorFromObj(t, server, j)
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "expired resourceGroup exists", false, server.Exists("/subscriptions/"+testSubscriptionId+"/resourceGroups/rg-expired"))
+
+	if queries := graph.Queries(); len(queries) != 1 || !strings.Contains(queries[0], `| where tostring(tags) contains '"ttl":'`) {
+		t.Fatalf(`expected resourceGroup query with tag condition, got: %v`, queries)
+	}
+	if val := testutil.CollectAndCount(j.Prometheus.MetricTtlResources); val != 1 {
+		t.Fatalf(`expected ttl metric for tagged resourceGroup only, got: %v`, val)
+	}
+}
+
+func TestRunResourceGraphDiscoveryManagementGroupRoleAssignments(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddManagementGroup("mg-test", "")
+
+	expired := time.Now().Add(-12 * time.Hour)
+	managementGroupScope := "/providers/Microsoft.Management/managementGroups/mg-test"
+	groupId := server.AddRoleAssignment(managementGroupScope, "group", testRoleDefinitionId, armauthorization.PrincipalTypeServicePrincipal, expired, "")
+	subscriptionRoleAssignmentId := server.AddRoleAssignment("/subscriptions/"+testSubscriptionId, "subscription", testRoleDefinitionId, armauthorization.PrincipalTypeServicePrincipal, expired, "")
+
+	graph := &fakeResourceGraphClient{server: server}
+
+	j := buildJanitorObj()
+	j.Conf.Janitor.Discovery.Backend = DiscoveryBackendResourceGraph
+	j.Conf.Janitor.RoleAssignments.Enable = true
+	j.Conf.Janitor.RoleAssignments.Ttl = 6 * time.Hour
+	j.Conf.Janitor.RoleAssignments.RoleDefintionIds = []string{testRoleDefinitionId}
+	j.Conf.Janitor.RoleAssignments.Scopes = []string{managementGroupScope, "/subscriptions/" + testSubscriptionId}
+	j.Conf.Janitor.RoleAssignments.AtScope = true
+	j.Azure.ResourceGraph = graph
+	j = buildFakeJanitorFromObj(t, server, j)
+	j.runJanitor(context.Background(), j.Logger)
+
+	// ManagementGroup scope (without subscriptionId in Resource Graph) is listed via ARM
+	assumeState(t, "managementGroup roleAssignment exists", false, server.Exists(groupId))
+	assumeState(t, "subscription roleAssignment exists", false, server.Exists(subscriptionRoleAssignmentId))
+
+	if queries := graph.Queries(); len(queries) != 1 || !strings.Contains(queries[0], "isnotempty(subscriptionId)") {
+		t.Fatalf(`expected roleAssignment query for subscriptions only, got: %v`, queries)
+	}
+	if failureCount := j.GetRunStatus().FailureCount(); failureCount != 0 {
+		t.Fatalf(`expected no failures, got: %v`, failureCount)
+	}
+}
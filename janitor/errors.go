@@ -0,0 +1,125 @@
+package janitor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/webdevops/go-common/log/slogger"
+)
+
+const (
+	ErrorClassRetryable = "retryable"
+	ErrorClassForbidden = "forbidden"
+	ErrorClassFatal     = "fatal"
+)
+
+type (
+	// RunStatus contains the failed subscriptions and tasks of one janitor run
+	RunStatus struct {
+		StartTime  time.Time    `json:"startTime"`
+		FinishTime *time.Time   `json:"finishTime,omitempty"`
+		Failures   []RunFailure `json:"failures"`
+
+		lock sync.Mutex
+	}
+
+	RunFailure struct {
+		SubscriptionID string `json:"subscriptionId,omitempty"`
+		Task           string `json:"task"`
+		ErrorClass     string `json:"errorClass"`
+		Error          string `json:"error"`
+	}
+)
+
+// classifyAzureError classifies errors as retryable (throttling, server errors, network), forbidden (authorization) or fatal
+func classifyAzureError(err error) string {
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) {
+		switch {
+		case responseErr.StatusCode == http.StatusUnauthorized, responseErr.StatusCode == http.StatusForbidden:
+			return ErrorClassForbidden
+		case responseErr.StatusCode == http.StatusTooManyRequests,
+			responseErr.StatusCode == http.StatusRequestTimeout,
+			responseErr.StatusCode >= http.StatusInternalServerError:
+			return ErrorClassRetryable
+		case strings.EqualFold(responseErr.ErrorCode, "AuthorizationFailed"):
+			return ErrorClassForbidden
+		default:
+			return ErrorClassFatal
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return ErrorClassRetryable
+	}
+
+	return ErrorClassFatal
+}
+
+func NewRunStatus() *RunStatus {
+	return &RunStatus{
+		StartTime: time.Now(),
+		Failures:  []RunFailure{},
+	}
+}
+
+// AddFailure adds a failed subscription or task (safe for concurrent use)
+func (s *RunStatus) AddFailure(failure RunFailure) {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Failures = append(s.Failures, failure)
+}
+
+// Finish marks the run as finished
+func (s *RunStatus) Finish() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	finishTime := time.Now()
+	s.FinishTime = &finishTime
+}
+
+// FailureCount returns the number of failures
+func (s *RunStatus) FailureCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.Failures)
+}
+
+// recordRunError logs and records a failed subscription or task, the run continues with the next one
+func (j *Janitor) recordRunError(logger *slogger.Logger, subscriptionID, task, resourceType string, err error) {
+	errorClass := classifyAzureError(err)
+
+	switch errorClass {
+	case ErrorClassForbidden:
+		logger.Warnf(`task "%s" failed, access forbidden: %v`, task, err.Error())
+	case ErrorClassRetryable:
+		logger.Warnf(`task "%s" failed, will be retried with next run: %v`, task, err.Error())
+	default:
+		logger.Errorf(`task "%s" failed: %v`, task, err.Error())
+	}
+
+	j.runStatus.AddFailure(RunFailure{
+		SubscriptionID: subscriptionID,
+		Task:           task,
+		ErrorClass:     errorClass,
+		Error:          err.Error(),
+	})
+
+	j.Prometheus.MetricErrors.With(prometheus.Labels{
+		"subscriptionID": strings.ToLower(subscriptionID),
+		"resourceType":   strings.ToLower(resourceType),
+	}).Inc()
+}
@@ -0,0 +1,81 @@
+package janitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClassifyAzureError(t *testing.T) {
+	testCases := map[string]struct {
+		err      error
+		expected string
+	}{
+		"forbidden":      {&azcore.ResponseError{StatusCode: http.StatusForbidden}, ErrorClassForbidden},
+		"unauthorized":   {&azcore.ResponseError{StatusCode: http.StatusUnauthorized}, ErrorClassForbidden},
+		"authorization":  {&azcore.ResponseError{StatusCode: http.StatusBadRequest, ErrorCode: "AuthorizationFailed"}, ErrorClassForbidden},
+		"throttled":      {&azcore.ResponseError{StatusCode: http.StatusTooManyRequests}, ErrorClassRetryable},
+		"server error":   {fmt.Errorf("wrapped: %w", &azcore.ResponseError{StatusCode: http.StatusBadGateway}), ErrorClassRetryable},
+		"timeout":        {context.DeadlineExceeded, ErrorClassRetryable},
+		"not found":      {&azcore.ResponseError{StatusCode: http.StatusNotFound}, ErrorClassFatal},
+		"unknown errors": {errors.New("something failed"), ErrorClassFatal},
+	}
+
+	for name, testCase := range testCases {
+		if val := classifyAzureError(testCase.err); val != testCase.expected {
+			t.Fatalf(`expected error class "%v" for %v, got: "%v"`, testCase.expected, name, val)
+		}
+	}
+}
+
+func TestRunContinuesAfterErrors(t *testing.T) {
+	failingSubscriptionId := "00000000-0000-0000-0000-000000000000"
+
+	server := buildFakeArmEnvironment(t)
+	server.AddSubscription(failingSubscriptionId, "failing-subscription")
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	expired := map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	}
+	failingId := server.AddResource(failingSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "failing", expired)
+	expiredId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "expired", expired)
+
+	server.FailRequest(http.MethodGet, "/subscriptions/"+failingSubscriptionId+"/resources", http.StatusForbidden)
+	server.FailRequest(http.MethodGet, "/subscriptions/"+failingSubscriptionId+"/resourcegroups", http.StatusTooManyRequests)
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.ResourceGroups.Enable = true
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "resource in failing subscription exists", true, server.Exists(failingId))
+	assumeState(t, "resource in healthy subscription exists", false, server.Exists(expiredId))
+
+	status := j.GetRunStatus()
+	if len(status.Failures) != 2 {
+		t.Fatalf(`expected 2 failures in run status, got: %v`, status.Failures)
+	}
+
+	errorClasses := map[string]string{}
+	for _, failure := range status.Failures {
+		if failure.SubscriptionID != failingSubscriptionId {
+			t.Fatalf(`expected failure for subscription "%v", got: %v`, failingSubscriptionId, failure)
+		}
+		errorClasses[failure.Task] = failure.ErrorClass
+	}
+
+	if errorClasses[PlanKindResource] != ErrorClassForbidden || errorClasses[PlanKindResourceGroup] != ErrorClassRetryable {
+		t.Fatalf(`unexpected error classes: %v`, errorClasses)
+	}
+
+	if val := testutil.CollectAndCount(j.Prometheus.MetricErrors); val != 2 {
+		t.Fatalf(`expected 2 error metrics, got: %v`, val)
+	}
+}
@@ -0,0 +1,1077 @@
+package janitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	armauthorization "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/managementgroups/armmanagementgroups"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armlocks"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armsubscriptions"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/webdevops/go-common/azuresdk/armclient"
+	"github.com/webdevops/go-common/utils/to"
+)
+
+const (
+	fakeArmProviderDeployments     = "/providers/microsoft.resources/deployments"
+	fakeArmProviderRoleAssignments = "/providers/microsoft.authorization/roleassignments"
+	fakeArmProviderLocks           = "/providers/microsoft.authorization/locks"
+	fakeArmManagementGroups        = "/providers/microsoft.management/managementgroups/"
+	fakeArmOperations              = "/operations/"
+	fakeArmProviderTags            = "/providers/microsoft.resources/tags/default"
+)
+
+type (
+	// fakeArmServer is an in-process fake of the Azure ResourceManager API
+	// implementing the endpoints used by the janitor
+	fakeArmServer struct {
+		server *httptest.Server
+		lock   sync.Mutex
+
+		subscriptions   map[string]*armsubscriptions.Subscription
+		providers       map[string][]*armresources.Provider
+		resources       map[string]*armresources.GenericResourceExpanded
+		resourceGroups  map[string]*armresources.ResourceGroup
+		deployments     map[string]*armresources.DeploymentExtended
+		roleAssignments map[string]*armauthorization.RoleAssignment
+		locks           map[string]*armlocks.ManagementLockObject
+
+		// managementGroups contains the parent of each management group, subscriptionGroups the management group
+		// of each subscription (all lowercase)
+		managementGroups   map[string]string
+		subscriptionGroups map[string]string
+
+		// failures contains injected error status codes by "METHOD /path" (lowercase path),
+		// requestFailures injected error status codes for the n-th request only
+		failures        map[string]int
+		requestFailures map[string]map[int]int
+		requestCounts   map[string]int
+
+		// longRunningDeletes contains delete operations which are processed asynchronously (by lowercase resource id)
+		longRunningDeletes map[string]*fakeArmOperation
+		operations         map[string]*fakeArmOperation
+
+		// dependencies contains resources which cannot be deleted while their parent exists (by lowercase resource id)
+		dependencies map[string]*fakeArmDependency
+
+		// requests contains all processed requests as "METHOD /path"
+		requests []string
+
+		// filters contains the $filter of all list requests by lowercase path, rejectFilters rejects all $filter requests
+		filters       map[string][]string
+		rejectFilters bool
+
+		// apiVersions contains the api-version of all requests by "METHOD /path" (lowercase path)
+		apiVersions map[string][]string
+	}
+
+	// fakeArmOperation is a long-running operation which is finished after the given number of polls
+	fakeArmOperation struct {
+		resourceId string
+		polls      int
+		fail       bool
+	}
+
+	// fakeArmDependency is a parent resource which blocks the delete of a resource, the delete also fails
+	// for the given number of (reserved) requests after the parent has been deleted
+	fakeArmDependency struct {
+		parentId string
+		reserved int
+	}
+
+	// fakeArmClientProvider connects the janitor to a fakeArmServer
+	fakeArmClientProvider struct {
+		server *fakeArmServer
+	}
+
+	// fakeResourceGraphClient answers Resource Graph queries from the objects of a fakeArmServer
+	fakeResourceGraphClient struct {
+		server *fakeArmServer
+		lock   sync.Mutex
+
+		// queries contains all executed queries, err is returned for all queries (if set)
+		queries []string
+		err     error
+	}
+
+	// fakePrincipalClient resolves all principals as existing except the deleted ones
+	fakePrincipalClient struct {
+		lock sync.Mutex
+
+		// deleted contains the (lowercase) IDs of deleted principals, lookups contains the principal IDs of
+		// all lookups, err is returned for all lookups (if set)
+		deleted map[string]bool
+		lookups [][]string
+		err     error
+	}
+
+	fakeTokenCredential struct{}
+)
+
+func newFakeArmServer(t *testing.T) *fakeArmServer {
+	t.Helper()
+
+	s := &fakeArmServer{
+		subscriptions:   map[string]*armsubscriptions.Subscription{},
+		providers:       map[string][]*armresources.Provider{},
+		resources:       map[string]*armresources.GenericResourceExpanded{},
+		resourceGroups:  map[string]*armresources.ResourceGroup{},
+		deployments:     map[string]*armresources.DeploymentExtended{},
+		roleAssignments: map[string]*armauthorization.RoleAssignment{},
+		locks:           map[string]*armlocks.ManagementLockObject{},
+
+		managementGroups:   map[string]string{},
+		subscriptionGroups: map[string]string{},
+		failures:           map[string]int{},
+		requestFailures:    map[string]map[int]int{},
+		requestCounts:      map[string]int{},
+		filters:            map[string][]string{},
+		apiVersions:        map[string][]string{},
+
+		longRunningDeletes: map[string]*fakeArmOperation{},
+		operations:         map[string]*fakeArmOperation{},
+		dependencies:       map[string]*fakeArmDependency{},
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.server.Close)
+
+	return s
+}
+
+// buildFakeJanitor builds a janitor connected to the fake ARM server with a private metric registry
+func buildFakeJanitor(t *testing.T, server *fakeArmServer) *Janitor {
+	t.Helper()
+	return buildFakeJanitorFromObj(t, server, buildJanitorObj())
+}
+
+// buildFakeJanitorFromObj connects a prepared janitor (eg with additional configuration) to the fake ARM server
+func buildFakeJanitorFromObj(t *testing.T, server *fakeArmServer, j *Janitor) *Janitor {
+	t.Helper()
+
+	j.Logger = buildTestLogger()
+	j.Conf.Janitor.Interval = time.Hour
+	j.Conf.Janitor.Delete.Timeout = time.Minute
+	j.Conf.Janitor.Delete.PollInterval = 10 * time.Millisecond
+	j.Azure.ClientProvider = &fakeArmClientProvider{server: server}
+	j.Azure.ResourceTagManager = &armclient.ResourceTagManager{}
+	j.Prometheus.Registerer = prometheus.NewRegistry()
+	j.Init()
+
+	return j
+}
+
+func (s *fakeArmServer) AddSubscription(subscriptionId, displayName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := armsubscriptions.SubscriptionStateEnabled
+	s.subscriptions[strings.ToLower(subscriptionId)] = &armsubscriptions.Subscription{
+		ID:             to.StringPtr("/subscriptions/" + subscriptionId),
+		SubscriptionID: to.StringPtr(subscriptionId),
+		DisplayName:    to.StringPtr(displayName),
+		State:          &state,
+	}
+}
+
+// SetSubscriptionTags sets the tags of a subscription
+func (s *fakeArmServer) SetSubscriptionTags(subscriptionId string, tags map[string]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if subscription, exists := s.subscriptions[strings.ToLower(subscriptionId)]; exists {
+		subscription.Tags = fakeArmTags(tags)
+	}
+}
+
+// AddManagementGroup adds a management group below the parent management group (empty for root)
+func (s *fakeArmServer) AddManagementGroup(groupId, parentGroupId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.managementGroups[strings.ToLower(groupId)] = strings.ToLower(parentGroupId)
+}
+
+// SetSubscriptionManagementGroup moves the subscription into the management group
+func (s *fakeArmServer) SetSubscriptionManagementGroup(subscriptionId, groupId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.subscriptionGroups[strings.ToLower(subscriptionId)] = strings.ToLower(groupId)
+}
+
+func (s *fakeArmServer) AddProvider(subscriptionId, namespace, resourceType string, apiVersions ...string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	provider := &armresources.Provider{
+		Namespace: to.StringPtr(namespace),
+		ResourceTypes: []*armresources.ProviderResourceType{
+			{
+				ResourceType: to.StringPtr(resourceType),
+				APIVersions:  to.SlicePtr(apiVersions),
+			},
+		},
+	}
+
+	key := strings.ToLower(subscriptionId)
+	s.providers[key] = append(s.providers[key], provider)
+}
+
+func (s *fakeArmServer) AddResourceGroup(subscriptionId, name string, tags map[string]string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	resourceId := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s", subscriptionId, name)
+	s.resourceGroups[strings.ToLower(resourceId)] = &armresources.ResourceGroup{
+		ID:       to.StringPtr(resourceId),
+		Name:     to.StringPtr(name),
+		Type:     to.StringPtr("Microsoft.Resources/resourceGroups"),
+		Location: to.StringPtr("westeurope"),
+		Tags:     fakeArmTags(tags),
+	}
+}
+
+func (s *fakeArmServer) AddResource(subscriptionId, resourceGroup, resourceType, name string, tags map[string]string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	resourceId := fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/%s/%s", subscriptionId, resourceGroup, resourceType, name)
+	s.resources[strings.ToLower(resourceId)] = &armresources.GenericResourceExpanded{
+		ID:       to.StringPtr(resourceId),
+		Name:     to.StringPtr(name),
+		Type:     to.StringPtr(resourceType),
+		Location: to.StringPtr("westeurope"),
+		Tags:     fakeArmTags(tags),
+	}
+
+	return resourceId
+}
+
+// SetCreatedTime sets the creation time of a resource (returned by list with $expand=createdTime)
+func (s *fakeArmServer) SetCreatedTime(resourceId string, createdTime time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if resource, exists := s.resources[strings.ToLower(resourceId)]; exists {
+		resource.CreatedTime = &createdTime
+	}
+}
+
+// SetChangedTime sets the last change time of a resource (returned by list with $expand=changedTime)
+func (s *fakeArmServer) SetChangedTime(resourceId string, changedTime time.Time) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if resource, exists := s.resources[strings.ToLower(resourceId)]; exists {
+		resource.ChangedTime = &changedTime
+	}
+}
+
+// SetSku sets the sku name of a resource
+func (s *fakeArmServer) SetSku(resourceId, skuName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if resource, exists := s.resources[strings.ToLower(resourceId)]; exists {
+		resource.SKU = &armresources.SKU{Name: to.StringPtr(skuName)}
+	}
+}
+
+// AddDeployment adds a deployment on subscription scope (resourceGroup is empty) or on resourceGroup scope
+func (s *fakeArmServer) AddDeployment(subscriptionId, resourceGroup, name string, timestamp time.Time) string {
+	scope := "/subscriptions/" + subscriptionId
+	if resourceGroup != "" {
+		scope += "/resourceGroups/" + resourceGroup
+	}
+
+	return s.AddScopeDeployment(scope, name, timestamp)
+}
+
+// AddScopeDeployment adds a deployment on any scope (eg. "/providers/Microsoft.Management/managementGroups/<id>",
+// empty for tenant scope)
+func (s *fakeArmServer) AddScopeDeployment(scope, name string, timestamp time.Time) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	resourceId := fmt.Sprintf("%s/providers/Microsoft.Resources/deployments/%s", scope, name)
+	s.deployments[strings.ToLower(resourceId)] = &armresources.DeploymentExtended{
+		ID:   to.StringPtr(resourceId),
+		Name: to.StringPtr(name),
+		Type: to.StringPtr("Microsoft.Resources/deployments"),
+		Properties: &armresources.DeploymentPropertiesExtended{
+			Timestamp: &timestamp,
+		},
+	}
+
+	return resourceId
+}
+
+// SetDeploymentState sets the provisioning state of a deployment
+func (s *fakeArmServer) SetDeploymentState(resourceId string, state armresources.ProvisioningState) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if deployment, exists := s.deployments[strings.ToLower(resourceId)]; exists {
+		deployment.Properties.ProvisioningState = &state
+	}
+}
+
+func (s *fakeArmServer) AddRoleAssignment(scope, name, roleDefinitionId string, principalType armauthorization.PrincipalType, createdOn time.Time, description string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	resourceId := fmt.Sprintf("%s/providers/Microsoft.Authorization/roleAssignments/%s", scope, name)
+	s.roleAssignments[strings.ToLower(resourceId)] = &armauthorization.RoleAssignment{
+		ID:   to.StringPtr(resourceId),
+		Name: to.StringPtr(name),
+		Type: to.StringPtr("Microsoft.Authorization/roleAssignments"),
+		Properties: &armauthorization.RoleAssignmentProperties{
+			Scope:            to.StringPtr(scope),
+			PrincipalID:      to.StringPtr("00000000-0000-0000-0000-" + fmt.Sprintf("%012d", len(s.roleAssignments))),
+			PrincipalType:    &principalType,
+			RoleDefinitionID: to.StringPtr(roleDefinitionId),
+			CreatedOn:        &createdOn,
+			Description:      to.StringPtr(description),
+		},
+	}
+
+	return resourceId
+}
+
+// SetRoleAssignmentPrincipal sets the principal ID of a roleAssignment
+func (s *fakeArmServer) SetRoleAssignmentPrincipal(resourceId, principalId string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if roleAssignment, exists := s.roleAssignments[strings.ToLower(resourceId)]; exists {
+		roleAssignment.Properties.PrincipalID = to.StringPtr(principalId)
+	}
+}
+
+// AddManagementLock adds a management lock on the given scope (subscription, resourceGroup or resource)
+func (s *fakeArmServer) AddManagementLock(scope, name string, level armlocks.LockLevel) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	lockId := fmt.Sprintf("%s/providers/Microsoft.Authorization/locks/%s", scope, name)
+	s.locks[strings.ToLower(lockId)] = &armlocks.ManagementLockObject{
+		ID:   to.StringPtr(lockId),
+		Name: to.StringPtr(name),
+		Type: to.StringPtr("Microsoft.Authorization/locks"),
+		Properties: &armlocks.ManagementLockProperties{
+			Level: &level,
+		},
+	}
+
+	return lockId
+}
+
+// FailRequest injects an error response for all requests with the given method and path
+func (s *fakeArmServer) FailRequest(method, path string, statusCode int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.failures[method+" "+strings.ToLower(path)] = statusCode
+}
+
+// FailNthRequest injects an error response only for the n-th request (starting at 1) with the given method and path
+func (s *fakeArmServer) FailNthRequest(method, path string, num, statusCode int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	requestKey := method + " " + strings.ToLower(path)
+	if s.requestFailures[requestKey] == nil {
+		s.requestFailures[requestKey] = map[int]int{}
+	}
+	s.requestFailures[requestKey][num] = statusCode
+}
+
+// LongRunningDelete processes the delete of a resource as long-running operation,
+// the resource is removed (or the operation fails) after the given number of polls
+func (s *fakeArmServer) LongRunningDelete(resourceId string, polls int, fail bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.longRunningDeletes[strings.ToLower(resourceId)] = &fakeArmOperation{
+		resourceId: strings.ToLower(resourceId),
+		polls:      polls,
+		fail:       fail,
+	}
+}
+
+// AddDependency blocks the delete of the resource (in use) while the parent exists and for the given number of
+// delete requests after the parent has been deleted
+func (s *fakeArmServer) AddDependency(resourceId, parentId string, reserved int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.dependencies[strings.ToLower(resourceId)] = &fakeArmDependency{
+		parentId: strings.ToLower(parentId),
+		reserved: reserved,
+	}
+}
+
+// Exists checks if a resource (resource, resourceGroup, deployment or roleAssignment) still exists
+func (s *fakeArmServer) Exists(resourceId string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := strings.ToLower(resourceId)
+	if _, exists := s.resources[key]; exists {
+		return true
+	}
+	if _, exists := s.resourceGroups[key]; exists {
+		return true
+	}
+	if _, exists := s.deployments[key]; exists {
+		return true
+	}
+	if _, exists := s.roleAssignments[key]; exists {
+		return true
+	}
+	return false
+}
+
+// Tags returns the current tags of a resource or resourceGroup
+func (s *fakeArmServer) Tags(resourceId string) map[string]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := strings.ToLower(resourceId)
+	if resource, exists := s.resources[key]; exists {
+		return to.StringMap(resource.Tags)
+	}
+	if resourceGroup, exists := s.resourceGroups[key]; exists {
+		return to.StringMap(resourceGroup.Tags)
+	}
+	return nil
+}
+
+// RejectFilters rejects all list requests with $filter (bad request)
+func (s *fakeArmServer) RejectFilters() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rejectFilters = true
+}
+
+// Filters returns the $filter of all list requests of the path (empty string for requests without $filter)
+func (s *fakeArmServer) Filters(path string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.filters[strings.ToLower(path)]...)
+}
+
+// ApiVersions returns the api-version of all requests with the given method and path
+func (s *fakeArmServer) ApiVersions(method, path string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string{}, s.apiVersions[method+" "+strings.ToLower(path)]...)
+}
+
+// Requests returns all processed requests with the given method
+func (s *fakeArmServer) Requests(method string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ret := []string{}
+	for _, request := range s.requests {
+		if strings.HasPrefix(request, method+" ") {
+			ret = append(ret, request)
+		}
+	}
+	return ret
+}
+
+func (s *fakeArmServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// scope based urls (eg roleAssignments) might contain double slashes
+	path := "/" + strings.Trim(r.URL.Path, "/")
+	for strings.Contains(path, "//") {
+		path = strings.ReplaceAll(path, "//", "/")
+	}
+	key := strings.ToLower(path)
+	s.requests = append(s.requests, r.Method+" "+path)
+	s.apiVersions[r.Method+" "+key] = append(s.apiVersions[r.Method+" "+key], r.URL.Query().Get("api-version"))
+
+	if statusCode, exists := s.failures[r.Method+" "+key]; exists {
+		s.writeError(w, statusCode, http.StatusText(statusCode), "injected failure")
+		return
+	}
+
+	s.requestCounts[r.Method+" "+key]++
+	if statusCode, exists := s.requestFailures[r.Method+" "+key][s.requestCounts[r.Method+" "+key]]; exists {
+		s.writeError(w, statusCode, http.StatusText(statusCode), "injected failure")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if strings.HasPrefix(key, fakeArmOperations) {
+			s.handleOperation(w, strings.TrimPrefix(key, fakeArmOperations))
+			return
+		}
+
+		// $filter is recorded but not applied
+		filter := r.URL.Query().Get("$filter")
+		s.filters[key] = append(s.filters[key], filter)
+		if filter != "" && s.rejectFilters {
+			s.writeError(w, http.StatusBadRequest, "InvalidFilterInQueryString", "injected filter rejection")
+			return
+		}
+		s.handleList(w, key, filter)
+	case http.MethodPatch:
+		s.handleUpdate(w, r, key)
+	case http.MethodDelete:
+		s.handleDelete(w, key)
+	default:
+		s.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+func (s *fakeArmServer) handleList(w http.ResponseWriter, key, filter string) {
+	parts := strings.Split(strings.TrimPrefix(key, "/"), "/")
+
+	switch {
+	case key == "/subscriptions":
+		list := []any{}
+		for _, subscriptionId := range fakeArmSortedKeys(s.subscriptions) {
+			list = append(list, s.subscriptions[subscriptionId])
+		}
+		s.writeList(w, list)
+
+	case strings.HasPrefix(key, fakeArmManagementGroups) && strings.HasSuffix(key, "/descendants"):
+		groupId := strings.TrimSuffix(strings.TrimPrefix(key, fakeArmManagementGroups), "/descendants")
+		if _, exists := s.managementGroups[groupId]; !exists {
+			s.writeError(w, http.StatusNotFound, "NotFound", key)
+			return
+		}
+
+		// management group is descendant if the group itself or one of its parents is the requested group
+		isDescendant := func(group string) bool {
+			for group != "" {
+				if group == groupId {
+					return true
+				}
+				group = s.managementGroups[group]
+			}
+			return false
+		}
+
+		list := []any{}
+		for _, group := range fakeArmSortedKeys(s.managementGroups) {
+			if group != groupId && isDescendant(group) {
+				list = append(list, &armmanagementgroups.DescendantInfo{
+					ID:   to.StringPtr("/providers/Microsoft.Management/managementGroups/" + group),
+					Name: to.StringPtr(group),
+					Type: to.StringPtr("Microsoft.Management/managementGroups"),
+				})
+			}
+		}
+		for _, subscriptionId := range fakeArmSortedKeys(s.subscriptionGroups) {
+			if isDescendant(s.subscriptionGroups[subscriptionId]) {
+				list = append(list, &armmanagementgroups.DescendantInfo{
+					ID:   to.StringPtr("/subscriptions/" + subscriptionId),
+					Name: to.StringPtr(subscriptionId),
+					Type: to.StringPtr("/subscriptions"),
+				})
+			}
+		}
+		s.writeList(w, list)
+
+	case len(parts) == 3 && parts[0] == "subscriptions" && parts[2] == "locations":
+		s.writeList(w, []any{})
+
+	case len(parts) == 3 && parts[0] == "subscriptions" && parts[2] == "providers":
+		list := []any{}
+		for _, provider := range s.providers[parts[1]] {
+			list = append(list, provider)
+		}
+		s.writeList(w, list)
+
+	case len(parts) == 4 && parts[0] == "subscriptions" && parts[2] == "providers":
+		// single resource provider namespace (resource types of all matching providers)
+		var ret *armresources.Provider
+		for _, provider := range s.providers[parts[1]] {
+			if !strings.EqualFold(to.String(provider.Namespace), parts[3]) {
+				continue
+			}
+			if ret == nil {
+				ret = &armresources.Provider{Namespace: provider.Namespace}
+			}
+			ret.ResourceTypes = append(ret.ResourceTypes, provider.ResourceTypes...)
+		}
+
+		if ret == nil {
+			s.writeError(w, http.StatusNotFound, "InvalidResourceNamespace", parts[3])
+			return
+		}
+		s.writeJson(w, http.StatusOK, ret)
+
+	case len(parts) == 3 && parts[0] == "subscriptions" && parts[2] == "resources":
+		prefix := "/subscriptions/" + parts[1] + "/"
+		list := []any{}
+		for _, resourceId := range fakeArmSortedKeys(s.resources) {
+			if !strings.HasPrefix(resourceId, prefix) {
+				continue
+			}
+
+			if strings.Contains(strings.ToLower(filter), "tagvalue") {
+				// like ARM: tags are omitted if $filter contains tagValue
+				resource := *s.resources[resourceId]
+				resource.Tags = nil
+				list = append(list, &resource)
+			} else {
+				list = append(list, s.resources[resourceId])
+			}
+		}
+		s.writeList(w, list)
+
+	case len(parts) == 3 && parts[0] == "subscriptions" && parts[2] == "resourcegroups":
+		prefix := "/subscriptions/" + parts[1] + "/"
+		list := []any{}
+		for _, resourceId := range fakeArmSortedKeys(s.resourceGroups) {
+			if strings.HasPrefix(resourceId, prefix) {
+				list = append(list, s.resourceGroups[resourceId])
+			}
+		}
+		s.writeList(w, list)
+
+	case len(parts) == 5 && parts[0] == "subscriptions" && strings.HasSuffix(key, fakeArmProviderLocks):
+		prefix := "/subscriptions/" + parts[1] + "/"
+		list := []any{}
+		for _, lockId := range fakeArmSortedKeys(s.locks) {
+			if strings.HasPrefix(lockId, prefix) {
+				list = append(list, s.locks[lockId])
+			}
+		}
+		s.writeList(w, list)
+
+	case strings.HasSuffix(key, fakeArmProviderDeployments):
+		scope := strings.TrimSuffix(key, fakeArmProviderDeployments)
+		list := []any{}
+		for _, resourceId := range fakeArmSortedKeys(s.deployments) {
+			if strings.HasPrefix(resourceId, scope+fakeArmProviderDeployments+"/") {
+				list = append(list, s.deployments[resourceId])
+			}
+		}
+		s.writeList(w, list)
+
+	case strings.HasSuffix(key, fakeArmProviderRoleAssignments):
+		scope := strings.TrimSuffix(key, fakeArmProviderRoleAssignments)
+		list := []any{}
+		managementGroupScopes := s.managementGroupScopes(scope)
+		for _, resourceId := range fakeArmSortedKeys(s.roleAssignments) {
+			// roleAssignments of the scope, of child scopes and inherited from parent scopes (including management groups)
+			roleAssignmentScope := strings.ToLower(to.String(s.roleAssignments[resourceId].Properties.Scope))
+			if strings.HasPrefix(resourceId, scope+"/") || scope == roleAssignmentScope || strings.HasPrefix(scope, roleAssignmentScope+"/") || managementGroupScopes[roleAssignmentScope] {
+				list = append(list, s.roleAssignments[resourceId])
+			}
+		}
+		s.writeList(w, list)
+
+	default:
+		s.writeError(w, http.StatusNotFound, "NotFound", key)
+	}
+}
+
+// managementGroupScopes returns the (lowercase) scopes of all management groups above the subscription of the scope
+func (s *fakeArmServer) managementGroupScopes(scope string) map[string]bool {
+	ret := map[string]bool{}
+
+	subscriptionId, found := strings.CutPrefix(scope, "/subscriptions/")
+	if !found {
+		return ret
+	}
+	subscriptionId, _, _ = strings.Cut(subscriptionId, "/")
+
+	groupId := s.subscriptionGroups[subscriptionId]
+	for groupId != "" && !ret["/providers/microsoft.management/managementgroups/"+groupId] {
+		ret["/providers/microsoft.management/managementgroups/"+groupId] = true
+		groupId = s.managementGroups[groupId]
+	}
+	return ret
+}
+
+// handleUpdate implements the Microsoft.Resources/tags patch operation (merge, delete, replace) at resource and
+// resourceGroup scope, other PATCH requests (eg. full resource updates) are rejected
+func (s *fakeArmServer) handleUpdate(w http.ResponseWriter, r *http.Request, key string) {
+	scope, isTagsRequest := strings.CutSuffix(key, fakeArmProviderTags)
+	if !isTagsRequest {
+		s.writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "only tags api is supported for updates")
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "InvalidRequest", err.Error())
+		return
+	}
+
+	payload := armresources.TagsPatchResource{}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Operation == nil || payload.Properties == nil {
+		s.writeError(w, http.StatusBadRequest, "InvalidRequestContent", string(body))
+		return
+	}
+
+	var tags *map[string]*string
+	if resource, exists := s.resources[scope]; exists {
+		tags = &resource.Tags
+	} else if resourceGroup, exists := s.resourceGroups[scope]; exists {
+		tags = &resourceGroup.Tags
+	} else {
+		s.writeError(w, http.StatusNotFound, "ResourceNotFound", scope)
+		return
+	}
+
+	if *tags == nil {
+		*tags = map[string]*string{}
+	}
+
+	switch *payload.Operation {
+	case armresources.TagsPatchOperationMerge:
+		maps.Copy(*tags, payload.Properties.Tags)
+	case armresources.TagsPatchOperationDelete:
+		for tagName := range payload.Properties.Tags {
+			delete(*tags, tagName)
+		}
+	case armresources.TagsPatchOperationReplace:
+		*tags = maps.Clone(payload.Properties.Tags)
+	default:
+		s.writeError(w, http.StatusBadRequest, "InvalidTagsOperation", string(*payload.Operation))
+		return
+	}
+
+	s.writeJson(w, http.StatusOK, armresources.TagsResource{
+		ID:         to.StringPtr(scope + fakeArmProviderTags),
+		Name:       to.StringPtr("default"),
+		Properties: &armresources.Tags{Tags: *tags},
+	})
+}
+
+func (s *fakeArmServer) handleDelete(w http.ResponseWriter, key string) {
+	for lockId := range s.locks {
+		scope, _, _ := strings.Cut(lockId, fakeArmProviderLocks+"/")
+		if key == scope || strings.HasPrefix(key, scope+"/") {
+			s.writeError(w, http.StatusConflict, "ScopeLocked", key)
+			return
+		}
+	}
+
+	if dependency, exists := s.dependencies[key]; exists {
+		if _, parentExists := s.resources[dependency.parentId]; parentExists {
+			code, message := fakeArmInUseError(key)
+			s.writeError(w, http.StatusBadRequest, code, message)
+			return
+		}
+		if dependency.reserved > 0 {
+			dependency.reserved--
+			s.writeError(w, http.StatusBadRequest, "NicReservedForAnotherVm", key)
+			return
+		}
+	}
+
+	if operation, exists := s.longRunningDeletes[key]; exists {
+		delete(s.longRunningDeletes, key)
+
+		operationId := fmt.Sprintf("%d", len(s.operations)+1)
+		s.operations[operationId] = operation
+
+		w.Header().Set("Location", s.server.URL+fakeArmOperations+operationId)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	s.deleteObject(w, key)
+}
+
+// handleOperation returns the state of a long-running operation
+func (s *fakeArmServer) handleOperation(w http.ResponseWriter, operationId string) {
+	operation, exists := s.operations[operationId]
+	if !exists {
+		s.writeError(w, http.StatusNotFound, "OperationNotFound", operationId)
+		return
+	}
+
+	if operation.polls > 0 {
+		operation.polls--
+		w.Header().Set("Location", s.server.URL+fakeArmOperations+operationId)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if operation.fail {
+		s.writeError(w, http.StatusConflict, "DeleteFailed", operation.resourceId)
+		return
+	}
+
+	s.deleteObject(w, operation.resourceId)
+}
+
+// deleteObject removes a resource, resourceGroup (including children), deployment or roleAssignment
+func (s *fakeArmServer) deleteObject(w http.ResponseWriter, key string) {
+	if _, exists := s.resources[key]; exists {
+		delete(s.resources, key)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if _, exists := s.resourceGroups[key]; exists {
+		delete(s.resourceGroups, key)
+
+		// also remove all child resources
+		for resourceId := range s.resources {
+			if strings.HasPrefix(resourceId, key+"/") {
+				delete(s.resources, resourceId)
+			}
+		}
+		for resourceId := range s.deployments {
+			if strings.HasPrefix(resourceId, key+"/") {
+				delete(s.deployments, resourceId)
+			}
+		}
+
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if _, exists := s.deployments[key]; exists {
+		delete(s.deployments, key)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if roleAssignment, exists := s.roleAssignments[key]; exists {
+		delete(s.roleAssignments, key)
+		s.writeJson(w, http.StatusOK, roleAssignment)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *fakeArmServer) writeList(w http.ResponseWriter, list []any) {
+	s.writeJson(w, http.StatusOK, map[string]any{"value": list})
+}
+
+// fakeArmInUseError returns the Azure error code and message for deleting a resource which is still in use
+func fakeArmInUseError(resourceId string) (string, string) {
+	switch {
+	case strings.Contains(resourceId, "/microsoft.compute/disks/"):
+		return "OperationNotAllowed", fmt.Sprintf("Disk %s is attached to VM.", resourceId)
+	case strings.Contains(resourceId, "/microsoft.network/publicipaddresses/"):
+		return "PublicIPAddressInUse", resourceId
+	case strings.Contains(resourceId, "/microsoft.network/networksecuritygroups/"):
+		return "InUseNetworkSecurityGroupCannotBeDeleted", resourceId
+	default:
+		return "NicInUse", resourceId
+	}
+}
+
+func (s *fakeArmServer) writeError(w http.ResponseWriter, statusCode int, code, message string) {
+	s.writeJson(w, statusCode, map[string]any{
+		"error": map[string]string{
+			"code":    code,
+			"message": message,
+		},
+	})
+}
+
+func (s *fakeArmServer) writeJson(w http.ResponseWriter, statusCode int, payload any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(payload); err != nil {
+		panic(err)
+	}
+}
+
+func (p *fakeArmClientProvider) GetCred() azcore.TokenCredential {
+	return &fakeTokenCredential{}
+}
+
+func (p *fakeArmClientProvider) NewArmClientOptions() *arm.ClientOptions {
+	return &arm.ClientOptions{
+		ClientOptions: policy.ClientOptions{
+			Cloud: cloud.Configuration{
+				ActiveDirectoryAuthorityHost: p.server.server.URL,
+				Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+					cloud.ResourceManager: {
+						Endpoint: p.server.server.URL,
+						Audience: "https://management.core.windows.net/",
+					},
+				},
+			},
+			Retry: policy.RetryOptions{
+				MaxRetries: -1,
+			},
+			InsecureAllowCredentialWithHTTP: true,
+		},
+		DisableRPRegistration: true,
+	}
+}
+
+func (p *fakeArmClientProvider) ListSubscriptions(ctx context.Context) (map[string]*armsubscriptions.Subscription, error) {
+	client, err := armsubscriptions.NewClient(p.GetCred(), p.NewArmClientOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	list := map[string]*armsubscriptions.Subscription{}
+	pager := client.NewListPager(nil)
+	for pager.More() {
+		result, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, subscription := range result.Value {
+			list[*subscription.SubscriptionID] = subscription
+		}
+	}
+
+	return list, nil
+}
+
+func (c *fakePrincipalClient) ExistingPrincipals(ctx context.Context, principalIds []string) (map[string]bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.lookups = append(c.lookups, principalIds)
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	ret := map[string]bool{}
+	for _, principalId := range principalIds {
+		if !c.deleted[strings.ToLower(principalId)] {
+			ret[strings.ToLower(principalId)] = true
+		}
+	}
+	return ret, nil
+}
+
+// Query supports the tables used for discovery (resources, resourcecontainers and authorizationresources),
+// rows are limited to the given subscriptions and resource types are returned lowercase (like Resource Graph).
+// Creation and change times are only returned if projected from properties, tag conditions are applied on
+// resourceGroups and rows outside of subscriptions (eg. ManagementGroup scope) have no subscriptionId.
+func (c *fakeResourceGraphClient) Query(ctx context.Context, query string, subscriptions []string) ([]map[string]any, error) {
+	c.lock.Lock()
+	c.queries = append(c.queries, query)
+	c.lock.Unlock()
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	c.server.lock.Lock()
+	defer c.server.lock.Unlock()
+
+	objects := map[string]any{}
+	switch strings.Fields(query)[0] {
+	case "resources":
+		for resourceId, resource := range c.server.resources {
+			if strings.Contains(query, "isnotempty(tags)") && len(resource.Tags) == 0 {
+				continue
+			}
+			objects[resourceId] = resource
+		}
+	case "resourcecontainers":
+		for resourceId, resourceGroup := range c.server.resourceGroups {
+			if _, tagCondition, exists := strings.Cut(query, "tostring(tags) contains '"); exists {
+				tagKey, _, _ := strings.Cut(tagCondition, ":'")
+				if tagName, _ := findTag(resourceGroup.Tags, strings.Trim(tagKey, `"`)); tagName == "" {
+					continue
+				}
+			}
+			objects[resourceId] = resourceGroup
+		}
+	case "authorizationresources":
+		for resourceId, roleAssignment := range c.server.roleAssignments {
+			objects[resourceId] = roleAssignment
+		}
+	default:
+		return nil, fmt.Errorf("unsupported query: %v", query)
+	}
+
+	ret := []map[string]any{}
+	for _, resourceId := range fakeArmSortedKeys(objects) {
+		subscriptionId := ""
+		if strings.HasPrefix(resourceId, "/subscriptions/") {
+			subscriptionId = strings.Split(resourceId, "/")[2]
+			if !slices.ContainsFunc(subscriptions, func(val string) bool { return strings.EqualFold(val, subscriptionId) }) {
+				continue
+			}
+		} else if strings.Contains(query, "isnotempty(subscriptionId)") {
+			continue
+		}
+
+		data, err := json.Marshal(objects[resourceId])
+		if err != nil {
+			return nil, err
+		}
+
+		row := map[string]any{}
+		if err := json.Unmarshal(data, &row); err != nil {
+			return nil, err
+		}
+		row["type"] = strings.ToLower(row["type"].(string))
+		row["subscriptionId"] = subscriptionId
+
+		// resource timestamps are part of the properties in Resource Graph
+		for _, field := range []string{"createdTime", "changedTime"} {
+			if _, exists := row[field]; exists && !strings.Contains(query, field+" = properties."+field) {
+				delete(row, field)
+			}
+		}
+		ret = append(ret, row)
+	}
+
+	return ret, nil
+}
+
+// Queries returns all executed queries
+func (c *fakeResourceGraphClient) Queries() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string{}, c.queries...)
+}
+
+func (c *fakeTokenCredential) GetToken(ctx context.Context, options policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	return azcore.AccessToken{
+		Token:     "fake-token",
+		ExpiresOn: time.Now().Add(time.Hour),
+	}, nil
+}
+
+func fakeArmTags(tags map[string]string) map[string]*string {
+	ret := map[string]*string{}
+	for tagName, tagValue := range tags {
+		ret[tagName] = to.StringPtr(tagValue)
+	}
+	return ret
+}
+
+func fakeArmSortedKeys[T any](list map[string]T) []string {
+	ret := make([]string, 0, len(list))
+	for key := range list {
+		ret = append(ret, key)
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,413 @@
+package janitor
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+)
+
+const (
+	filterFieldName          = "name"
+	filterFieldResourceType  = "resourcetype"
+	filterFieldLocation      = "location"
+	filterFieldResourceGroup = "resourcegroup"
+	filterFieldTagName       = "tagname"
+	filterFieldTagValue      = "tagvalue"
+)
+
+var (
+	// filterFieldNames maps the (lowercase) fields to the names used by ARM
+	filterFieldNames = map[string]string{
+		filterFieldName:          "name",
+		filterFieldResourceType:  "resourceType",
+		filterFieldLocation:      "location",
+		filterFieldResourceGroup: "resourceGroup",
+		filterFieldTagName:       "tagName",
+		filterFieldTagValue:      "tagValue",
+	}
+
+	// filterFields contains the supported fields of $filter expressions per listing
+	filterFields = map[string][]string{
+		PlanKindResource: {
+			filterFieldName,
+			filterFieldResourceType,
+			filterFieldLocation,
+			filterFieldResourceGroup,
+			filterFieldTagName,
+			filterFieldTagValue,
+		},
+		PlanKindResourceGroup: {
+			filterFieldName,
+			filterFieldLocation,
+			filterFieldTagName,
+			filterFieldTagValue,
+		},
+	}
+)
+
+type (
+	// ListFilter narrows the resource or resourceGroup listing. The supported part of the filter is passed as $filter
+	// to ARM (server side), the full filter is always checked client side as ARM rejects some combinations
+	// (eg. tagName and resourceType) and resourceGroup listings only support tag filters.
+	ListFilter struct {
+		kind       string
+		expression filterExpression
+		server     filterExpression
+	}
+
+	// FilterObject contains the properties of a resource or resourceGroup used for client side filtering
+	FilterObject struct {
+		Name          string
+		ResourceType  string
+		Location      string
+		ResourceGroup string
+		Tags          map[string]*string
+	}
+
+	filterExpression interface {
+		matches(obj FilterObject) bool
+		String() string
+	}
+
+	filterAnd struct {
+		terms []filterExpression
+	}
+
+	filterOr struct {
+		terms []filterExpression
+	}
+
+	// filterCompare is a "field eq 'value'" condition (case insensitive)
+	filterCompare struct {
+		field string
+		value string
+	}
+
+	// filterTag is a "tagName eq 'name'" condition, optionally combined with "tagValue eq 'value'"
+	filterTag struct {
+		name  string
+		value *string
+	}
+
+	// filterSubstring is a "substringof('value', field)" condition (case insensitive)
+	filterSubstring struct {
+		field string
+		value string
+	}
+)
+
+// NewListFilter builds the filter for resource or resourceGroup listings (kind) based on the additional $filter
+// expression and the tag, resource type and location options, all conditions are combined with "and".
+// Returns nil if no filter is set.
+func NewListFilter(kind, expression, tag string, resourceTypes, locations []string) (*ListFilter, error) {
+	terms := []filterExpression{}
+
+	if strings.TrimSpace(expression) != "" {
+		parsed, err := parseFilterExpression(expression)
+		if err != nil {
+			return nil, fmt.Errorf(`invalid $filter "%s": %w`, expression, err)
+		}
+		terms = append(terms, parsed)
+	}
+
+	if tag != "" {
+		terms = append(terms, &filterTag{name: tag})
+	}
+
+	for _, option := range []struct {
+		field  string
+		values []string
+	}{
+		{field: filterFieldResourceType, values: resourceTypes},
+		{field: filterFieldLocation, values: locations},
+	} {
+		if len(option.values) == 0 {
+			continue
+		}
+
+		or := &filterOr{}
+		for _, value := range option.values {
+			or.terms = append(or.terms, &filterCompare{field: option.field, value: value})
+		}
+		terms = append(terms, simplifyFilter(or))
+	}
+
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	filter := &ListFilter{
+		kind:       kind,
+		expression: simplifyFilter(&filterAnd{terms: terms}),
+	}
+
+	if err := filter.validate(filter.expression); err != nil {
+		return nil, err
+	}
+	filter.server = filter.buildServerFilter()
+
+	return filter, nil
+}
+
+// Matches checks the object against the filter (client side), a nil filter matches everything
+func (f *ListFilter) Matches(obj FilterObject) bool {
+	if f == nil {
+		return true
+	}
+
+	return f.expression.matches(obj)
+}
+
+// ServerFilter returns the $filter for ARM (nil if no part of the filter is supported by ARM)
+func (f *ListFilter) ServerFilter() *string {
+	if f == nil || f.server == nil {
+		return nil
+	}
+
+	filter := f.server.String()
+	return &filter
+}
+
+// ServerFilterTagName returns the tag name if the server side filter is a tag condition (empty otherwise)
+func (f *ListFilter) ServerFilterTagName() string {
+	if f == nil {
+		return ""
+	}
+
+	if tag, ok := f.server.(*filterTag); ok {
+		return tag.name
+	}
+	return ""
+}
+
+func (f *ListFilter) String() string {
+	if f == nil {
+		return ""
+	}
+
+	return f.expression.String()
+}
+
+// validate checks if all used fields are supported by the listing
+func (f *ListFilter) validate(expression filterExpression) error {
+	check := func(field string) error {
+		for _, supportedField := range filterFields[f.kind] {
+			if field == supportedField {
+				return nil
+			}
+		}
+		return fmt.Errorf(`field "%s" is not supported for %s filter`, filterFieldNames[field], f.kind)
+	}
+
+	switch v := expression.(type) {
+	case *filterAnd:
+		for _, term := range v.terms {
+			if err := f.validate(term); err != nil {
+				return err
+			}
+		}
+	case *filterOr:
+		for _, term := range v.terms {
+			if err := f.validate(term); err != nil {
+				return err
+			}
+		}
+	case *filterCompare:
+		return check(v.field)
+	case *filterSubstring:
+		return check(v.field)
+	case *filterTag:
+		return check(filterFieldTagName)
+	}
+
+	return nil
+}
+
+// buildServerFilter returns the part of the filter supported by ARM: resource listings support either one tag condition
+// or conditions without tags, resourceGroup listings support one tag condition only (without tagValue, see serverFilterTag)
+func (f *ListFilter) buildServerFilter() filterExpression {
+	if f.isServerSupported(f.expression) {
+		return serverFilterTag(f.expression)
+	}
+
+	and, ok := f.expression.(*filterAnd)
+	if !ok {
+		return nil
+	}
+
+	supported := &filterAnd{}
+	for _, term := range and.terms {
+		if !containsFilterTag(term) && f.isServerSupported(term) {
+			supported.terms = append(supported.terms, term)
+		}
+	}
+
+	if len(supported.terms) == 0 {
+		// try tag condition only
+		for _, term := range and.terms {
+			if _, ok := term.(*filterTag); ok {
+				return serverFilterTag(term)
+			}
+		}
+		return nil
+	}
+
+	return simplifyFilter(supported)
+}
+
+func (f *ListFilter) isServerSupported(expression filterExpression) bool {
+	if _, ok := expression.(*filterTag); ok {
+		return true
+	}
+
+	return f.kind == PlanKindResource && !containsFilterTag(expression)
+}
+
+// serverFilterTag removes the tagValue from tag conditions: ARM omits the tags of all listed resources if the $filter
+// contains tagValue, so only the tagName is passed to ARM and the value is checked client side
+func serverFilterTag(expression filterExpression) filterExpression {
+	if tag, ok := expression.(*filterTag); ok && tag.value != nil {
+		return &filterTag{name: tag.name}
+	}
+	return expression
+}
+
+// isFilterRejectedError checks if ARM has rejected the $filter of a listing (bad request)
+func isFilterRejectedError(err error) bool {
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusBadRequest
+}
+
+func containsFilterTag(expression filterExpression) bool {
+	switch v := expression.(type) {
+	case *filterTag:
+		return true
+	case *filterAnd:
+		for _, term := range v.terms {
+			if containsFilterTag(term) {
+				return true
+			}
+		}
+	case *filterOr:
+		for _, term := range v.terms {
+			if containsFilterTag(term) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// simplifyFilter removes and/or nodes with only one term
+func simplifyFilter(expression filterExpression) filterExpression {
+	switch v := expression.(type) {
+	case *filterAnd:
+		if len(v.terms) == 1 {
+			return v.terms[0]
+		}
+	case *filterOr:
+		if len(v.terms) == 1 {
+			return v.terms[0]
+		}
+	}
+
+	return expression
+}
+
+func (e *filterAnd) matches(obj FilterObject) bool {
+	for _, term := range e.terms {
+		if !term.matches(obj) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *filterAnd) String() string {
+	parts := make([]string, 0, len(e.terms))
+	for _, term := range e.terms {
+		if _, ok := term.(*filterOr); ok {
+			parts = append(parts, "("+term.String()+")")
+		} else {
+			parts = append(parts, term.String())
+		}
+	}
+	return strings.Join(parts, " and ")
+}
+
+func (e *filterOr) matches(obj FilterObject) bool {
+	for _, term := range e.terms {
+		if term.matches(obj) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *filterOr) String() string {
+	parts := make([]string, 0, len(e.terms))
+	for _, term := range e.terms {
+		if tag, ok := term.(*filterTag); ok && tag.value != nil {
+			parts = append(parts, "("+term.String()+")")
+		} else {
+			parts = append(parts, term.String())
+		}
+	}
+	return strings.Join(parts, " or ")
+}
+
+func (e *filterCompare) matches(obj FilterObject) bool {
+	return strings.EqualFold(obj.field(e.field), e.value)
+}
+
+func (e *filterCompare) String() string {
+	return fmt.Sprintf("%s eq %s", filterFieldNames[e.field], quoteFilterValue(e.value))
+}
+
+func (e *filterTag) matches(obj FilterObject) bool {
+	tagName, tagValue := findTag(obj.Tags, e.name)
+	if tagName == "" {
+		return false
+	}
+
+	return e.value == nil || (tagValue != nil && strings.EqualFold(*tagValue, *e.value))
+}
+
+func (e *filterTag) String() string {
+	ret := fmt.Sprintf("tagName eq %s", quoteFilterValue(e.name))
+	if e.value != nil {
+		ret += fmt.Sprintf(" and tagValue eq %s", quoteFilterValue(*e.value))
+	}
+	return ret
+}
+
+func (e *filterSubstring) matches(obj FilterObject) bool {
+	return strings.Contains(strings.ToLower(obj.field(e.field)), strings.ToLower(e.value))
+}
+
+func (e *filterSubstring) String() string {
+	return fmt.Sprintf("substringof(%s, %s)", quoteFilterValue(e.value), filterFieldNames[e.field])
+}
+
+func (obj FilterObject) field(name string) string {
+	switch name {
+	case filterFieldName:
+		return obj.Name
+	case filterFieldResourceType:
+		return obj.ResourceType
+	case filterFieldLocation:
+		return obj.Location
+	case filterFieldResourceGroup:
+		return obj.ResourceGroup
+	}
+	return ""
+}
+
+// quoteFilterValue quotes the value as OData string (single quotes are escaped by doubling them)
+func quoteFilterValue(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
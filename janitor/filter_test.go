@@ -0,0 +1,249 @@
+package janitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/webdevops/go-common/utils/to"
+)
+
+func TestListFilterParser(t *testing.T) {
+	testCases := map[string]string{
+		"resourceType eq 'Microsoft.Storage/storageAccounts'":                      "resourceType eq 'Microsoft.Storage/storageAccounts'",
+		"ResourceType EQ 'a' Or location eq 'westeurope'":                          "resourceType eq 'a' or location eq 'westeurope'",
+		"(resourceType eq 'a' or resourceType eq 'b') and location eq 'x'":         "(resourceType eq 'a' or resourceType eq 'b') and location eq 'x'",
+		"tagName eq 'owner' and tagValue eq 'team''s'":                             "tagName eq 'owner' and tagValue eq 'team''s'",
+		"substringof('sandbox', resourceGroup) and tagName eq 'ttl'":               "substringof('sandbox', resourceGroup) and tagName eq 'ttl'",
+		"tagName eq 'a' and tagValue eq '1' or tagName eq 'b' and tagValue eq '2'": "(tagName eq 'a' and tagValue eq '1') or (tagName eq 'b' and tagValue eq '2')",
+	}
+
+	for expression, expected := range testCases {
+		filter, err := NewListFilter(PlanKindResource, expression, "", nil, nil)
+		assumeNotError(t, expression, err)
+		if val := filter.String(); val != expected {
+			t.Fatalf(`expected filter "%v" for "%v", got: "%v"`, expected, expression, val)
+		}
+	}
+
+	invalidExpressions := []string{
+		"resourceType eq 'a",
+		"resourceType ne 'a'",
+		"unknown eq 'a'",
+		"tagValue eq 'a'",
+		"(resourceType eq 'a'",
+		"resourceType eq 'a' and",
+		"substringof('a', tagName)",
+		"resourceType eq 'a' location eq 'b'",
+	}
+	for _, expression := range invalidExpressions {
+		_, err := NewListFilter(PlanKindResource, expression, "", nil, nil)
+		assumeError(t, expression, err)
+	}
+
+	// resourceGroups cannot be filtered by resourceType
+	_, err := NewListFilter(PlanKindResourceGroup, "resourceType eq 'a'", "", nil, nil)
+	assumeError(t, "resourceGroup filter", err)
+
+	// no filter
+	filter, err := NewListFilter(PlanKindResource, " ", "", nil, nil)
+	assumeNotError(t, "empty filter", err)
+	if filter != nil || filter.ServerFilter() != nil || !filter.Matches(FilterObject{}) {
+		t.Fatalf(`expected nil filter matching everything, got: "%v"`, filter.String())
+	}
+}
+
+func TestListFilterServerFilter(t *testing.T) {
+	testCases := []struct {
+		kind          string
+		expression    string
+		tag           string
+		resourceTypes []string
+		locations     []string
+		server        string
+	}{
+		{kind: PlanKindResource, tag: "ttl", server: "tagName eq 'ttl'"},
+		{kind: PlanKindResource, resourceTypes: []string{"a", "b"}, locations: []string{"x"}, server: "(resourceType eq 'a' or resourceType eq 'b') and location eq 'x'"},
+		// ARM rejects tagName combined with other conditions, tag is checked client side
+		{kind: PlanKindResource, tag: "ttl", resourceTypes: []string{"a"}, server: "resourceType eq 'a'"},
+		{kind: PlanKindResource, expression: "tagName eq 'ttl' or location eq 'x'", server: ""},
+		// tagValue is checked client side (ARM omits tags if $filter contains tagValue)
+		{kind: PlanKindResource, expression: "tagName eq 'owner' and tagValue eq 'team'", server: "tagName eq 'owner'"},
+		{kind: PlanKindResourceGroup, expression: "tagName eq 'owner' and tagValue eq 'team'", server: "tagName eq 'owner'"},
+		// resourceGroups only support tag filters
+		{kind: PlanKindResourceGroup, tag: "ttl", locations: []string{"x"}, server: "tagName eq 'ttl'"},
+		{kind: PlanKindResourceGroup, locations: []string{"x"}, server: ""},
+	}
+
+	for _, testCase := range testCases {
+		filter, err := NewListFilter(testCase.kind, testCase.expression, testCase.tag, testCase.resourceTypes, testCase.locations)
+		assumeNotError(t, "filter", err)
+
+		if val := to.String(filter.ServerFilter()); val != testCase.server {
+			t.Fatalf(`expected server filter "%v" for "%v", got: "%v"`, testCase.server, filter.String(), val)
+		}
+	}
+}
+
+func TestListFilterMatches(t *testing.T) {
+	filter, err := NewListFilter(
+		PlanKindResource,
+		"substringof('sandbox', resourceGroup) and (tagName eq 'env' and tagValue eq 'DEV' or tagName eq 'ttl')",
+		"",
+		[]string{"Microsoft.Storage/storageAccounts"},
+		nil,
+	)
+	assumeNotError(t, "filter", err)
+
+	obj := FilterObject{
+		Name:          "storage",
+		ResourceType:  "microsoft.storage/storageaccounts",
+		Location:      "westeurope",
+		ResourceGroup: "rg-Sandbox-1",
+		Tags:          map[string]*string{"Env": to.StringPtr("dev")},
+	}
+	assumeState(t, "matching object", true, filter.Matches(obj))
+
+	obj.Tags = map[string]*string{"env": to.StringPtr("prod")}
+	assumeState(t, "wrong tag value", false, filter.Matches(obj))
+
+	obj.Tags = map[string]*string{"ttl": to.StringPtr("")}
+	assumeState(t, "alternative tag", true, filter.Matches(obj))
+
+	obj.ResourceGroup = "rg-prod"
+	assumeState(t, "wrong resourceGroup", false, filter.Matches(obj))
+
+	obj.ResourceGroup = "rg-sandbox"
+	obj.ResourceType = "Microsoft.Compute/disks"
+	assumeState(t, "wrong resourceType", false, filter.Matches(obj))
+}
+
+func TestRunResourcesFilter(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddProvider(testSubscriptionId, "Microsoft.Compute", "disks", "2023-01-01")
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	expired := func(tags map[string]string) map[string]string {
+		tags["ttl"] = time.Now().Add(-1 * time.Hour).Format(time.RFC3339)
+		return tags
+	}
+	matchingId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "matching", expired(map[string]string{"cleanup": "true"}))
+	untaggedId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "untagged", expired(map[string]string{}))
+	otherTypeId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Compute/disks", "other", expired(map[string]string{"cleanup": "true"}))
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.Resources.FilterTag = "cleanup"
+	j.Conf.Janitor.Resources.FilterResourceType = []string{"Microsoft.Storage/storageAccounts"}
+	j.initFilters()
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "matching resource exists", false, server.Exists(matchingId))
+	assumeState(t, "untagged resource exists", true, server.Exists(untaggedId))
+	assumeState(t, "other type resource exists", true, server.Exists(otherTypeId))
+
+	resourcesPath := "/subscriptions/" + testSubscriptionId + "/resources"
+	if val := server.Filters(resourcesPath); len(val) != 1 || val[0] != "resourceType eq 'Microsoft.Storage/storageAccounts'" {
+		t.Fatalf(`expected server side resourceType filter, got: %v`, val)
+	}
+}
+
+func TestRunResourcesFilterTagValue(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	expired := time.Now().Add(-1 * time.Hour).Format(time.RFC3339)
+	matchingId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "matching", map[string]string{"cleanup": "true", "ttl": expired})
+	otherValueId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "other", map[string]string{"cleanup": "false", "ttl": expired})
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.Resources.AdditionalFilter = to.StringPtr("tagName eq 'cleanup' and tagValue eq 'true'")
+	j.initFilters()
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "matching resource exists", false, server.Exists(matchingId))
+	assumeState(t, "resource with other tag value exists", true, server.Exists(otherValueId))
+
+	resourcesPath := "/subscriptions/" + testSubscriptionId + "/resources"
+	if val := server.Filters(resourcesPath); len(val) != 1 || val[0] != "tagName eq 'cleanup'" {
+		t.Fatalf(`expected server side filter without tagValue, got: %v`, val)
+	}
+}
+
+func TestRunResourcesFilterRejected(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+	server.RejectFilters()
+
+	expiredId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "expired", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+	otherId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "other", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.Resources.AdditionalFilter = to.StringPtr("name eq 'expired'")
+	j.initFilters()
+	j.runJanitor(context.Background(), j.Logger)
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "expired resource exists", false, server.Exists(expiredId))
+	assumeState(t, "other resource exists", true, server.Exists(otherId))
+
+	// rejected filter is retried without filter, every run tries the filter again
+	resourcesPath := "/subscriptions/" + testSubscriptionId + "/resources"
+	if val := server.Filters(resourcesPath); len(val) != 4 || val[0] != "name eq 'expired'" || val[1] != "" || val[2] != "name eq 'expired'" || val[3] != "" {
+		t.Fatalf(`expected rejected filter and fallback without filter in each run, got: %v`, val)
+	}
+
+	if failureCount := j.GetRunStatus().FailureCount(); failureCount != 0 {
+		t.Fatalf(`expected no failures, got: %v`, failureCount)
+	}
+}
+
+func TestRunResourceGroupsFilterTag(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	expired := time.Now().Add(-1 * time.Hour).Format(time.RFC3339)
+	server.AddResourceGroup(testSubscriptionId, "rg-tagged", map[string]string{"ttl": expired})
+	server.AddResourceGroup(testSubscriptionId, "rg-target", map[string]string{"ttl_expiry": expired})
+	taggedId := "/subscriptions/" + testSubscriptionId + "/resourceGroups/rg-tagged"
+	targetId := "/subscriptions/" + testSubscriptionId + "/resourceGroups/rg-target"
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.DryRun = true
+	j.Conf.Janitor.ResourceGroups.Enable = true
+	j.initFilters()
+	j.runJanitor(context.Background(), j.Logger)
+
+	// no implicit tag filter, resourceGroups with target tag only are processed too
+	resourceGroupsPath := "/subscriptions/" + testSubscriptionId + "/resourcegroups"
+	if val := server.Filters(resourceGroupsPath); len(val) != 1 || val[0] != "" {
+		t.Fatalf(`expected listing without server side filter, got: %v`, val)
+	}
+	planned := map[string]bool{}
+	for _, item := range j.GetPlan().ItemsByAction(PlanActionDelete) {
+		planned[item.ResourceID] = true
+	}
+	if len(planned) != 2 || !planned[taggedId] || !planned[targetId] {
+		t.Fatalf(`expected planned deletion of %v and %v, got: %v`, taggedId, targetId, planned)
+	}
+
+	// explicit tag filter is passed as server side filter
+	j.Conf.Janitor.ResourceGroups.FilterTag = "ttl"
+	j.initFilters()
+	j.runJanitor(context.Background(), j.Logger)
+
+	if val := server.Filters(resourceGroupsPath); len(val) != 2 || val[1] != "tagName eq 'ttl'" {
+		t.Fatalf(`expected server side ttl tag filter, got: %v`, val)
+	}
+	planned = map[string]bool{}
+	for _, item := range j.GetPlan().ItemsByAction(PlanActionDelete) {
+		planned[item.ResourceID] = true
+	}
+	if len(planned) != 1 || !planned[taggedId] {
+		t.Fatalf(`expected planned deletion of %v only, got: %v`, taggedId, planned)
+	}
+}
@@ -0,0 +1,266 @@
+package janitor
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	filterTokenIdent = iota
+	filterTokenString
+	filterTokenOpen
+	filterTokenClose
+	filterTokenComma
+)
+
+type (
+	filterToken struct {
+		kind  int
+		value string
+	}
+
+	// filterParser parses the supported subset of OData $filter expressions:
+	// "field eq 'value'" and "substringof('value', field)" conditions combined with and/or and parentheses
+	filterParser struct {
+		tokens []filterToken
+		pos    int
+	}
+)
+
+func parseFilterExpression(expression string) (filterExpression, error) {
+	tokens, err := tokenizeFilter(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &filterParser{tokens: tokens}
+	ret, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if token := parser.peek(); token != nil {
+		return nil, fmt.Errorf(`unexpected "%s"`, token.value)
+	}
+
+	return ret, nil
+}
+
+func tokenizeFilter(expression string) ([]filterToken, error) {
+	tokens := []filterToken{}
+
+	for pos := 0; pos < len(expression); {
+		char := expression[pos]
+		switch {
+		case char == ' ' || char == '\t' || char == '\n':
+			pos++
+		case char == '(':
+			tokens = append(tokens, filterToken{kind: filterTokenOpen, value: "("})
+			pos++
+		case char == ')':
+			tokens = append(tokens, filterToken{kind: filterTokenClose, value: ")"})
+			pos++
+		case char == ',':
+			tokens = append(tokens, filterToken{kind: filterTokenComma, value: ","})
+			pos++
+		case char == '\'':
+			// OData string, single quotes are escaped by doubling them
+			value := strings.Builder{}
+			closed := false
+			for pos++; pos < len(expression); pos++ {
+				if expression[pos] == '\'' {
+					if pos+1 < len(expression) && expression[pos+1] == '\'' {
+						value.WriteByte('\'')
+						pos++
+						continue
+					}
+					closed = true
+					pos++
+					break
+				}
+				value.WriteByte(expression[pos])
+			}
+			if !closed {
+				return nil, errors.New("unterminated string")
+			}
+			tokens = append(tokens, filterToken{kind: filterTokenString, value: value.String()})
+		case isFilterIdentChar(char):
+			start := pos
+			for pos < len(expression) && isFilterIdentChar(expression[pos]) {
+				pos++
+			}
+			tokens = append(tokens, filterToken{kind: filterTokenIdent, value: expression[start:pos]})
+		default:
+			return nil, fmt.Errorf(`unexpected character "%c"`, char)
+		}
+	}
+
+	return tokens, nil
+}
+
+func isFilterIdentChar(char byte) bool {
+	return (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9') || char == '_'
+}
+
+func (p *filterParser) peek() *filterToken {
+	if p.pos >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos]
+}
+
+func (p *filterParser) next(kind int, description string) (*filterToken, error) {
+	token := p.peek()
+	if token == nil {
+		return nil, fmt.Errorf(`unexpected end, expected %s`, description)
+	}
+	if token.kind != kind {
+		return nil, fmt.Errorf(`unexpected "%s", expected %s`, token.value, description)
+	}
+	p.pos++
+	return token, nil
+}
+
+// isKeyword checks if the next token is the keyword (case insensitive) and consumes it
+func (p *filterParser) isKeyword(keyword string) bool {
+	if token := p.peek(); token != nil && token.kind == filterTokenIdent && strings.EqualFold(token.value, keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) parseOr() (filterExpression, error) {
+	ret := &filterOr{}
+	for {
+		term, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		ret.terms = append(ret.terms, term)
+
+		if !p.isKeyword("or") {
+			return simplifyFilter(ret), nil
+		}
+	}
+}
+
+func (p *filterParser) parseAnd() (filterExpression, error) {
+	terms := []filterExpression{}
+	for {
+		term, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
+
+		if !p.isKeyword("and") {
+			break
+		}
+	}
+
+	// combine tagName and tagValue conditions
+	ret := &filterAnd{}
+	var lastTag *filterTag
+	for _, term := range terms {
+		compare, ok := term.(*filterCompare)
+		switch {
+		case ok && compare.field == filterFieldTagName:
+			lastTag = &filterTag{name: compare.value}
+			ret.terms = append(ret.terms, lastTag)
+		case ok && compare.field == filterFieldTagValue:
+			if lastTag == nil || lastTag.value != nil {
+				return nil, errors.New("tagValue must follow a tagName condition")
+			}
+			value := compare.value
+			lastTag.value = &value
+		default:
+			ret.terms = append(ret.terms, term)
+		}
+	}
+
+	return simplifyFilter(ret), nil
+}
+
+func (p *filterParser) parseTerm() (filterExpression, error) {
+	token := p.peek()
+	if token == nil {
+		return nil, errors.New("unexpected end, expected condition")
+	}
+
+	if token.kind == filterTokenOpen {
+		p.pos++
+		ret, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.next(filterTokenClose, `")"`); err != nil {
+			return nil, err
+		}
+		return ret, nil
+	}
+
+	if p.isKeyword("substringof") {
+		return p.parseSubstring()
+	}
+
+	fieldToken, err := p.next(filterTokenIdent, "field")
+	if err != nil {
+		return nil, err
+	}
+	field, err := parseFilterField(fieldToken.value)
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.isKeyword("eq") {
+		return nil, fmt.Errorf(`expected "eq" after "%s" (only eq is supported)`, fieldToken.value)
+	}
+
+	value, err := p.next(filterTokenString, "string")
+	if err != nil {
+		return nil, err
+	}
+
+	return &filterCompare{field: field, value: value.value}, nil
+}
+
+// parseSubstring parses substringof('value', field)
+func (p *filterParser) parseSubstring() (filterExpression, error) {
+	if _, err := p.next(filterTokenOpen, `"("`); err != nil {
+		return nil, err
+	}
+	value, err := p.next(filterTokenString, "string")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.next(filterTokenComma, `","`); err != nil {
+		return nil, err
+	}
+	fieldToken, err := p.next(filterTokenIdent, "field")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.next(filterTokenClose, `")"`); err != nil {
+		return nil, err
+	}
+
+	field, err := parseFilterField(fieldToken.value)
+	if err != nil {
+		return nil, err
+	}
+	if field == filterFieldTagName || field == filterFieldTagValue {
+		return nil, fmt.Errorf(`substringof is not supported for "%s"`, fieldToken.value)
+	}
+
+	return &filterSubstring{field: field, value: value.value}, nil
+}
+
+func parseFilterField(value string) (string, error) {
+	field := strings.ToLower(value)
+	if _, exists := filterFieldNames[field]; !exists {
+		return "", fmt.Errorf(`unknown field "%s"`, value)
+	}
+	return field, nil
+}
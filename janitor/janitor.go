@@ -4,13 +4,16 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armsubscriptions"
 	tparse "github.com/karrick/tparse/v2"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/remeh/sizedwaitgroup"
 	"github.com/rickb777/period"
 	"github.com/webdevops/go-common/azuresdk/armclient"
 	"github.com/webdevops/go-common/log/slogger"
@@ -20,35 +23,79 @@ import (
 )
 
 const (
-	ApiVersionNoLocation = "UNDEFINED"
+	// suffix of the tag (appended to tag target) containing the expiry time before the first extension
+	ExpiryOriginalTagSuffix = "_original"
+
+	// suffix of the tag (appended to extend tag) an invalid extension is moved to
+	ExpiryInvalidTagSuffix = "_invalid"
 )
 
 type (
 	Janitor struct {
-		apiVersionMap map[string]map[string]string
-
-		Conf  config.Opts
-		Azure JanitorAzureConfig
+		// apiVersions is set by Init, might be read concurrently by the debug endpoint
+		apiVersions atomic.Pointer[apiVersionCache]
+
+		plan          *Plan
+		lastPlan      *Plan
+		runStatus     *RunStatus
+		lastRunStatus *RunStatus
+		planLock      sync.RWMutex
+
+		deletionSlots        chan struct{}
+		pendingDeletions     map[string]struct{}
+		pendingDeletionsLock sync.Mutex
+		pendingDeletionsWg   sync.WaitGroup
+
+		notifier        *notifier
+		auditSinks      []AuditSink
+		managementLocks *managementLockCache
+		firstSeen       firstSeenCache
+		subscriptions   []*armsubscriptions.Subscription
+		discovery       *discoverySnapshot
+
+		// processedRoleAssignments contains the roleAssignments processed in the current run
+		processedRoleAssignments *roleAssignmentSet
+
+		resourceFilter      *ListFilter
+		resourceGroupFilter *ListFilter
+		resourceSelector    *ResourceSelector
+
+		Conf   config.Opts
+		Policy *config.Policy
+		Azure  JanitorAzureConfig
 
 		Logger *slogger.Logger
 
 		UserAgent string
 
 		Prometheus struct {
-			MetricDuration           *prometheus.GaugeVec
-			MetricDeployment         *prometheus.GaugeVec
-			MetricTtlResources       *prometheus.GaugeVec
-			MetricTtlRoleAssignments *prometheus.GaugeVec
-			MetricDeletedResource    *prometheus.CounterVec
-			MetricErrors             *prometheus.CounterVec
+			MetricDuration                *prometheus.GaugeVec
+			MetricDeployment              *prometheus.GaugeVec
+			MetricDeploymentState         *prometheus.GaugeVec
+			MetricTtlResources            *prometheus.GaugeVec
+			MetricTtlRoleAssignments      *prometheus.GaugeVec
+			MetricOrphanedRoleAssignments *prometheus.GaugeVec
+			MetricDeletedResource         *prometheus.CounterVec
+			MetricDeleteFailed            *prometheus.CounterVec
+			MetricErrors                  *prometheus.CounterVec
+			MetricNotifications           *prometheus.CounterVec
+
+			Registerer prometheus.Registerer
 		}
 	}
 
 	JanitorAzureConfig struct {
-		Client                *armclient.ArmClient
-		Subscription          []string
-		SubscriptionsIterator *armclient.SubscriptionsIterator
-		ResourceTagManager    *armclient.ResourceTagManager
+		Client             *armclient.ArmClient
+		ClientProvider     AzureClientProvider
+		ResourceGraph      ResourceGraphClient
+		Principals         PrincipalClient
+		ResourceTagManager *armclient.ResourceTagManager
+
+		// subscription selection (all criteria must match, empty criteria match all visible subscriptions)
+		Subscription                []string
+		SubscriptionManagementGroup []string
+		SubscriptionTag             []string
+		SubscriptionName            *regexp.Regexp
 	}
 )
 
@@ -76,230 +123,349 @@ var (
 )
 
 func (j *Janitor) Init() {
-	// init subscription iterator
-	j.Azure.SubscriptionsIterator = armclient.NewSubscriptionIterator(j.Azure.Client, j.Conf.Azure.Subscription...)
+	// use ArmClient as default client provider
+	if j.Azure.ClientProvider == nil {
+		j.Azure.ClientProvider = j.Azure.Client
+	}
 
+	j.initConcurrency()
+	j.initPolicy()
+	j.initFilters()
+	j.initDiscovery()
+	j.initPrincipals()
+	j.initNotifications()
+	j.initAudit()
 	j.initPrometheus()
 	j.initAzureApiVersions()
 }
 
-func (j *Janitor) Run() {
-	ctx := context.Background()
-
-	go func() {
-		for {
-			runLogger := j.Logger
+func (j *Janitor) initConcurrency() {
+	// sanity checks, at least one of each
+	j.Conf.Janitor.Concurrency.Subscriptions = max(j.Conf.Janitor.Concurrency.Subscriptions, 1)
+	j.Conf.Janitor.Concurrency.Tasks = max(j.Conf.Janitor.Concurrency.Tasks, 1)
+	j.Conf.Janitor.Concurrency.Deletions = max(j.Conf.Janitor.Concurrency.Deletions, 1)
 
-			startTime := time.Now()
-			runLogger.Infof("start janitor run")
+	j.deletionSlots = make(chan struct{}, j.Conf.Janitor.Concurrency.Deletions)
+	j.pendingDeletions = map[string]struct{}{}
+}
 
-			callbackFuncs := make(chan func())
+func (j *Janitor) initPolicy() {
+	// use janitor flags as implicit policy
+	if j.Policy == nil {
+		j.Policy = config.NewImplicitPolicy(j.Conf.Janitor.Tag, j.Conf.Janitor.TagTarget)
+	} else if j.Conf.Janitor.Deployments.Enable || j.Conf.Janitor.RoleAssignments.Enable {
+		// policy rules only cover resources and resourceGroups
+		j.Logger.Info("policy file is not applied to deployments and roleAssignments, these are configured by flags only")
+	}
 
-			// subscription processing
-			go func() {
-				err := j.Azure.SubscriptionsIterator.ForEach(runLogger.Logger, func(subscription *armsubscriptions.Subscription, logger *slog.Logger) {
-					contextLogger := runLogger.With(
-						slog.String("subscriptionID", to.String(subscription.SubscriptionID)),
-						slog.String("subscriptionName", to.String(subscription.DisplayName)),
-					)
-
-					if j.Conf.Janitor.Deployments.Enable {
-						j.runDeployments(ctx, contextLogger, subscription, callbackFuncs)
-					}
-
-					if j.Conf.Janitor.Resources.Enable {
-						j.runResources(ctx, contextLogger, subscription, j.Conf.Janitor.Resources.Filter, callbackFuncs)
-					}
-
-					if j.Conf.Janitor.RoleAssignments.Enable {
-						j.runRoleAssignments(ctx, contextLogger, subscription, j.Conf.Janitor.RoleAssignments.Filter, callbackFuncs)
-					}
-
-					if j.Conf.Janitor.ResourceGroups.Enable {
-						j.runResourceGroups(ctx, contextLogger, subscription, j.Conf.Janitor.ResourceGroups.Filter, callbackFuncs)
-					}
-				})
-				if err != nil {
-					panic(err)
+	for _, rule := range j.Policy.Rules {
+		for name, value := range map[string]string{"defaultTtl": rule.DefaultTtl, "maxAge": rule.MaxAge, "maxIdle": rule.MaxIdle} {
+			if value != "" {
+				if duration, err := j.parseExpiryDuration(value); err != nil {
+					j.Logger.Fatalf(`rule "%s": invalid %s: %v`, rule.Name, name, err.Error())
+				} else if duration == nil {
+					j.Logger.Fatalf(`rule "%s": invalid %s: empty duration`, rule.Name, name)
 				}
+			}
+		}
+	}
+}
 
-				close(callbackFuncs)
-			}()
+// initFilters builds and checks the filters for resource and resourceGroup listings and the resource selector
+func (j *Janitor) initFilters() {
+	var err error
+
+	j.resourceFilter, err = NewListFilter(
+		PlanKindResource,
+		to.String(j.Conf.Janitor.Resources.AdditionalFilter),
+		j.Conf.Janitor.Resources.FilterTag,
+		j.Conf.Janitor.Resources.FilterResourceType,
+		j.Conf.Janitor.Resources.FilterLocation,
+	)
+	if err != nil {
+		j.Logger.Fatalf(`invalid resources filter: %v`, err.Error())
+	}
 
-			// store metriclists from channel
-			callbackFuncList := []func(){}
-			for callbackFunc := range callbackFuncs {
-				if callbackFunc != nil {
-					callbackFuncList = append(callbackFuncList, callbackFunc)
-				}
-			}
+	j.resourceGroupFilter, err = NewListFilter(
+		PlanKindResourceGroup,
+		to.String(j.Conf.Janitor.ResourceGroups.AdditionalFilter),
+		j.Conf.Janitor.ResourceGroups.FilterTag,
+		nil,
+		j.Conf.Janitor.ResourceGroups.FilterLocation,
+	)
+	if err != nil {
+		j.Logger.Fatalf(`invalid resourceGroups filter: %v`, err.Error())
+	}
 
-			// after channel is closed: reset metric and set them to the new state
-			j.Prometheus.MetricDeployment.Reset()
-			j.Prometheus.MetricTtlResources.Reset()
-			j.Prometheus.MetricTtlRoleAssignments.Reset()
+	j.resourceSelector, err = ParseResourceSelector(j.Conf.Janitor.Resources.Selector)
+	if err != nil {
+		j.Logger.Fatalf(`invalid resources selector: %v`, err.Error())
+	}
 
-			for _, callbackFunc := range callbackFuncList {
-				callbackFunc()
-			}
+	if j.resourceFilter != nil {
+		j.Logger.Infof(`using resources filter "%s"`, j.resourceFilter.String())
+	}
+	if j.resourceSelector != nil {
+		j.Logger.Infof(`using resources selector "%s"`, j.resourceSelector.String())
+	}
+	if j.resourceGroupFilter != nil {
+		j.Logger.Infof(`using resourceGroups filter "%s"`, j.resourceGroupFilter.String())
+	}
+}
 
-			duration := time.Since(startTime)
-			j.Prometheus.MetricDuration.With(prometheus.Labels{}).Set(duration.Seconds())
+func (j *Janitor) Run() {
+	ctx := context.Background()
 
-			runLogger.With(
-				slog.Duration("duration", duration),
-				slog.Time("nextRun", time.Now().Add(j.Conf.Janitor.Interval)),
-			).Info("finished run")
+	go func() {
+		for {
+			j.runJanitor(ctx, j.Logger)
 			time.Sleep(j.Conf.Janitor.Interval)
 		}
 	}()
 }
 
-func (j *Janitor) initAzureApiVersions() {
-	ctx := context.Background()
+// runJanitor executes one janitor run for all subscriptions and updates the metrics afterwards
+func (j *Janitor) runJanitor(ctx context.Context, runLogger *slogger.Logger) {
+	startTime := time.Now()
+	runLogger.Infof("start janitor run")
 
-	j.apiVersionMap = map[string]map[string]string{}
+	j.plan = NewPlan(j.Conf.DryRun)
+	j.runStatus = NewRunStatus()
+	j.managementLocks = newManagementLockCache()
+	j.processedRoleAssignments = newRoleAssignmentSet()
 
-	err := j.Azure.SubscriptionsIterator.ForEach(j.Logger.Slog(), func(subscription *armsubscriptions.Subscription, logger *slog.Logger) {
-		subscriptionId := to.String(subscription.SubscriptionID)
+	callbackFuncs := make(chan func())
 
-		j.Logger.With(slog.String("subscriptionID", subscriptionId)).Infof(`fetch Azure available api-versions`)
+	// subscriptions are resolved on every run, subscriptions of the previous run are used on failure
+	if err := j.updateSubscriptions(ctx, runLogger); err != nil {
+		j.recordRunError(runLogger, "", "subscriptions", "Microsoft.Resources/subscriptions", err)
+	}
+	j.updateAzureApiVersions(ctx, runLogger)
 
-		// fetch location translation map
-		subscriptionClient, err := armsubscriptions.NewClient(j.Azure.Client.GetCred(), j.Azure.Client.NewArmClientOptions())
+	// subscription processing
+	go func() {
+		// discovery via Resource Graph (if enabled), list APIs are used as fallback
+		discovery, err := j.runDiscovery(ctx, runLogger)
 		if err != nil {
-			panic(err)
+			j.recordRunError(runLogger, "", "discovery", "Microsoft.ResourceGraph/resources", err)
+			runLogger.Warnf("discovery via Azure Resource Graph failed, falling back to Azure list APIs")
 		}
+		j.discovery = discovery
 
-		locationPager := subscriptionClient.NewListLocationsPager(*subscription.SubscriptionID, nil)
-		locationMap := map[string]string{}
-		for locationPager.More() {
-			result, err := locationPager.NextPage(ctx)
-			if err != nil {
-				panic(err)
-			}
+		// management group scopes first, their roleAssignments are inherited by the subscriptions
+		if j.Conf.Janitor.RoleAssignments.Enable || j.Conf.Janitor.RoleAssignmentsOrphaned.Enable {
+			j.runScopeRoleAssignments(ctx, runLogger, callbackFuncs)
+		}
 
-			for _, location := range result.Value {
-				locationDisplayName := to.String(location.DisplayName)
-				locationName := to.String(location.Name)
-				locationMap[locationDisplayName] = locationName
-			}
+		subscriptionWg := sizedwaitgroup.New(j.Conf.Janitor.Concurrency.Subscriptions)
+		j.forEachSubscription(func(subscription *armsubscriptions.Subscription) {
+			subscriptionWg.Add()
+			go func() {
+				defer subscriptionWg.Done()
+				j.runSubscription(ctx, runLogger, subscription, callbackFuncs)
+			}()
+		})
+		subscriptionWg.Wait()
+
+		if j.Conf.Janitor.Deployments.Enable {
+			j.runScopeDeployments(ctx, runLogger, callbackFuncs)
 		}
 
-		providersClient, err := armresources.NewProvidersClient(*subscription.SubscriptionID, j.Azure.Client.GetCred(), j.Azure.Client.NewArmClientOptions())
-		if err != nil {
-			panic(err)
+		close(callbackFuncs)
+	}()
+
+	// store metriclists from channel
+	callbackFuncList := []func(){}
+	for callbackFunc := range callbackFuncs {
+		if callbackFunc != nil {
+			callbackFuncList = append(callbackFuncList, callbackFunc)
 		}
+	}
 
-		providerPager := providersClient.NewListPager(nil)
-		j.apiVersionMap[subscriptionId] = map[string]string{}
-		for providerPager.More() {
-			result, err := providerPager.NextPage(ctx)
-			if err != nil {
-				panic(err)
-			}
+	// after channel is closed: reset metric and set them to the new state
+	j.Prometheus.MetricDeployment.Reset()
+	j.Prometheus.MetricDeploymentState.Reset()
+	j.Prometheus.MetricTtlResources.Reset()
+	j.Prometheus.MetricTtlRoleAssignments.Reset()
+	j.Prometheus.MetricOrphanedRoleAssignments.Reset()
 
-			for _, provider := range result.Value {
-				if provider.ResourceTypes == nil {
-					continue
-				}
+	for _, callbackFunc := range callbackFuncList {
+		callbackFunc()
+	}
 
-				for _, resourceType := range provider.ResourceTypes {
-					if resourceType.APIVersions == nil {
-						continue
-					}
-
-					resourceTypeName := fmt.Sprintf(
-						"%s/%s",
-						strings.ToLower(*provider.Namespace),
-						strings.ToLower(*resourceType.ResourceType),
-					)
-
-					// select best last apiversion
-					lastApiVersion := ""
-					lastApiPreviewVersion := ""
-					providerApiVersion := ""
-					for _, val := range resourceType.APIVersions {
-						if val == nil {
-							continue
-						}
-
-						apiVersion := to.String(val)
-						if strings.Contains(apiVersion, "-preview") {
-							if lastApiVersion == "" || lastApiPreviewVersion > apiVersion {
-								lastApiPreviewVersion = apiVersion
-							}
-						} else {
-							if lastApiVersion == "" || lastApiVersion > apiVersion {
-								lastApiVersion = apiVersion
-							}
-						}
-					}
-
-					// choose best apiversion
-					if lastApiVersion != "" {
-						providerApiVersion = lastApiVersion
-					} else if lastApiPreviewVersion != "" {
-						providerApiVersion = lastApiPreviewVersion
-					}
-
-					// add all locations (if available)
-					for _, val := range resourceType.Locations {
-						if val == nil {
-							continue
-						}
-						location := to.String(val)
-
-						// try to translate location to internal type
-						if val, ok := locationMap[location]; ok {
-							location = val
-						}
-
-						key := strings.ToLower(fmt.Sprintf("%s::%s", location, resourceTypeName))
-						j.apiVersionMap[subscriptionId][key] = providerApiVersion
-					}
-
-					// add no location fallback
-					key := strings.ToLower(fmt.Sprintf("%s::%s", ApiVersionNoLocation, resourceTypeName))
-					j.apiVersionMap[subscriptionId][key] = providerApiVersion
+	j.sendNotifications(ctx, runLogger)
+	j.publishPlan(runLogger)
+	j.publishRunStatus(runLogger)
+	j.firstSeen.finishRun(j.runStatus.FailureCount() == 0)
 
-				}
+	duration := time.Since(startTime)
+	j.Prometheus.MetricDuration.With(prometheus.Labels{}).Set(duration.Seconds())
+
+	runLogger.With(
+		slog.Duration("duration", duration),
+		slog.Time("nextRun", time.Now().Add(j.Conf.Janitor.Interval)),
+	).Info("finished run")
+}
+
+// runSubscription executes all enabled janitor tasks for one subscription
+func (j *Janitor) runSubscription(ctx context.Context, runLogger *slogger.Logger, subscription *armsubscriptions.Subscription, callbackFuncs chan<- func()) {
+	subscriptionId := to.String(subscription.SubscriptionID)
+	contextLogger := runLogger.With(
+		slog.String("subscriptionID", subscriptionId),
+		slog.String("subscriptionName", to.String(subscription.DisplayName)),
+	)
+
+	tasks := []struct {
+		name         string
+		resourceType string
+		enabled      bool
+		run          func() error
+	}{
+		{
+			name:         PlanKindDeployment,
+			resourceType: "Microsoft.Resources/deployments",
+			enabled:      j.Conf.Janitor.Deployments.Enable,
+			run: func() error {
+				return j.runDeployments(ctx, contextLogger, subscription, callbackFuncs)
+			},
+		},
+		{
+			name:         PlanKindResource,
+			resourceType: "Microsoft.Resources/resources",
+			enabled:      j.Conf.Janitor.Resources.Enable,
+			run: func() error {
+				return j.runResources(ctx, contextLogger, subscription, j.resourceFilter, callbackFuncs)
+			},
+		},
+		{
+			name:         PlanKindRoleAssignment,
+			resourceType: "Microsoft.Authorization/roleAssignments",
+			enabled:      j.Conf.Janitor.RoleAssignments.Enable || j.Conf.Janitor.RoleAssignmentsOrphaned.Enable,
+			run: func() error {
+				return j.runRoleAssignments(ctx, contextLogger, subscription, j.Conf.Janitor.RoleAssignments.Filter, callbackFuncs)
+			},
+		},
+		{
+			name:         PlanKindResourceGroup,
+			resourceType: "Microsoft.Resources/resourceGroups",
+			enabled:      j.Conf.Janitor.ResourceGroups.Enable,
+			run: func() error {
+				return j.runResourceGroups(ctx, contextLogger, subscription, j.resourceGroupFilter, callbackFuncs)
+			},
+		},
+	}
+
+	taskWg := sizedwaitgroup.New(j.Conf.Janitor.Concurrency.Tasks)
+	for _, task := range tasks {
+		if !task.enabled {
+			continue
+		}
+
+		taskWg.Add()
+		go func() {
+			defer taskWg.Done()
+			if err := task.run(); err != nil {
+				j.recordRunError(contextLogger, subscriptionId, task.name, task.resourceType, err)
 			}
+		}()
+	}
+	taskWg.Wait()
+}
+
+// publishPlan finishes the plan of the current run, makes it available via GetPlan and writes it to the plan file (if set)
+func (j *Janitor) publishPlan(logger *slogger.Logger) {
+	plan := j.plan
+	plan.Finish()
+
+	j.planLock.Lock()
+	j.lastPlan = plan
+	j.planLock.Unlock()
+
+	if j.Conf.Janitor.Plan.File != "" {
+		if err := plan.WriteFile(j.Conf.Janitor.Plan.File); err != nil {
+			logger.Errorf(`unable to write plan to "%s": %v`, j.Conf.Janitor.Plan.File, err.Error())
 		}
-	})
-	if err != nil {
-		panic(err)
 	}
+
+	logger.Infof(
+		"plan contains %v deletions, %v tag updates and %v protected resources",
+		len(plan.ItemsByAction(PlanActionDelete)),
+		len(plan.ItemsByAction(PlanActionUpdateTags)),
+		len(plan.ItemsByAction(PlanActionProtected)),
+	)
 }
 
-func (j *Janitor) getAzureApiVersionForResourceType(subscriptionId, location, resourceType string) (apiVersion string) {
-	locationKey := strings.ToLower(fmt.Sprintf("%s::%s", location, resourceType))
-	unknownKey := strings.ToLower(fmt.Sprintf("%s::%s", ApiVersionNoLocation, resourceType))
-	if val, ok := j.apiVersionMap[subscriptionId][locationKey]; ok {
-		// location based apiVersion
-		apiVersion = val
-	} else if val, ok := j.apiVersionMap[subscriptionId][unknownKey]; ok {
-		// unknown location based apiVersion
-		apiVersion = val
+// publishRunStatus finishes the status of the current run and makes it available via GetRunStatus
+func (j *Janitor) publishRunStatus(logger *slogger.Logger) {
+	status := j.runStatus
+	status.Finish()
+
+	j.planLock.Lock()
+	j.lastRunStatus = status
+	j.planLock.Unlock()
+
+	if failureCount := status.FailureCount(); failureCount > 0 {
+		logger.Warnf("run finished with %v failed subscriptions or tasks", failureCount)
 	}
-	return
 }
 
-func (j *Janitor) checkAzureResourceExpiry(logger *slogger.Logger, resourceType, resourceId string, resourceTags *map[string]*string) (resourceExpireTime *time.Time, resourceExpired bool, resourceTagRewriteNeeded bool) {
-	ttlValue := j.getTtlTagFromAzureResource(*resourceTags)
+// GetRunStatus returns the status of the last finished janitor run (nil if no run has finished yet)
+func (j *Janitor) GetRunStatus() *RunStatus {
+	j.planLock.RLock()
+	defer j.planLock.RUnlock()
+	return j.lastRunStatus
+}
 
-	if ttlValue != nil {
+// GetPlan returns the plan of the last finished janitor run (nil if no run has finished yet)
+func (j *Janitor) GetPlan() *Plan {
+	j.planLock.RLock()
+	defer j.planLock.RUnlock()
+	return j.lastPlan
+}
+
+// forEachSubscription loops over the subscriptions of the current run, ordered by subscription id
+func (j *Janitor) forEachSubscription(callback func(subscription *armsubscriptions.Subscription)) {
+	for _, subscription := range j.subscriptions {
+		callback(subscription)
+	}
+}
+
+func (j *Janitor) checkAzureResourceExpiry(logger *slogger.Logger, rule *config.PolicyRule, resourceType, resourceId string, resourceCreatedTime *time.Time, resourceTags *map[string]*string) (resourceExpireTime *time.Time, resourceExpired bool, resourceTagRewriteNeeded bool) {
+	ttlValue := j.getTtlTagFromAzureResource(rule, *resourceTags)
+
+	if ttlValue == nil && rule.DefaultTtl != "" {
+		// use default ttl of rule for resources without ttl tag (based on creation or first seen time)
+		if duration, err := j.parseExpiryDuration(rule.DefaultTtl); err == nil && duration != nil {
+			baseTime, baseTimeSource := j.defaultTtlBaseTime(resourceId, resourceCreatedTime)
+			expiryTime := baseTime.Add(*duration)
+			logger.Infof("no ttl tag found, using default ttl %v based on %s (%v)", rule.DefaultTtl, baseTimeSource, baseTime.Format(time.RFC3339))
+
+			// the computed expiry time is only written as tag, deletion happens in a later run after the grace period
+			// (old untagged resources are not deleted without notice)
+			if minExpiryTime := time.Now().Add(j.Conf.Janitor.DefaultTtl.Grace).Truncate(time.Second); expiryTime.Before(minExpiryTime) {
+				logger.Infof("default expiry time %v already passed, using grace period of %v", expiryTime.Format(time.RFC3339), j.Conf.Janitor.DefaultTtl.Grace)
+				expiryTime = minExpiryTime
+			}
+
+			ttlValue := expiryTime.Format(time.RFC3339)
+			(*resourceTags)[rule.TagTarget] = &ttlValue
+			deleteTag(*resourceTags, rule.TagTarget+ExpiryOriginalTagSuffix)
+
+			resourceTagRewriteNeeded = true
+			resourceExpireTime = &expiryTime
+		} else if err != nil {
+			logger.Errorf("unable to parse default ttl: %v", err)
+		} else {
+			logger.Errorf("unable to parse default ttl: empty duration")
+		}
+	} else if ttlValue != nil {
 		logger.Debug("checking ttl")
 
 		tagValueParsed, tagValueExpired, timeParseErr := j.checkExpiryDate(*ttlValue)
 		if timeParseErr == nil {
 			// date parsed successfully
 			if tagValueExpired {
-				if j.Conf.DryRun {
-					logger.Infof("expired, but dryrun active")
-				} else {
-					resourceExpired = true
-				}
+				resourceExpired = true
 			} else {
 				logger.Debug("NOT expired")
 			}
@@ -309,7 +475,9 @@ func (j *Janitor) checkAzureResourceExpiry(logger *slogger.Logger, resourceType,
 			// try parse as duration
 			logger.Infof("found valid duration (%v)", *ttlValue)
 			ttlValue := val.Format(time.RFC3339)
-			(*resourceTags)[j.Conf.Janitor.TagTarget] = &ttlValue
+			(*resourceTags)[rule.TagTarget] = &ttlValue
+			// new expiry time, the total extension is based on it
+			deleteTag(*resourceTags, rule.TagTarget+ExpiryOriginalTagSuffix)
 
 			resourceTagRewriteNeeded = true
 			resourceExpireTime = val
@@ -318,12 +486,91 @@ func (j *Janitor) checkAzureResourceExpiry(logger *slogger.Logger, resourceType,
 		}
 	}
 
+	// apply extension (snooze) on top of the current expiry time
+	if resourceExpireTime != nil {
+		extendedTime, tagsChanged := j.applyExpiryExtension(logger, rule, resourceTags, *resourceExpireTime)
+		if tagsChanged {
+			resourceTagRewriteNeeded = true
+		}
+		if extendedTime != nil {
+			resourceExpireTime = extendedTime
+			resourceExpired = extendedTime.Before(time.Now())
+		}
+	}
+
 	return
 }
 
-func (j *Janitor) getTtlTagFromAzureResource(tags map[string]*string) *string {
+// applyExpiryExtension adds the duration of the extend tag to the expiry time, writes the new expiry time to
+// the target tag and removes the extend tag. The total extension is capped based on the original expiry time,
+// which is kept in an additional tag. Invalid extend tags are renamed (suffix _invalid) and not applied.
+// Returns the extended expiry time (nil if no valid extend tag is set) and if the tags have been changed.
+func (j *Janitor) applyExpiryExtension(logger *slogger.Logger, rule *config.PolicyRule, resourceTags *map[string]*string, expiryTime time.Time) (*time.Time, bool) {
+	if j.Conf.Janitor.TagExtend.Name == "" {
+		return nil, false
+	}
+
+	extendTagName, extendValue := findTag(*resourceTags, j.Conf.Janitor.TagExtend.Name)
+	if extendValue == nil || *extendValue == "" {
+		return nil, false
+	}
+
+	duration, err := j.parseExpiryDuration(*extendValue)
+	if err != nil || duration == nil {
+		// keep the value for the owner but don't try to parse it again on every run
+		invalidTagName := extendTagName + ExpiryInvalidTagSuffix
+		logger.Errorf("unable to parse ttl extension (%v), moving it to tag %s: %v", *extendValue, invalidTagName, err)
+		delete(*resourceTags, extendTagName)
+		(*resourceTags)[invalidTagName] = extendValue
+		return nil, true
+	}
+
+	originalTagName := rule.TagTarget + ExpiryOriginalTagSuffix
+	originalTime := expiryTime
+	if _, val := findTag(*resourceTags, originalTagName); val != nil {
+		if parsedTime, _, err := j.checkExpiryDate(*val); err == nil {
+			originalTime = *parsedTime
+		}
+	} else {
+		// first extension, remember original expiry time
+		(*resourceTags)[originalTagName] = to.StringPtr(originalTime.Format(time.RFC3339))
+	}
+
+	extendedTime := expiryTime.Add(*duration)
+	if maxExtension := j.Conf.Janitor.TagExtend.Max; maxExtension > 0 && extendedTime.After(originalTime.Add(maxExtension)) {
+		extendedTime = originalTime.Add(maxExtension)
+		logger.Warnf("ttl extension (%v) exceeds maximum extension of %v, capping expiry time", *extendValue, maxExtension)
+	}
+	logger.Infof("extending expiry time by %v to %v", *extendValue, extendedTime.Format(time.RFC3339))
+
+	delete(*resourceTags, extendTagName)
+	(*resourceTags)[rule.TagTarget] = to.StringPtr(extendedTime.Format(time.RFC3339))
+
+	return &extendedTime, true
+}
+
+// findTag returns the name (as set on the resource) and value of a tag, tag names are case insensitive
+func findTag(tags map[string]*string, name string) (string, *string) {
+	name = strings.ToLower(name)
+	for tagName, tagValue := range tags {
+		if strings.ToLower(tagName) == name {
+			return tagName, tagValue
+		}
+	}
+
+	return "", nil
+}
+
+// deleteTag removes a tag (case insensitive name)
+func deleteTag(tags map[string]*string, name string) {
+	if tagName, _ := findTag(tags, name); tagName != "" {
+		delete(tags, tagName)
+	}
+}
+
+func (j *Janitor) getTtlTagFromAzureResource(rule *config.PolicyRule, tags map[string]*string) *string {
 	// check target tag first
-	janitorTagTarget := strings.ToLower(j.Conf.Janitor.TagTarget)
+	janitorTagTarget := strings.ToLower(rule.TagTarget)
 	for tagName, tagValue := range tags {
 		if strings.ToLower(tagName) == janitorTagTarget && tagValue != nil && *tagValue != "" {
 			return tagValue
@@ -331,7 +578,7 @@ func (j *Janitor) getTtlTagFromAzureResource(tags map[string]*string) *string {
 	}
 
 	// check source tag last
-	janitorTag := strings.ToLower(j.Conf.Janitor.Tag)
+	janitorTag := strings.ToLower(rule.Tag)
 	for tagName, tagValue := range tags {
 		if strings.ToLower(tagName) == janitorTag && tagValue != nil && *tagValue != "" {
 			return tagValue
@@ -16,7 +16,11 @@ func buildJanitorObj() *Janitor {
 	opts := config.Opts{}
 	opts.Janitor.Tag = "ttl"
 	opts.Janitor.TagTarget = "ttl_expiry"
+	opts.Janitor.TagExtend.Name = "ttl_extend"
+	opts.Janitor.TagExtend.Max = 7 * 24 * time.Hour
+	opts.Janitor.DefaultTtl.Grace = 24 * time.Hour
 	j := Janitor{Conf: opts}
+	j.Policy = config.NewImplicitPolicy(opts.Janitor.Tag, opts.Janitor.TagTarget)
 
 	return &j
 }
@@ -66,8 +70,10 @@ func TestResourceGroupExpiry(t *testing.T) {
 
 	resourceExpireTime, resourceExpired, resourceTagRewriteNeeded = j.checkAzureResourceExpiry(
 		contextLogger,
+		j.Policy.Rules[0],
 		"resourceGroup",
 		"no-ttl-tag",
+		nil,
 		&map[string]*string{
 			"foobar": to.StringPtr("barfoo"),
 		},
@@ -78,8 +84,10 @@ func TestResourceGroupExpiry(t *testing.T) {
 
 	resourceExpireTime, resourceExpired, resourceTagRewriteNeeded = j.checkAzureResourceExpiry(
 		contextLogger,
+		j.Policy.Rules[0],
 		"resourceGroup",
 		"absolute-time-ttl-tag-already-expired",
+		nil,
 		&map[string]*string{
 			"foobar": to.StringPtr("barfoo"),
 			"ttl":    to.StringPtr(time.Now().Add(-10 * time.Minute).Format(time.RFC3339)),
@@ -91,8 +99,10 @@ func TestResourceGroupExpiry(t *testing.T) {
 
 	resourceExpireTime, resourceExpired, resourceTagRewriteNeeded = j.checkAzureResourceExpiry(
 		contextLogger,
+		j.Policy.Rules[0],
 		"resourceGroup",
 		"absolute-time-ttl-tag-not-expired",
+		nil,
 		&map[string]*string{
 			"foobar": to.StringPtr("barfoo"),
 			"ttl":    to.StringPtr(time.Now().Add(10 * time.Minute).Format(time.RFC3339)),
@@ -104,8 +114,10 @@ func TestResourceGroupExpiry(t *testing.T) {
 
 	resourceExpireTime, resourceExpired, resourceTagRewriteNeeded = j.checkAzureResourceExpiry(
 		contextLogger,
+		j.Policy.Rules[0],
 		"resourceGroup",
 		"relative-time-ttl-tag-not-expired",
+		nil,
 		&map[string]*string{
 			"foobar": to.StringPtr("barfoo"),
 			"ttl":    to.StringPtr("5d"),
@@ -116,6 +128,168 @@ func TestResourceGroupExpiry(t *testing.T) {
 	assumeState(t, `resource tag rewrite needed`, true, resourceTagRewriteNeeded)
 }
 
+func TestResourceExpiryExtension(t *testing.T) {
+	contextLogger := buildTestLogger()
+
+	j := buildJanitorObj()
+
+	expiryTime := time.Now().Add(-10 * time.Minute).Truncate(time.Second)
+	tags := map[string]*string{
+		"ttl":        to.StringPtr(expiryTime.Format(time.RFC3339)),
+		"TTL_Extend": to.StringPtr("2d"),
+	}
+	resourceExpireTime, resourceExpired, resourceTagRewriteNeeded := j.checkAzureResourceExpiry(contextLogger, j.Policy.Rules[0], "resourceGroup", "expired-with-extension", nil, &tags)
+	assumeNotNil(t, "calculated expiry time", resourceExpireTime)
+	assumeState(t, `resource expired`, false, resourceExpired)
+	assumeState(t, `resource tag rewrite needed`, true, resourceTagRewriteNeeded)
+	assumeDuration(t, "extension", 48*time.Hour, resourceExpireTime.Sub(expiryTime))
+
+	if _, exists := tags["TTL_Extend"]; exists {
+		t.Fatalf(`expected extend tag to be removed, got: %v`, to.StringMap(tags))
+	}
+	if val := to.String(tags["ttl_expiry"]); val != expiryTime.Add(48*time.Hour).Format(time.RFC3339) {
+		t.Fatalf(`expected extended expiry time in target tag, got: "%v"`, val)
+	}
+	if val := to.String(tags["ttl_expiry_original"]); val != expiryTime.Format(time.RFC3339) {
+		t.Fatalf(`expected original expiry time in original tag, got: "%v"`, val)
+	}
+
+	// second extension is capped (7d based on original expiry time)
+	tags["ttl_extend"] = to.StringPtr("P1W")
+	resourceExpireTime, resourceExpired, resourceTagRewriteNeeded = j.checkAzureResourceExpiry(contextLogger, j.Policy.Rules[0], "resourceGroup", "capped-extension", nil, &tags)
+	assumeNotNil(t, "calculated expiry time", resourceExpireTime)
+	assumeState(t, `resource expired`, false, resourceExpired)
+	assumeState(t, `resource tag rewrite needed`, true, resourceTagRewriteNeeded)
+	assumeDuration(t, "capped extension", 7*24*time.Hour, resourceExpireTime.Sub(expiryTime))
+
+	// invalid extension is not applied and moved to the invalid tag
+	tags["ttl_extend"] = to.StringPtr("later")
+	resourceExpireTime, _, resourceTagRewriteNeeded = j.checkAzureResourceExpiry(contextLogger, j.Policy.Rules[0], "resourceGroup", "invalid-extension", nil, &tags)
+	assumeNotNil(t, "calculated expiry time", resourceExpireTime)
+	assumeState(t, `resource tag rewrite needed`, true, resourceTagRewriteNeeded)
+	assumeDuration(t, "extension", 7*24*time.Hour, resourceExpireTime.Sub(expiryTime))
+	if _, exists := tags["ttl_extend"]; exists {
+		t.Fatalf(`expected invalid extend tag to be removed, got: %v`, to.StringMap(tags))
+	}
+	if val := to.String(tags["ttl_extend_invalid"]); val != "later" {
+		t.Fatalf(`expected invalid extension in invalid tag, got: "%v"`, val)
+	}
+
+	// invalid extension is not processed again
+	_, _, resourceTagRewriteNeeded = j.checkAzureResourceExpiry(contextLogger, j.Policy.Rules[0], "resourceGroup", "invalid-extension", nil, &tags)
+	assumeState(t, `resource tag rewrite needed after invalid extension`, false, resourceTagRewriteNeeded)
+
+	// reset of the ttl removes the original expiry time
+	tags = map[string]*string{
+		"ttl":                 to.StringPtr("5d"),
+		"ttl_expiry_original": to.StringPtr(expiryTime.Format(time.RFC3339)),
+	}
+	resourceExpireTime, _, resourceTagRewriteNeeded = j.checkAzureResourceExpiry(contextLogger, j.Policy.Rules[0], "resourceGroup", "reset-ttl", nil, &tags)
+	assumeNotNil(t, "calculated expiry time", resourceExpireTime)
+	assumeState(t, `resource tag rewrite needed after ttl reset`, true, resourceTagRewriteNeeded)
+	if _, exists := tags["ttl_expiry_original"]; exists {
+		t.Fatalf(`expected original tag to be removed after ttl reset, got: %v`, to.StringMap(tags))
+	}
+
+	// no expiry time, nothing to extend
+	resourceExpireTime, _, resourceTagRewriteNeeded = j.checkAzureResourceExpiry(contextLogger, j.Policy.Rules[0], "resourceGroup", "no-ttl-tag", nil, &map[string]*string{
+		"ttl_extend": to.StringPtr("2d"),
+	})
+	assumeNil(t, "calculated expiry time", resourceExpireTime)
+	assumeState(t, `resource tag rewrite needed`, false, resourceTagRewriteNeeded)
+}
+
+func TestResourceDefaultTtl(t *testing.T) {
+	contextLogger := buildTestLogger()
+
+	j := buildJanitorObj()
+	rule := &config.PolicyRule{
+		Name:       "sandbox",
+		Tag:        "ttl",
+		TagTarget:  "ttl_expiry",
+		DefaultTtl: "7d",
+		Action:     config.PolicyActionDelete,
+	}
+
+	// based on creation time
+	createdTime := time.Now().Add(-2 * 24 * time.Hour).Truncate(time.Second)
+	tags := map[string]*string{}
+	resourceExpireTime, resourceExpired, resourceTagRewriteNeeded := j.checkAzureResourceExpiry(contextLogger, rule, "resource", "created", &createdTime, &tags)
+	assumeNotNil(t, "calculated expiry time", resourceExpireTime)
+	assumeState(t, `resource expired`, false, resourceExpired)
+	assumeState(t, `resource tag rewrite needed`, true, resourceTagRewriteNeeded)
+	assumeDuration(t, "default ttl", 7*24*time.Hour, resourceExpireTime.Sub(createdTime))
+	if val := to.String(tags["ttl_expiry"]); val != createdTime.Add(7*24*time.Hour).Format(time.RFC3339) {
+		t.Fatalf(`expected default expiry time in target tag, got: "%v"`, val)
+	}
+
+	// old untagged resource is not expired in the first run, expiry time is set to the end of the grace period
+	oldCreatedTime := time.Now().Add(-30 * 24 * time.Hour)
+	oldTags := map[string]*string{}
+	resourceExpireTime, resourceExpired, resourceTagRewriteNeeded = j.checkAzureResourceExpiry(contextLogger, rule, "resource", "created-long-ago", &oldCreatedTime, &oldTags)
+	assumeNotNil(t, "calculated expiry time", resourceExpireTime)
+	assumeState(t, `old resource expired`, false, resourceExpired)
+	assumeState(t, `old resource tag rewrite needed`, true, resourceTagRewriteNeeded)
+	assumeDuration(t, "grace period", 24*time.Hour, resourceExpireTime.Sub(time.Now()).Round(time.Hour))
+
+	// written expiry time is used in the following runs
+	resourceExpireTime, resourceExpired, resourceTagRewriteNeeded = j.checkAzureResourceExpiry(contextLogger, rule, "resource", "created-long-ago", &oldCreatedTime, &oldTags)
+	assumeNotNil(t, "calculated expiry time", resourceExpireTime)
+	assumeState(t, `old resource expired in next run`, false, resourceExpired)
+	assumeState(t, `old resource tag rewrite needed in next run`, false, resourceTagRewriteNeeded)
+
+	// without grace period the resource is still only tagged in the first run
+	j.Conf.Janitor.DefaultTtl.Grace = 0
+	oldTags = map[string]*string{}
+	_, resourceExpired, _ = j.checkAzureResourceExpiry(contextLogger, rule, "resource", "created-long-ago", &oldCreatedTime, &oldTags)
+	assumeState(t, `old resource expired without grace period`, false, resourceExpired)
+	j.Conf.Janitor.DefaultTtl.Grace = 24 * time.Hour
+
+	// based on first seen time (stable across runs)
+	resourceExpireTime, resourceExpired, resourceTagRewriteNeeded = j.checkAzureResourceExpiry(contextLogger, rule, "resourceGroup", "first-seen", nil, &map[string]*string{})
+	assumeNotNil(t, "calculated expiry time", resourceExpireTime)
+	assumeState(t, `resource expired`, false, resourceExpired)
+	assumeState(t, `resource tag rewrite needed`, true, resourceTagRewriteNeeded)
+
+	firstExpireTime := *resourceExpireTime
+	resourceExpireTime, _, _ = j.checkAzureResourceExpiry(contextLogger, rule, "resourceGroup", "FIRST-SEEN", nil, &map[string]*string{})
+	assumeNotNil(t, "calculated expiry time", resourceExpireTime)
+	if !resourceExpireTime.Equal(firstExpireTime) {
+		t.Fatalf(`expected same expiry time for already seen resource, got: "%v" and "%v"`, firstExpireTime, resourceExpireTime)
+	}
+
+	// ttl tag wins over default ttl
+	resourceExpireTime, resourceExpired, resourceTagRewriteNeeded = j.checkAzureResourceExpiry(contextLogger, rule, "resource", "tagged", &createdTime, &map[string]*string{
+		"ttl": to.StringPtr(time.Now().Add(10 * time.Minute).Format(time.RFC3339)),
+	})
+	assumeNotNil(t, "calculated expiry time", resourceExpireTime)
+	assumeState(t, `resource expired`, false, resourceExpired)
+	assumeState(t, `resource tag rewrite needed`, false, resourceTagRewriteNeeded)
+}
+
+func TestFirstSeenCacheEviction(t *testing.T) {
+	cache := firstSeenCache{}
+	firstSeen := cache.get("kept")
+	cache.get("removed")
+	cache.finishRun(true)
+
+	// resources not seen in an incomplete run are kept
+	cache.get("kept")
+	cache.finishRun(false)
+	if _, exists := cache.times["removed"]; !exists {
+		t.Fatal(`expected first seen time to be kept after incomplete run`)
+	}
+
+	cache.get("kept")
+	cache.finishRun(true)
+	if _, exists := cache.times["removed"]; exists {
+		t.Fatal(`expected first seen time of resource not seen in complete run to be evicted`)
+	}
+	if val := cache.get("KEPT"); !val.Equal(firstSeen) {
+		t.Fatalf(`expected first seen time of seen resource to be kept, got: "%v" and "%v"`, firstSeen, val)
+	}
+}
+
 func assumeError(t *testing.T, message string, err error) {
 	t.Helper()
 	if err == nil {
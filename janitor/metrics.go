@@ -1,14 +1,22 @@
 package janitor
 
 import (
+	"context"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 func (j *Janitor) initPrometheus() {
-	var err error
-	j.Azure.ResourceTagManager, err = j.Azure.Client.TagManager.ParseTagConfig(j.Conf.Azure.ResourceTags)
-	if err != nil {
-		j.Logger.Fatal(`unable to parse resourceTag configuration "%s": %v"`, j.Conf.Azure.ResourceTags, err.Error())
+	if j.Azure.ResourceTagManager == nil {
+		var err error
+		j.Azure.ResourceTagManager, err = j.Azure.Client.TagManager.ParseTagConfig(j.Conf.Azure.ResourceTags)
+		if err != nil {
+			j.Logger.Fatal(`unable to parse resourceTag configuration "%s": %v"`, j.Conf.Azure.ResourceTags, err.Error())
+		}
+	}
+
+	if j.Prometheus.Registerer == nil {
+		j.Prometheus.Registerer = prometheus.DefaultRegisterer
 	}
 
 	j.Prometheus.MetricDuration = prometheus.NewGaugeVec(
@@ -18,7 +26,7 @@ func (j *Janitor) initPrometheus() {
 		},
 		[]string{},
 	)
-	prometheus.MustRegister(j.Prometheus.MetricDuration)
+	j.Prometheus.Registerer.MustRegister(j.Prometheus.MetricDuration)
 
 	j.Prometheus.MetricDeployment = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -30,7 +38,21 @@ func (j *Janitor) initPrometheus() {
 			"resourceGroup",
 		},
 	)
-	prometheus.MustRegister(j.Prometheus.MetricDeployment)
+	j.Prometheus.Registerer.MustRegister(j.Prometheus.MetricDeployment)
+
+	j.Prometheus.MetricDeploymentState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azurejanitor_deployment_state",
+			Help: "AzureJanitor count of deployments on scope by state (remaining or would be deleted in dry run)",
+		},
+		[]string{
+			"subscriptionID",
+			"managementGroup",
+			"resourceGroup",
+			"state",
+		},
+	)
+	j.Prometheus.Registerer.MustRegister(j.Prometheus.MetricDeploymentState)
 
 	j.Prometheus.MetricTtlResources = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -46,7 +68,7 @@ func (j *Janitor) initPrometheus() {
 			},
 		),
 	)
-	prometheus.MustRegister(j.Prometheus.MetricTtlResources)
+	j.Prometheus.Registerer.MustRegister(j.Prometheus.MetricTtlResources)
 
 	j.Prometheus.MetricTtlRoleAssignments = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -63,7 +85,24 @@ func (j *Janitor) initPrometheus() {
 			"resourceGroup",
 		},
 	)
-	prometheus.MustRegister(j.Prometheus.MetricTtlRoleAssignments)
+	j.Prometheus.Registerer.MustRegister(j.Prometheus.MetricTtlRoleAssignments)
+
+	j.Prometheus.MetricOrphanedRoleAssignments = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azurejanitor_roleassignment_orphaned",
+			Help: "AzureJanitor roleassignments whose principal does not exist anymore",
+		},
+		[]string{
+			"roleAssignmentId",
+			"scope",
+			"principalId",
+			"principalType",
+			"roleDefinitionId",
+			"subscriptionID",
+			"resourceGroup",
+		},
+	)
+	j.Prometheus.Registerer.MustRegister(j.Prometheus.MetricOrphanedRoleAssignments)
 
 	j.Prometheus.MetricDeletedResource = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -75,7 +114,20 @@ func (j *Janitor) initPrometheus() {
 			"resourceType",
 		},
 	)
-	prometheus.MustRegister(j.Prometheus.MetricDeletedResource)
+	j.Prometheus.Registerer.MustRegister(j.Prometheus.MetricDeletedResource)
+
+	j.Prometheus.MetricDeleteFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azurejanitor_resource_delete_failed_count",
+			Help: "AzureJanitor failed or timed out delete operations",
+		},
+		[]string{
+			"subscriptionID",
+			"resourceType",
+			"reason",
+		},
+	)
+	j.Prometheus.Registerer.MustRegister(j.Prometheus.MetricDeleteFailed)
 
 	j.Prometheus.MetricErrors = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -87,5 +139,26 @@ func (j *Janitor) initPrometheus() {
 			"resourceType",
 		},
 	)
-	prometheus.MustRegister(j.Prometheus.MetricErrors)
+	j.Prometheus.Registerer.MustRegister(j.Prometheus.MetricErrors)
+
+	j.Prometheus.MetricNotifications = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "azurejanitor_notification_count",
+			Help: "AzureJanitor sent expiry notifications",
+		},
+		[]string{
+			"backend",
+			"result",
+		},
+	)
+	j.Prometheus.Registerer.MustRegister(j.Prometheus.MetricNotifications)
+}
+
+// addResourceTagsToPrometheusLabels adds the configured resource tags as labels (no lookup if no tags are configured)
+func (j *Janitor) addResourceTagsToPrometheusLabels(ctx context.Context, labels prometheus.Labels, resourceID string) prometheus.Labels {
+	if len(j.Azure.ResourceTagManager.Tags) == 0 {
+		return labels
+	}
+
+	return j.Azure.ResourceTagManager.AddResourceTagsToPrometheusLabels(ctx, labels, resourceID)
 }
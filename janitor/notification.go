@@ -0,0 +1,351 @@
+package janitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/webdevops/go-common/log/slogger"
+)
+
+const (
+	NotificationFormatWebhook = "webhook"
+	NotificationFormatSlack   = "slack"
+	NotificationFormatTeams   = "teams"
+)
+
+type (
+	// ExpiryWarning is sent when a resource will expire (and be deleted) within a notification window
+	ExpiryWarning struct {
+		ResourceID     string    `json:"resourceId"`
+		Kind           string    `json:"kind"`
+		SubscriptionID string    `json:"subscriptionId"`
+		Rule           string    `json:"rule,omitempty"`
+		Owner          string    `json:"owner,omitempty"`
+		ExpiryTime     time.Time `json:"expiryTime"`
+		Window         string    `json:"window"`
+
+		window time.Duration
+	}
+
+	// NotificationSender sends expiry warnings to one backend
+	NotificationSender interface {
+		Name() string
+		Send(ctx context.Context, warning ExpiryWarning) error
+	}
+
+	// webhookNotificationSender posts expiry warnings as json (generic webhook, Slack or Teams payload)
+	webhookNotificationSender struct {
+		format string
+		url    string
+		client *http.Client
+	}
+
+	// notifier collects the expiry warnings of one run and remembers already sent warnings
+	notifier struct {
+		senders []NotificationSender
+		windows []time.Duration
+
+		warnings []ExpiryWarning
+
+		// sent contains all sent warnings (key: sender, resource, window and expiry) with expiry time
+		sent      map[string]time.Time
+		stateFile string
+
+		lock sync.Mutex
+	}
+)
+
+func (j *Janitor) initNotifications() {
+	j.notifier = &notifier{
+		windows:   append([]time.Duration{}, j.Conf.Janitor.Notification.Window...),
+		sent:      map[string]time.Time{},
+		stateFile: j.Conf.Janitor.Notification.StateFile,
+	}
+
+	// smallest window first
+	sort.Slice(j.notifier.windows, func(a, b int) bool {
+		return j.notifier.windows[a] < j.notifier.windows[b]
+	})
+
+	httpClient := &http.Client{Timeout: j.Conf.Janitor.Notification.Timeout}
+	for format, url := range map[string]string{
+		NotificationFormatWebhook: j.Conf.Janitor.Notification.Webhook,
+		NotificationFormatSlack:   j.Conf.Janitor.Notification.Slack,
+		NotificationFormatTeams:   j.Conf.Janitor.Notification.Teams,
+	} {
+		if url != "" {
+			j.notifier.senders = append(j.notifier.senders, &webhookNotificationSender{format: format, url: url, client: httpClient})
+		}
+	}
+	sort.Slice(j.notifier.senders, func(a, b int) bool {
+		return j.notifier.senders[a].Name() < j.notifier.senders[b].Name()
+	})
+
+	if err := j.notifier.loadState(); err != nil {
+		j.Logger.Warnf(`unable to load notification state from "%s": %v`, j.notifier.stateFile, err.Error())
+	}
+}
+
+// addExpiryWarning queues an expiry warning if the resource expires within one of the notification windows,
+// the owner is taken from the configured owner tag
+func (j *Janitor) addExpiryWarning(warning ExpiryWarning, tags map[string]*string) {
+	if !j.notifier.enabled() {
+		return
+	}
+
+	window, ok := j.notifier.matchWindow(time.Until(warning.ExpiryTime))
+	if !ok {
+		return
+	}
+
+	ownerTag := strings.ToLower(j.Conf.Janitor.Notification.OwnerTag)
+	for tagName, tagValue := range tags {
+		if strings.ToLower(tagName) == ownerTag && tagValue != nil {
+			warning.Owner = *tagValue
+		}
+	}
+
+	warning.window = window
+	warning.Window = window.String()
+	j.notifier.add(warning)
+}
+
+// sendNotifications sends all queued expiry warnings of the run, warnings are sent only once per window and backend
+func (j *Janitor) sendNotifications(ctx context.Context, logger *slogger.Logger) {
+	if !j.notifier.enabled() {
+		return
+	}
+
+	for _, warning := range j.notifier.flush() {
+		warningLogger := logger.With(slog.String("resourceID", warning.ResourceID), slog.String("window", warning.Window))
+
+		if j.Conf.DryRun {
+			warningLogger.Infof("expires at %v, but dryrun active, not sending notification", warning.ExpiryTime.Format(time.RFC3339))
+			continue
+		}
+
+		for _, sender := range j.notifier.senders {
+			key := notificationKey(sender, warning)
+			if j.notifier.isSent(key) {
+				continue
+			}
+
+			if err := sender.Send(ctx, warning); err != nil {
+				warningLogger.Errorf(`unable to send notification via "%s": %v`, sender.Name(), err.Error())
+				j.Prometheus.MetricNotifications.With(prometheus.Labels{
+					"backend": sender.Name(),
+					"result":  "failed",
+				}).Inc()
+				continue
+			}
+
+			warningLogger.Infof(`sent expiry notification via "%s"`, sender.Name())
+			j.notifier.markSent(key, warning.ExpiryTime)
+			j.Prometheus.MetricNotifications.With(prometheus.Labels{
+				"backend": sender.Name(),
+				"result":  "success",
+			}).Inc()
+		}
+	}
+
+	j.notifier.cleanup()
+	if err := j.notifier.saveState(); err != nil {
+		logger.Errorf(`unable to write notification state to "%s": %v`, j.notifier.stateFile, err.Error())
+	}
+}
+
+func notificationKey(sender NotificationSender, warning ExpiryWarning) string {
+	return strings.ToLower(fmt.Sprintf(
+		"%s::%s::%s::%d",
+		sender.Name(),
+		warning.ResourceID,
+		warning.window,
+		warning.ExpiryTime.Unix(),
+	))
+}
+
+func (n *notifier) enabled() bool {
+	return n != nil && len(n.windows) > 0 && len(n.senders) > 0
+}
+
+// matchWindow returns the smallest window containing the remaining time until expiry
+func (n *notifier) matchWindow(remaining time.Duration) (time.Duration, bool) {
+	if remaining <= 0 {
+		return 0, false
+	}
+
+	for _, window := range n.windows {
+		if remaining <= window {
+			return window, true
+		}
+	}
+
+	return 0, false
+}
+
+func (n *notifier) add(warning ExpiryWarning) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.warnings = append(n.warnings, warning)
+}
+
+// flush returns and removes all queued warnings
+func (n *notifier) flush() []ExpiryWarning {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	warnings := n.warnings
+	n.warnings = nil
+
+	sort.Slice(warnings, func(a, b int) bool {
+		return warnings[a].ResourceID < warnings[b].ResourceID
+	})
+	return warnings
+}
+
+func (n *notifier) isSent(key string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	_, exists := n.sent[key]
+	return exists
+}
+
+func (n *notifier) markSent(key string, expiryTime time.Time) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.sent[key] = expiryTime
+}
+
+// cleanup removes sent warnings of already expired resources
+func (n *notifier) cleanup() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	now := time.Now()
+	for key, expiryTime := range n.sent {
+		if expiryTime.Before(now) {
+			delete(n.sent, key)
+		}
+	}
+}
+
+func (n *notifier) loadState() error {
+	if n.stateFile == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(n.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return json.Unmarshal(content, &n.sent)
+}
+
+func (n *notifier) saveState() error {
+	if n.stateFile == "" {
+		return nil
+	}
+
+	n.lock.Lock()
+	content, err := json.Marshal(n.sent)
+	n.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(n.stateFile, content, 0600)
+}
+
+func (s *webhookNotificationSender) Name() string {
+	return s.format
+}
+
+func (s *webhookNotificationSender) Send(ctx context.Context, warning ExpiryWarning) error {
+	body, err := json.Marshal(s.payload(warning))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint:errcheck
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %v", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// payload builds the json payload for the backend format
+func (s *webhookNotificationSender) payload(warning ExpiryWarning) any {
+	message := fmt.Sprintf(
+		"Azure %s %s expires at %s and will be deleted by azure-janitor",
+		warning.Kind,
+		warning.ResourceID,
+		warning.ExpiryTime.UTC().Format(time.RFC3339),
+	)
+	if warning.Owner != "" {
+		message = fmt.Sprintf("%s (owner: %s)", message, warning.Owner)
+	}
+
+	switch s.format {
+	case NotificationFormatSlack:
+		return map[string]any{
+			"text": message,
+		}
+	case NotificationFormatTeams:
+		facts := []map[string]string{
+			{"name": "Resource", "value": warning.ResourceID},
+			{"name": "Subscription", "value": warning.SubscriptionID},
+			{"name": "Expiry", "value": warning.ExpiryTime.UTC().Format(time.RFC3339)},
+		}
+		if warning.Owner != "" {
+			facts = append(facts, map[string]string{"name": "Owner", "value": warning.Owner})
+		}
+
+		return map[string]any{
+			"@type":      "MessageCard",
+			"@context":   "https://schema.org/extensions",
+			"summary":    "Azure resource expires soon",
+			"themeColor": "FFA500",
+			"title":      fmt.Sprintf("Azure %s expires soon", warning.Kind),
+			"text":       message,
+			"sections": []map[string]any{
+				{"facts": facts},
+			},
+		}
+	default:
+		return struct {
+			ExpiryWarning
+			Message string `json:"message"`
+		}{
+			ExpiryWarning: warning,
+			Message:       message,
+		}
+	}
+}
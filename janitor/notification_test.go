@@ -0,0 +1,144 @@
+package janitor
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testNotificationReceiver struct {
+	server *httptest.Server
+
+	lock     sync.Mutex
+	payloads map[string][]map[string]any
+}
+
+func newTestNotificationReceiver(t *testing.T) *testNotificationReceiver {
+	t.Helper()
+
+	r := &testNotificationReceiver{payloads: map[string][]map[string]any{}}
+	r.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		payload := map[string]any{}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.payloads[req.URL.Path] = append(r.payloads[req.URL.Path], payload)
+	}))
+	t.Cleanup(r.server.Close)
+
+	return r
+}
+
+func (r *testNotificationReceiver) Payloads(path string) []map[string]any {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.payloads[path]
+}
+
+func TestNotificationWindow(t *testing.T) {
+	n := &notifier{windows: []time.Duration{time.Hour, 24 * time.Hour}}
+
+	testCases := []struct {
+		remaining time.Duration
+		window    time.Duration
+		matched   bool
+	}{
+		{remaining: 30 * time.Minute, window: time.Hour, matched: true},
+		{remaining: 10 * time.Hour, window: 24 * time.Hour, matched: true},
+		{remaining: 48 * time.Hour, matched: false},
+		{remaining: -1 * time.Minute, matched: false},
+	}
+
+	for _, testCase := range testCases {
+		window, matched := n.matchWindow(testCase.remaining)
+		if matched != testCase.matched || window != testCase.window {
+			t.Fatalf(`expected window %v (%v) for %v, got: %v (%v)`, testCase.window, testCase.matched, testCase.remaining, window, matched)
+		}
+	}
+}
+
+func TestRunExpiryNotifications(t *testing.T) {
+	receiver := newTestNotificationReceiver(t)
+
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+	soonId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "soon", map[string]string{
+		"ttl":   time.Now().Add(30 * time.Minute).Format(time.RFC3339),
+		"Owner": "alice@example.com",
+	})
+	server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "later", map[string]string{
+		"ttl": time.Now().Add(10 * time.Hour).Format(time.RFC3339),
+	})
+	server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "notyet", map[string]string{
+		"ttl": time.Now().Add(72 * time.Hour).Format(time.RFC3339),
+	})
+
+	j := buildJanitorObj()
+	j.Conf.Janitor.Notification.Window = []time.Duration{24 * time.Hour, time.Hour}
+	j.Conf.Janitor.Notification.OwnerTag = "owner"
+	j.Conf.Janitor.Notification.Webhook = receiver.server.URL + "/webhook"
+	j.Conf.Janitor.Notification.Slack = receiver.server.URL + "/slack"
+	j.Conf.Janitor.Notification.Timeout = 10 * time.Second
+	j = buildFakeJanitorFromObj(t, server, j)
+	j.Conf.Janitor.Resources.Enable = true
+
+	// warnings must only be sent once
+	j.runJanitor(context.Background(), j.Logger)
+	j.runJanitor(context.Background(), j.Logger)
+
+	webhookPayloads := receiver.Payloads("/webhook")
+	if len(webhookPayloads) != 2 {
+		t.Fatalf(`expected 2 webhook notifications, got: %v`, webhookPayloads)
+	}
+
+	if val := len(receiver.Payloads("/slack")); val != 2 {
+		t.Fatalf(`expected 2 slack notifications, got: %v`, val)
+	}
+
+	for _, payload := range webhookPayloads {
+		if strings.EqualFold(payload["resourceId"].(string), soonId) {
+			if payload["owner"] != "alice@example.com" || payload["window"] != time.Hour.String() {
+				t.Fatalf(`expected owner and 1h window for "%v", got: %v`, soonId, payload)
+			}
+		}
+	}
+
+	for _, payload := range receiver.Payloads("/slack") {
+		if _, exists := payload["text"]; !exists {
+			t.Fatalf(`expected slack payload with text, got: %v`, payload)
+		}
+	}
+}
+
+func TestRunExpiryNotificationsDryRun(t *testing.T) {
+	receiver := newTestNotificationReceiver(t)
+
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+	server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "soon", map[string]string{
+		"ttl": time.Now().Add(30 * time.Minute).Format(time.RFC3339),
+	})
+
+	j := buildJanitorObj()
+	j.Conf.DryRun = true
+	j.Conf.Janitor.Notification.Window = []time.Duration{time.Hour}
+	j.Conf.Janitor.Notification.Teams = receiver.server.URL + "/teams"
+	j = buildFakeJanitorFromObj(t, server, j)
+	j.Conf.Janitor.Resources.Enable = true
+	j.runJanitor(context.Background(), j.Logger)
+
+	if val := len(receiver.Payloads("/teams")); val != 0 {
+		t.Fatalf(`expected no notifications in dry run, got: %v`, val)
+	}
+}
@@ -0,0 +1,163 @@
+package janitor
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	armauthorization "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/webdevops/go-common/azuresdk/armclient"
+	"github.com/webdevops/go-common/log/slogger"
+	prometheusCommon "github.com/webdevops/go-common/prometheus"
+	"github.com/webdevops/go-common/utils/to"
+)
+
+var (
+	// principal types which can be resolved in the tenant via Microsoft Graph
+	orphanedRoleAssignmentPrincipalTypes = []armauthorization.PrincipalType{
+		armauthorization.PrincipalTypeUser,
+		armauthorization.PrincipalTypeGroup,
+		armauthorization.PrincipalTypeServicePrincipal,
+	}
+)
+
+// processOrphanedRoleAssignments resolves the principals of the roleAssignments and reports (or deletes) the
+// roleAssignments whose principal does not exist anymore. Independent of ttl, only roleAssignments at or below the
+// listed scope are checked and the principal, scope and (if set) roleDefinition filters are applied.
+// If the principals cannot be resolved nothing is reported.
+func (j *Janitor) processOrphanedRoleAssignments(ctx context.Context, logger *slogger.Logger, subscriptionId string, client *armauthorization.RoleAssignmentsClient, roleAssignments []scopedRoleAssignment, orphanedMetric *prometheusCommon.MetricList) error {
+	conf := j.Conf.Janitor.RoleAssignmentsOrphaned
+	resourceType := "Microsoft.Authorization/roleAssignments"
+	contextLogger := logger.With(slog.String("check", "orphaned"))
+
+	// principals of new roleAssignments might not be replicated yet
+	minCreatedOn := time.Now().Add(-conf.MinAge)
+
+	candidates := []scopedRoleAssignment{}
+	principalIds := []string{}
+	principalSeen := map[string]bool{}
+	for _, item := range roleAssignments {
+		properties := item.roleAssignment.Properties
+		if properties == nil || to.String(properties.PrincipalID) == "" || properties.CreatedOn == nil || properties.CreatedOn.After(minCreatedOn) {
+			continue
+		}
+
+		// inherited roleAssignments (from parent scopes) are handled on their own scope
+		if !isScopeWithin(item.scope, to.String(properties.Scope)) {
+			continue
+		}
+
+		if !isOrphanedRoleAssignmentResolvable(item.roleAssignment) {
+			continue
+		}
+
+		if !j.isRoleAssignmentSelected(item.roleAssignment, item.scope) {
+			continue
+		}
+
+		if len(j.Conf.Janitor.RoleAssignments.RoleDefintionIds) > 0 && !j.isRoleAssignmentRoleDefinitionAllowed(item.roleAssignment) {
+			continue
+		}
+
+		candidates = append(candidates, item)
+		if principalId := to.StringLower(properties.PrincipalID); !principalSeen[principalId] {
+			principalSeen[principalId] = true
+			principalIds = append(principalIds, principalId)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	existingPrincipals, err := j.Azure.Principals.ExistingPrincipals(ctx, principalIds)
+	if err != nil {
+		return fmt.Errorf("unable to resolve principals of roleAssignments: %w", err)
+	}
+
+	orphanedCount := 0
+	for _, item := range candidates {
+		roleAssignment := item.roleAssignment
+		if existingPrincipals[to.StringLower(roleAssignment.Properties.PrincipalID)] {
+			continue
+		}
+		orphanedCount++
+
+		azureResource, _ := armclient.ParseResourceId(to.String(roleAssignment.Properties.Scope))
+
+		roleAssignmentLogger := contextLogger.With(
+			slog.String("roleAssignmentScope", item.scope),
+			slog.String("roleAssignmentId", to.StringLower(roleAssignment.ID)),
+			slog.String("scope", to.StringLower(roleAssignment.Properties.Scope)),
+			slog.String("principalId", to.StringLower(roleAssignment.Properties.PrincipalID)),
+			slog.String("principalType", strings.ToLower(roleAssignmentPrincipalType(roleAssignment))),
+			slog.String("roleDefinitionId", to.StringLower(roleAssignment.Properties.RoleDefinitionID)),
+			slog.String("subscriptionID", strings.ToLower(subscriptionId)),
+			slog.String("resourceGroup", azureResource.ResourceGroup),
+		)
+
+		orphanedMetric.Add(prometheus.Labels{
+			"roleAssignmentId": to.StringLower(roleAssignment.ID),
+			"scope":            to.StringLower(roleAssignment.Properties.Scope),
+			"principalId":      to.StringLower(roleAssignment.Properties.PrincipalID),
+			"principalType":    strings.ToLower(roleAssignmentPrincipalType(roleAssignment)),
+			"roleDefinitionId": to.StringLower(roleAssignment.Properties.RoleDefinitionID),
+			"subscriptionID":   strings.ToLower(subscriptionId),
+			"resourceGroup":    azureResource.ResourceGroup,
+		}, 1)
+
+		orphanedItem := PlanItem{
+			ResourceID:     to.String(roleAssignment.ID),
+			Kind:           PlanKindRoleAssignment,
+			SubscriptionID: subscriptionId,
+			Reason:         PlanReasonRoleAssignmentOrphaned,
+			Action:         PlanActionReport,
+		}
+		if conf.Delete {
+			orphanedItem.Action = PlanActionDelete
+		}
+		j.plan.Add(orphanedItem)
+
+		switch {
+		case !conf.Delete:
+			roleAssignmentLogger.Warnf("principal not found, orphaned roleAssignment is only reported")
+			j.writeAuditEvent(ctx, roleAssignmentLogger, orphanedItem, nil, AuditResultSkipped, AuditSkipReasonReportOnly)
+		case j.Conf.DryRun:
+			roleAssignmentLogger.Infof("principal not found, but dryrun active")
+			j.writeAuditEvent(ctx, roleAssignmentLogger, orphanedItem, nil, AuditResultSkipped, AuditSkipReasonDryRun)
+		default:
+			roleAssignmentLogger.Infof("principal not found, trying to delete orphaned roleAssignment")
+			j.runDeletion(ctx, roleAssignmentLogger, deletion{
+				subscriptionID: strings.ToLower(subscriptionId),
+				resourceType:   strings.ToLower(resourceType),
+				planItem:       orphanedItem,
+				begin: func(ctx context.Context) (func(ctx context.Context) error, error) {
+					// role assignments are deleted synchronously
+					_, err := client.DeleteByID(ctx, to.String(roleAssignment.ID), nil)
+					return nil, err
+				},
+			})
+		}
+	}
+
+	contextLogger.Infof("checked %v roleAssignments of %v principals, %v orphaned", len(candidates), len(principalIds), orphanedCount)
+
+	return nil
+}
+
+// isOrphanedRoleAssignmentResolvable checks if the principal of the roleAssignment can be resolved in the tenant,
+// principals of other tenants (eg. ForeignGroup, delegated managed identities) are never found and would be
+// reported as orphaned
+func isOrphanedRoleAssignmentResolvable(roleAssignment *armauthorization.RoleAssignment) bool {
+	if roleAssignment.Properties.DelegatedManagedIdentityResourceID != nil {
+		return false
+	}
+
+	return slices.ContainsFunc(orphanedRoleAssignmentPrincipalTypes, func(principalType armauthorization.PrincipalType) bool {
+		return strings.EqualFold(string(principalType), roleAssignmentPrincipalType(roleAssignment))
+	})
+}
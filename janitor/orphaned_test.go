@@ -0,0 +1,137 @@
+package janitor
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	armauthorization "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/webdevops/go-common/utils/to"
+)
+
+func TestRunOrphanedRoleAssignments(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+
+	scope := "/subscriptions/" + testSubscriptionId
+	created := time.Now().Add(-2 * time.Hour)
+
+	// orphaned roleAssignments are detected independent of the roleDefinition
+	orphanedId := server.AddRoleAssignment(scope, "orphaned", "/providers/Microsoft.Authorization/roleDefinitions/other", armauthorization.PrincipalTypeServicePrincipal, created, "")
+	server.SetRoleAssignmentPrincipal(orphanedId, "deleted-principal")
+	existingId := server.AddRoleAssignment(scope, "existing", "/providers/Microsoft.Authorization/roleDefinitions/other", armauthorization.PrincipalTypeUser, created, "")
+	newId := server.AddRoleAssignment(scope, "new", "/providers/Microsoft.Authorization/roleDefinitions/other", armauthorization.PrincipalTypeServicePrincipal, time.Now(), "")
+	server.SetRoleAssignmentPrincipal(newId, "new-principal")
+
+	principals := &fakePrincipalClient{deleted: map[string]bool{"deleted-principal": true, "new-principal": true}}
+
+	j := buildJanitorObj()
+	j.Conf.Janitor.RoleAssignmentsOrphaned.Enable = true
+	j.Conf.Janitor.RoleAssignmentsOrphaned.MinAge = time.Hour
+	j.Azure.Principals = principals
+	j = buildFakeJanitorFromObj(t, server, j)
+
+	// report only
+	j.runJanitor(context.Background(), j.Logger)
+	assumeState(t, "reported orphaned roleAssignment exists", true, server.Exists(orphanedId))
+	if val := testutil.CollectAndCount(j.Prometheus.MetricOrphanedRoleAssignments); val != 1 {
+		t.Fatalf(`expected 1 orphaned roleAssignment metric, got: %v`, val)
+	}
+	if val := len(j.GetPlan().ItemsByAction(PlanActionReport)); val != 1 {
+		t.Fatalf(`expected 1 reported plan item, got: %v`, val)
+	}
+	if val := testutil.CollectAndCount(j.Prometheus.MetricTtlRoleAssignments); val != 0 {
+		t.Fatalf(`expected no ttl metrics without roleAssignment ttl cleanup, got: %v`, val)
+	}
+
+	// delete (requires explicit scope, principal type or roleDefinition filter)
+	j.Conf.Janitor.RoleAssignmentsOrphaned.Delete = true
+	j.Conf.Janitor.RoleAssignments.Scopes = []string{scope}
+	j.runJanitor(context.Background(), j.Logger)
+	assumeState(t, "orphaned roleAssignment exists", false, server.Exists(orphanedId))
+	assumeState(t, "roleAssignment of existing principal exists", true, server.Exists(existingId))
+	assumeState(t, "new roleAssignment exists", true, server.Exists(newId))
+
+	// principals are resolved in one lookup per run, new roleAssignments are not checked
+	for _, lookup := range principals.lookups {
+		if len(lookup) != 2 {
+			t.Fatalf(`expected lookup of 2 principals, got: %v`, lookup)
+		}
+	}
+}
+
+func TestRunOrphanedRoleAssignmentsLookupFailure(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+
+	scope := "/subscriptions/" + testSubscriptionId
+	orphanedId := server.AddRoleAssignment(scope, "orphaned", testRoleDefinitionId, armauthorization.PrincipalTypeServicePrincipal, time.Now().Add(-2*time.Hour), "")
+
+	j := buildJanitorObj()
+	j.Conf.Janitor.RoleAssignmentsOrphaned.Enable = true
+	j.Conf.Janitor.RoleAssignmentsOrphaned.Delete = true
+	j.Azure.Principals = &fakePrincipalClient{err: errors.New("injected failure")}
+	j = buildFakeJanitorFromObj(t, server, j)
+	j.runJanitor(context.Background(), j.Logger)
+
+	// unresolved principals are never treated as deleted
+	assumeState(t, "roleAssignment exists", true, server.Exists(orphanedId))
+	if val := testutil.CollectAndCount(j.Prometheus.MetricOrphanedRoleAssignments); val != 0 {
+		t.Fatalf(`expected no orphaned roleAssignment metrics, got: %v`, val)
+	}
+	if val := testutil.CollectAndCount(j.Prometheus.MetricErrors); val == 0 {
+		t.Fatalf(`expected error metric for failed principal lookup`)
+	}
+}
+
+func TestRunOrphanedRoleAssignmentsScope(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	subscriptionScope := "/subscriptions/" + testSubscriptionId
+	resourceGroupScope := subscriptionScope + "/resourceGroups/rg-test"
+	created := time.Now().Add(-2 * time.Hour)
+
+	orphanedId := server.AddRoleAssignment(resourceGroupScope, "orphaned", testRoleDefinitionId, armauthorization.PrincipalTypeServicePrincipal, created, "")
+	server.SetRoleAssignmentPrincipal(orphanedId, "deleted-principal")
+	inheritedId := server.AddRoleAssignment(subscriptionScope, "inherited", testRoleDefinitionId, armauthorization.PrincipalTypeServicePrincipal, created, "")
+	server.SetRoleAssignmentPrincipal(inheritedId, "deleted-principal")
+	foreignGroupId := server.AddRoleAssignment(resourceGroupScope, "foreign", testRoleDefinitionId, armauthorization.PrincipalTypeForeignGroup, created, "")
+	server.SetRoleAssignmentPrincipal(foreignGroupId, "foreign-principal")
+	otherRoleId := server.AddRoleAssignment(resourceGroupScope, "other-role", "/providers/Microsoft.Authorization/roleDefinitions/other", armauthorization.PrincipalTypeServicePrincipal, created, "")
+	server.SetRoleAssignmentPrincipal(otherRoleId, "deleted-principal")
+
+	j := buildJanitorObj()
+	j.Conf.Janitor.RoleAssignmentsOrphaned.Enable = true
+	j.Conf.Janitor.RoleAssignmentsOrphaned.Delete = true
+	j.Conf.Janitor.RoleAssignmentsOrphaned.MinAge = time.Hour
+	j.Conf.Janitor.RoleAssignments.Scopes = []string{resourceGroupScope}
+	j.Conf.Janitor.RoleAssignments.RoleDefintionIds = []string{testRoleDefinitionId}
+	j.Azure.Principals = &fakePrincipalClient{deleted: map[string]bool{"deleted-principal": true, "foreign-principal": true}}
+	j = buildFakeJanitorFromObj(t, server, j)
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "orphaned roleAssignment exists", false, server.Exists(orphanedId))
+	assumeState(t, "inherited roleAssignment exists", true, server.Exists(inheritedId))
+	assumeState(t, "foreign group roleAssignment exists", true, server.Exists(foreignGroupId))
+	assumeState(t, "roleAssignment of other roleDefinition exists", true, server.Exists(otherRoleId))
+}
+
+func TestOrphanedRoleAssignmentResolvable(t *testing.T) {
+	newRoleAssignment := func(principalType armauthorization.PrincipalType) *armauthorization.RoleAssignment {
+		return &armauthorization.RoleAssignment{
+			Properties: &armauthorization.RoleAssignmentProperties{
+				PrincipalType: &principalType,
+			},
+		}
+	}
+
+	assumeState(t, "user resolvable", true, isOrphanedRoleAssignmentResolvable(newRoleAssignment(armauthorization.PrincipalTypeUser)))
+	assumeState(t, "service principal resolvable", true, isOrphanedRoleAssignmentResolvable(newRoleAssignment(armauthorization.PrincipalTypeServicePrincipal)))
+	assumeState(t, "foreign group resolvable", false, isOrphanedRoleAssignmentResolvable(newRoleAssignment(armauthorization.PrincipalTypeForeignGroup)))
+	assumeState(t, "unknown principal type resolvable", false, isOrphanedRoleAssignmentResolvable(&armauthorization.RoleAssignment{Properties: &armauthorization.RoleAssignmentProperties{}}))
+
+	delegated := newRoleAssignment(armauthorization.PrincipalTypeServicePrincipal)
+	delegated.Properties.DelegatedManagedIdentityResourceID = to.StringPtr("/subscriptions/other/resourceGroups/rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/identity")
+	assumeState(t, "delegated managed identity resolvable", false, isOrphanedRoleAssignmentResolvable(delegated))
+}
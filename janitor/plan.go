@@ -0,0 +1,127 @@
+package janitor
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/webdevops/azure-janitor/config"
+)
+
+const (
+	PlanKindResource       = "resource"
+	PlanKindResourceGroup  = "resourceGroup"
+	PlanKindDeployment     = "deployment"
+	PlanKindRoleAssignment = "roleAssignment"
+
+	PlanReasonTtlExpired             = "ttl expired"
+	PlanReasonTtlDuration            = "ttl duration"
+	PlanReasonResourceAge            = "resource age"
+	PlanReasonResourceIdle           = "resource idle"
+	PlanReasonDeploymentLimit        = "deployment limit"
+	PlanReasonDeploymentAge          = "deployment age"
+	PlanReasonRoleAssignmentTtl      = "role assignment ttl"
+	PlanReasonRoleAssignmentOrphaned = "role assignment orphaned"
+
+	PlanActionDelete     = "delete"
+	PlanActionUpdateTags = "update tags"
+	PlanActionReport     = "report"
+	PlanActionProtected  = "protected"
+)
+
+type (
+	// Plan contains all actions (deletions and tag rewrites) of one janitor run
+	Plan struct {
+		DryRun     bool       `json:"dryRun"`
+		StartTime  time.Time  `json:"startTime"`
+		FinishTime *time.Time `json:"finishTime,omitempty"`
+		Items      []PlanItem `json:"items"`
+
+		lock sync.Mutex
+	}
+
+	PlanItem struct {
+		ResourceID     string     `json:"resourceId"`
+		Kind           string     `json:"kind"`
+		SubscriptionID string     `json:"subscriptionId"`
+		Rule           string     `json:"rule,omitempty"`
+		Reason         string     `json:"reason"`
+		ExpiryTime     *time.Time `json:"expiryTime,omitempty"`
+		Action         string     `json:"action"`
+		Protection     string     `json:"protection,omitempty"`
+	}
+)
+
+func NewPlan(dryRun bool) *Plan {
+	return &Plan{
+		DryRun:    dryRun,
+		StartTime: time.Now(),
+		Items:     []PlanItem{},
+	}
+}
+
+// Add adds an item to the plan (safe for concurrent use)
+func (p *Plan) Add(item PlanItem) {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.Items = append(p.Items, item)
+}
+
+// Finish marks the plan as finished
+func (p *Plan) Finish() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	finishTime := time.Now()
+	p.FinishTime = &finishTime
+}
+
+// ItemsByAction returns all items with the given action
+func (p *Plan) ItemsByAction(action string) []PlanItem {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ret := []PlanItem{}
+	for _, item := range p.Items {
+		if item.Action == action {
+			ret = append(ret, item)
+		}
+	}
+	return ret
+}
+
+// MarshalJSON returns plan as json (safe for concurrent use)
+func (p *Plan) MarshalJSON() ([]byte, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	type planAlias Plan
+	return json.Marshal(&struct {
+		*planAlias
+	}{
+		planAlias: (*planAlias)(p),
+	})
+}
+
+// planActionForRule returns the plan action for expired resources matched by the rule
+func planActionForRule(rule *config.PolicyRule) string {
+	if rule.Action == config.PolicyActionReport {
+		return PlanActionReport
+	}
+	return PlanActionDelete
+}
+
+// WriteFile writes the plan as json to the given file
+func (p *Plan) WriteFile(path string) error {
+	content, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, content, 0600)
+}
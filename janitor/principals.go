@@ -0,0 +1,91 @@
+package janitor
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+)
+
+const (
+	// maximum number of ids per Microsoft Graph getByIds request
+	principalBatchSize = 1000
+)
+
+type (
+	// PrincipalClient resolves Entra ID principals (users, groups, service principals)
+	PrincipalClient interface {
+		// ExistingPrincipals returns the (lowercase) IDs of the given principals which still exist
+		ExistingPrincipals(ctx context.Context, principalIds []string) (map[string]bool, error)
+	}
+
+	// graphPrincipalClient is the Microsoft Graph implementation of PrincipalClient
+	graphPrincipalClient struct {
+		provider AzureClientProvider
+		endpoint string
+	}
+
+	graphDirectoryObjects struct {
+		Value []struct {
+			ID string `json:"id"`
+		} `json:"value"`
+	}
+)
+
+// ExistingPrincipals looks up the principals via directoryObjects/getByIds (batched), deleted principals are
+// not returned by Microsoft Graph
+func (c *graphPrincipalClient) ExistingPrincipals(ctx context.Context, principalIds []string) (map[string]bool, error) {
+	clientOptions := c.provider.NewArmClientOptions()
+	pipeline := runtime.NewPipeline("azure-janitor", "", runtime.PipelineOptions{
+		PerRetry: []policy.Policy{
+			runtime.NewBearerTokenPolicy(c.provider.GetCred(), []string{c.endpoint + "/.default"}, nil),
+		},
+	}, &clientOptions.ClientOptions)
+
+	ret := map[string]bool{}
+	for start := 0; start < len(principalIds); start += principalBatchSize {
+		batch := principalIds[start:min(start+principalBatchSize, len(principalIds))]
+
+		req, err := runtime.NewRequest(ctx, http.MethodPost, c.endpoint+"/v1.0/directoryObjects/getByIds")
+		if err != nil {
+			return nil, err
+		}
+		if err := runtime.MarshalAsJSON(req, map[string]any{"ids": batch}); err != nil {
+			return nil, err
+		}
+
+		resp, err := pipeline.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if !runtime.HasStatusCode(resp, http.StatusOK) {
+			return nil, runtime.NewResponseError(resp)
+		}
+
+		result := graphDirectoryObjects{}
+		if err := runtime.UnmarshalAsJSON(resp, &result); err != nil {
+			return nil, err
+		}
+		for _, object := range result.Value {
+			ret[strings.ToLower(object.ID)] = true
+		}
+	}
+
+	return ret, nil
+}
+
+// initPrincipals sets the Microsoft Graph principal client if orphaned roleAssignments are detected
+func (j *Janitor) initPrincipals() {
+	if !j.Conf.Janitor.RoleAssignmentsOrphaned.Enable {
+		return
+	}
+
+	if j.Azure.Principals == nil {
+		j.Azure.Principals = &graphPrincipalClient{
+			provider: j.Azure.ClientProvider,
+			endpoint: strings.TrimSuffix(j.Conf.Janitor.RoleAssignmentsOrphaned.GraphEndpoint, "/"),
+		}
+	}
+}
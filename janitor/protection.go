@@ -0,0 +1,173 @@
+package janitor
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armlocks"
+	"github.com/webdevops/go-common/log/slogger"
+	"github.com/webdevops/go-common/utils/to"
+)
+
+const (
+	ProtectionReasonTag            = "protection tag"
+	ProtectionReasonManagementLock = "management lock"
+
+	managementLockScopeSeparator = "/providers/microsoft.authorization/locks/"
+)
+
+type (
+	// managementLockCache contains the scopes of all management locks, fetched once per subscription and run
+	managementLockCache struct {
+		subscriptions map[string]*managementLockList
+		lock          sync.Mutex
+	}
+
+	managementLockList struct {
+		once   sync.Once
+		scopes []string
+		err    error
+	}
+)
+
+func newManagementLockCache() *managementLockCache {
+	return &managementLockCache{
+		subscriptions: map[string]*managementLockList{},
+	}
+}
+
+// checkProtection returns the reason why a resource must not be deleted (empty if not protected),
+// the protection tag is checked first and management locks (CanNotDelete and ReadOnly) afterwards
+func (j *Janitor) checkProtection(ctx context.Context, logger *slogger.Logger, subscriptionID, resourceID string, tags map[string]*string) string {
+	if j.hasProtectionTag(tags) {
+		return ProtectionReasonTag
+	}
+
+	if j.Conf.Janitor.Protection.DisableLockCheck || subscriptionID == "" {
+		// management locks are not available above subscription scope
+		return ""
+	}
+
+	locked, err := j.isManagementLocked(ctx, subscriptionID, resourceID)
+	if err != nil {
+		// unable to check, delete operation will fail if resource is locked
+		logger.Warnf("unable to check management locks: %v", err.Error())
+		return ""
+	}
+
+	if locked {
+		return ProtectionReasonManagementLock
+	}
+
+	return ""
+}
+
+// hasProtectionTag checks if the protection tag is set (tag value "false" disables the protection)
+func (j *Janitor) hasProtectionTag(tags map[string]*string) bool {
+	if j.Conf.Janitor.Protection.Tag == "" {
+		return false
+	}
+
+	protectionTag := strings.ToLower(j.Conf.Janitor.Protection.Tag)
+	for tagName, tagValue := range tags {
+		if strings.ToLower(tagName) != protectionTag {
+			continue
+		}
+
+		if val, err := strconv.ParseBool(strings.TrimSpace(to.String(tagValue))); err == nil && !val {
+			return false
+		}
+		return true
+	}
+
+	return false
+}
+
+// isManagementLocked checks if a management lock exists on the resource or one of its parent scopes
+func (j *Janitor) isManagementLocked(ctx context.Context, subscriptionID, resourceID string) (bool, error) {
+	scopes, err := j.managementLocks.get(subscriptionID, func() ([]string, error) {
+		return j.fetchManagementLockScopes(ctx, subscriptionID)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	resourceID = strings.ToLower(resourceID)
+	for _, scope := range scopes {
+		if resourceID == scope || strings.HasPrefix(resourceID, scope+"/") {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// fetchManagementLockScopes lists all management locks (all levels) of the subscription and returns their scopes
+func (j *Janitor) fetchManagementLockScopes(ctx context.Context, subscriptionID string) ([]string, error) {
+	client, err := armlocks.NewManagementLocksClient(subscriptionID, j.Azure.ClientProvider.GetCred(), j.Azure.ClientProvider.NewArmClientOptions())
+	if err != nil {
+		return nil, err
+	}
+
+	scopes := []string{}
+	pager := client.NewListAtSubscriptionLevelPager(nil)
+	for pager.More() {
+		result, err := pager.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, lock := range result.Value {
+			// CanNotDelete and ReadOnly both prevent deletion
+			lockID := to.StringLower(lock.ID)
+			if scope, _, found := strings.Cut(lockID, managementLockScopeSeparator); found {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+
+	return scopes, nil
+}
+
+// get returns the cached lock scopes of the subscription, fetch is called only once per subscription
+func (c *managementLockCache) get(subscriptionID string, fetch func() ([]string, error)) ([]string, error) {
+	c.lock.Lock()
+	list, exists := c.subscriptions[strings.ToLower(subscriptionID)]
+	if !exists {
+		list = &managementLockList{}
+		c.subscriptions[strings.ToLower(subscriptionID)] = list
+	}
+	c.lock.Unlock()
+
+	list.once.Do(func() {
+		list.scopes, list.err = fetch()
+	})
+
+	return list.scopes, list.err
+}
+
+// isScopeLockedError checks if a delete operation failed because of a management lock
+func isScopeLockedError(err error) bool {
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && strings.EqualFold(responseErr.ErrorCode, "ScopeLocked")
+}
+
+// protectPlanItem marks a planned deletion as protected (with protection reason) if the resource must not be deleted
+func (j *Janitor) protectPlanItem(ctx context.Context, logger *slogger.Logger, item *PlanItem, tags map[string]*string) bool {
+	if item.Action != PlanActionDelete {
+		return false
+	}
+
+	protection := j.checkProtection(ctx, logger, item.SubscriptionID, item.ResourceID, tags)
+	if protection == "" {
+		return false
+	}
+
+	item.Action = PlanActionProtected
+	item.Protection = protection
+	return true
+}
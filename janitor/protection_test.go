@@ -0,0 +1,105 @@
+package janitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armlocks"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/webdevops/go-common/utils/to"
+)
+
+func TestProtectionTag(t *testing.T) {
+	j := buildJanitorObj()
+	j.Conf.Janitor.Protection.Tag = "donotdelete"
+
+	testCases := map[string]struct {
+		tags      map[string]*string
+		protected bool
+	}{
+		"no tag":      {tags: map[string]*string{"ttl": to.StringPtr("1h")}, protected: false},
+		"empty value": {tags: map[string]*string{"DoNotDelete": to.StringPtr("")}, protected: true},
+		"true":        {tags: map[string]*string{"donotdelete": to.StringPtr("true")}, protected: true},
+		"text":        {tags: map[string]*string{"donotdelete": to.StringPtr("production database")}, protected: true},
+		"false":       {tags: map[string]*string{"donotdelete": to.StringPtr("false")}, protected: false},
+	}
+
+	for name, testCase := range testCases {
+		if val := j.hasProtectionTag(testCase.tags); val != testCase.protected {
+			t.Fatalf(`%v: expected protected=%v, got: %v`, name, testCase.protected, val)
+		}
+	}
+}
+
+func TestRunProtection(t *testing.T) {
+	expiredTags := func(tags map[string]string) map[string]string {
+		tags["ttl"] = time.Now().Add(-1 * time.Hour).Format(time.RFC3339)
+		return tags
+	}
+
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+	server.AddResourceGroup(testSubscriptionId, "rg-locked", expiredTags(map[string]string{}))
+	server.AddManagementLock("/subscriptions/"+testSubscriptionId+"/resourceGroups/rg-locked", "nodelete", armlocks.LockLevelCanNotDelete)
+
+	taggedId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "tagged", expiredTags(map[string]string{"donotdelete": "true"}))
+	lockedId := server.AddResource(testSubscriptionId, "rg-locked", "Microsoft.Storage/storageAccounts", "locked", expiredTags(map[string]string{}))
+	expiredId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "expired", expiredTags(map[string]string{}))
+
+	j := buildJanitorObj()
+	j.Conf.Janitor.Protection.Tag = "donotdelete"
+	j = buildFakeJanitorFromObj(t, server, j)
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.ResourceGroups.Enable = true
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "tagged resource exists", true, server.Exists(taggedId))
+	assumeState(t, "locked resource exists", true, server.Exists(lockedId))
+	assumeState(t, "locked resourceGroup exists", true, server.Exists("/subscriptions/"+testSubscriptionId+"/resourceGroups/rg-locked"))
+	assumeState(t, "expired resource exists", false, server.Exists(expiredId))
+
+	protection := map[string]string{}
+	for _, item := range j.GetPlan().ItemsByAction(PlanActionProtected) {
+		protection[item.ResourceID] = item.Protection
+	}
+
+	if len(protection) != 3 || protection[taggedId] != ProtectionReasonTag || protection[lockedId] != ProtectionReasonManagementLock {
+		t.Fatalf(`expected tagged and locked resources to be protected, got: %v`, protection)
+	}
+
+	if val := testutil.CollectAndCount(j.Prometheus.MetricErrors); val != 0 {
+		t.Fatalf(`expected no errors, got: %v`, val)
+	}
+
+	// locks are fetched only once per subscription and run
+	lockRequests := 0
+	for _, request := range server.Requests("GET") {
+		if request == "GET /subscriptions/"+testSubscriptionId+"/providers/Microsoft.Authorization/locks" {
+			lockRequests++
+		}
+	}
+	if lockRequests != 1 {
+		t.Fatalf(`expected 1 lock request, got: %v`, lockRequests)
+	}
+}
+
+func TestRunProtectionScopeLocked(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-locked", nil)
+	server.AddManagementLock("/subscriptions/"+testSubscriptionId+"/resourceGroups/rg-locked", "nodelete", armlocks.LockLevelCanNotDelete)
+	lockedId := server.AddResource(testSubscriptionId, "rg-locked", "Microsoft.Storage/storageAccounts", "locked", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.Protection.DisableLockCheck = true
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "locked resource exists", true, server.Exists(lockedId))
+
+	if val := testutil.CollectAndCount(j.Prometheus.MetricErrors); val != 0 {
+		t.Fatalf(`expected no errors for locked resource, got: %v`, val)
+	}
+}
@@ -3,7 +3,9 @@ package janitor
 import (
 	"context"
 	"log/slog"
+	"maps"
 	"strings"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armsubscriptions"
@@ -11,88 +13,178 @@ import (
 	"github.com/webdevops/go-common/log/slogger"
 	prometheusCommon "github.com/webdevops/go-common/prometheus"
 	"github.com/webdevops/go-common/utils/to"
+
+	"github.com/webdevops/azure-janitor/config"
 )
 
-func (j *Janitor) runResourceGroups(ctx context.Context, logger *slogger.Logger, subscription *armsubscriptions.Subscription, filter string, callback chan<- func()) {
+func (j *Janitor) runResourceGroups(ctx context.Context, logger *slogger.Logger, subscription *armsubscriptions.Subscription, filter *ListFilter, callback chan<- func()) error {
 	contextLogger := logger.With(slog.String("task", "resourceGroup"))
 	resourceType := "Microsoft.Resources/resourceGroups"
 
-	client, err := armresources.NewResourceGroupsClient(*subscription.SubscriptionID, j.Azure.Client.GetCred(), j.Azure.Client.NewArmClientOptions())
+	client, err := armresources.NewResourceGroupsClient(*subscription.SubscriptionID, j.Azure.ClientProvider.GetCred(), j.Azure.ClientProvider.NewArmClientOptions())
+	if err != nil {
+		return err
+	}
+
+	tagsClient, err := armresources.NewTagsClient(*subscription.SubscriptionID, j.Azure.ClientProvider.GetCred(), j.Azure.ClientProvider.NewArmClientOptions())
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	resourceTtl := prometheusCommon.NewMetricsList()
 
-	pager := client.NewListPager(nil)
-	for pager.More() {
-		result, err := pager.NextPage(ctx)
-		if err != nil {
-			panic(err)
+	// resourceGroup timestamps are built from the contained resources, only needed for age limits
+	// (not available via Resource Graph discovery, first seen time is used instead)
+	var resourceGroupTimestamps map[string]resourceTimestamps
+	if j.policyUsesResourceGroupAge() && j.discovery == nil {
+		if resourceGroupTimestamps, err = j.fetchResourceGroupTimestamps(ctx, subscription); err != nil {
+			return err
+		}
+	}
+
+	deletions := []orderedDeletion{}
+	err = j.forEachResourceGroup(ctx, contextLogger, subscription, client, filter, func(resourceGroup *armresources.ResourceGroup) {
+		if !filter.Matches(FilterObject{
+			Name:     to.String(resourceGroup.Name),
+			Location: to.String(resourceGroup.Location),
+			Tags:     resourceGroup.Tags,
+		}) {
+			return
 		}
 
-		for _, resourceGroup := range result.Value {
-			resourceLogger := contextLogger.With(slog.String("resource", to.String(resourceGroup.ID)))
+		resourceLogger := contextLogger.With(slog.String("resource", to.String(resourceGroup.ID)))
 
-			if resourceGroup.Tags != nil {
-				resourceExpiryTime, resourceExpired, resourceTagUpdateNeeded := j.checkAzureResourceExpiry(resourceLogger, resourceType, *resourceGroup.ID, &resourceGroup.Tags)
+		rule := j.Policy.Match(to.String(subscription.SubscriptionID), to.String(resourceGroup.Name), resourceType, to.String(resourceGroup.Location))
+		if rule == nil {
+			resourceLogger.Debug("no matching policy rule found")
+			return
+		}
+		resourceLogger = resourceLogger.With(slog.String("rule", rule.Name))
 
-				if resourceExpiryTime != nil {
-					labels := prometheus.Labels{
+		if resourceGroup.Tags == nil {
+			resourceGroup.Tags = map[string]*string{}
+		}
+		originalTags := maps.Clone(resourceGroup.Tags)
+
+		// default ttl of resourceGroups is based on the first seen time
+		resourceExpiryTime, resourceExpired, resourceTagUpdateNeeded := j.checkAzureResourceExpiry(resourceLogger, rule, resourceType, *resourceGroup.ID, nil, &resourceGroup.Tags)
+
+		// empty resourceGroups have no timestamps, first seen time is used instead
+		timestamps := resourceGroupTimestamps[to.StringLower(resourceGroup.Name)]
+
+		// age limits of rule win if they expire earlier
+		resourceExpiryReason := PlanReasonTtlExpired
+		if ageExpiryTime, ageReason := j.checkAzureResourceAge(resourceLogger, rule, *resourceGroup.ID, timestamps); ageExpiryTime != nil && (resourceExpiryTime == nil || ageExpiryTime.Before(*resourceExpiryTime)) {
+			resourceExpiryTime = ageExpiryTime
+			resourceExpired = ageExpiryTime.Before(time.Now())
+			resourceExpiryReason = ageReason
+		}
+
+		if resourceExpiryTime != nil {
+			labels := prometheus.Labels{
+				"subscriptionID": to.StringLower(subscription.SubscriptionID),
+				"resourceID":     to.StringLower(resourceGroup.ID),
+				"resourceGroup":  to.StringLower(resourceGroup.Name),
+				"resourceType":   strings.ToLower(resourceType),
+			}
+			labels = j.addResourceTagsToPrometheusLabels(ctx, labels, *resourceGroup.ID)
+			resourceTtl.AddTime(labels, *resourceExpiryTime)
+		}
+
+		if resourceExpiryTime != nil && !resourceExpired && rule.Action == config.PolicyActionDelete && !j.hasProtectionTag(resourceGroup.Tags) {
+			j.addExpiryWarning(ExpiryWarning{
+				ResourceID:     to.String(resourceGroup.ID),
+				Kind:           PlanKindResourceGroup,
+				SubscriptionID: to.String(subscription.SubscriptionID),
+				Rule:           rule.Name,
+				ExpiryTime:     *resourceExpiryTime,
+			}, resourceGroup.Tags)
+		}
+
+		if resourceTagUpdateNeeded && rule.Action == config.PolicyActionDelete && !j.hasProtectionTag(resourceGroup.Tags) {
+			tagUpdateItem := PlanItem{
+				ResourceID:     to.String(resourceGroup.ID),
+				Kind:           PlanKindResourceGroup,
+				SubscriptionID: to.String(subscription.SubscriptionID),
+				Rule:           rule.Name,
+				Reason:         PlanReasonTtlDuration,
+				ExpiryTime:     resourceExpiryTime,
+				Action:         PlanActionUpdateTags,
+			}
+			j.plan.Add(tagUpdateItem)
+
+			if j.Conf.DryRun {
+				j.writeAuditEvent(ctx, resourceLogger, tagUpdateItem, resourceGroup.Tags, AuditResultSkipped, AuditSkipReasonDryRun)
+			} else {
+				resourceLogger.Infof("tag update needed, updating resource")
+				if err := j.updateTagsAtScope(ctx, tagsClient, *resourceGroup.ID, originalTags, resourceGroup.Tags); err == nil {
+					// successfully updated
+					resourceLogger.Infof("successfully updated")
+					j.writeAuditEvent(ctx, resourceLogger, tagUpdateItem, resourceGroup.Tags, AuditResultSuccess, "")
+				} else {
+					// failed update
+					resourceLogger.Error(err.Error())
+					j.writeAuditEvent(ctx, resourceLogger, tagUpdateItem, resourceGroup.Tags, AuditResultFailed, err.Error())
+
+					j.Prometheus.MetricErrors.With(prometheus.Labels{
 						"subscriptionID": to.StringLower(subscription.SubscriptionID),
-						"resourceID":     to.StringLower(resourceGroup.ID),
-						"resourceGroup":  to.StringLower(resourceGroup.Name),
 						"resourceType":   strings.ToLower(resourceType),
-					}
-					labels = j.Azure.ResourceTagManager.AddResourceTagsToPrometheusLabels(ctx, labels, *resourceGroup.ID)
-					resourceTtl.AddTime(labels, *resourceExpiryTime)
-				}
-
-				if !j.Conf.DryRun && resourceTagUpdateNeeded {
-					resourceLogger.Infof("tag update needed, updating resource")
-					resourceGroupOpts := armresources.ResourceGroupPatchable{
-						Tags: resourceGroup.Tags,
-					}
-
-					if _, err := client.Update(ctx, *resourceGroup.Name, resourceGroupOpts, nil); err == nil {
-						// successfully deleted
-						resourceLogger.Infof("successfully updated")
-					} else {
-						// failed delete
-						resourceLogger.Error(err.Error())
-
-						j.Prometheus.MetricErrors.With(prometheus.Labels{
-							"subscriptionID": to.StringLower(subscription.SubscriptionID),
-							"resourceType":   strings.ToLower(resourceType),
-						}).Inc()
-					}
+					}).Inc()
 				}
+			}
+		}
 
-				if !j.Conf.DryRun && resourceExpired {
-					resourceLogger.Infof("expired, trying to delete")
-					if _, err := client.BeginDelete(ctx, *resourceGroup.Name, nil); err == nil {
-						// successfully deleted
-						resourceLogger.Infof("successfully deleted")
-
-						j.Prometheus.MetricDeletedResource.With(prometheus.Labels{
-							"subscriptionID": to.StringLower(subscription.SubscriptionID),
-							"resourceType":   strings.ToLower(resourceType),
-						}).Inc()
-					} else {
-						// failed delete
-						resourceLogger.Error(err.Error())
-
-						j.Prometheus.MetricErrors.With(prometheus.Labels{
-							"subscriptionID": to.StringLower(subscription.SubscriptionID),
-							"resourceType":   strings.ToLower(resourceType),
-						}).Inc()
-					}
-				}
+		if resourceExpired {
+			expiredItem := PlanItem{
+				ResourceID:     to.String(resourceGroup.ID),
+				Kind:           PlanKindResourceGroup,
+				SubscriptionID: to.String(subscription.SubscriptionID),
+				Rule:           rule.Name,
+				Reason:         resourceExpiryReason,
+				ExpiryTime:     resourceExpiryTime,
+				Action:         planActionForRule(rule),
+			}
+			j.protectPlanItem(ctx, resourceLogger, &expiredItem, resourceGroup.Tags)
+			j.plan.Add(expiredItem)
+
+			switch {
+			case expiredItem.Action == PlanActionProtected:
+				resourceLogger.Infof("expired, but protected by %s", expiredItem.Protection)
+				j.writeAuditEvent(ctx, resourceLogger, expiredItem, resourceGroup.Tags, AuditResultSkipped, AuditSkipReasonProtected)
+			case j.Conf.DryRun:
+				resourceLogger.Infof("expired, but dryrun active")
+				j.writeAuditEvent(ctx, resourceLogger, expiredItem, resourceGroup.Tags, AuditResultSkipped, AuditSkipReasonDryRun)
+			case rule.Action == config.PolicyActionReport:
+				resourceLogger.Infof("expired, but rule action is report only")
+				j.writeAuditEvent(ctx, resourceLogger, expiredItem, resourceGroup.Tags, AuditResultSkipped, AuditSkipReasonReportOnly)
+			default:
+				resourceLogger.Infof("expired, trying to delete")
+				deletions = append(deletions, orderedDeletion{logger: resourceLogger, deletion: deletion{
+					subscriptionID: to.StringLower(subscription.SubscriptionID),
+					resourceType:   strings.ToLower(resourceType),
+					planItem:       expiredItem,
+					tags:           resourceGroup.Tags,
+					begin: func(ctx context.Context) (func(ctx context.Context) error, error) {
+						poller, err := client.BeginDelete(ctx, *resourceGroup.Name, nil)
+						if err != nil {
+							return nil, err
+						}
+						return waitForPoller(j, poller), nil
+					},
+				}})
 			}
 		}
+	})
+	if err != nil {
+		return err
 	}
 
+	// resourceGroups don't depend on each other, all deletions are executed in parallel
+	j.runDeletionLevel(ctx, deletions, deletionLevelOptions{})
+
 	callback <- func() {
 		resourceTtl.GaugeSet(j.Prometheus.MetricTtlResources)
 	}
+
+	return nil
 }
@@ -3,7 +3,9 @@ package janitor
 import (
 	"context"
 	"log/slog"
+	"maps"
 	"strings"
+	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armsubscriptions"
@@ -12,108 +14,185 @@ import (
 	"github.com/webdevops/go-common/log/slogger"
 	prometheusCommon "github.com/webdevops/go-common/prometheus"
 	"github.com/webdevops/go-common/utils/to"
+
+	"github.com/webdevops/azure-janitor/config"
 )
 
-func (j *Janitor) runResources(ctx context.Context, logger *slogger.Logger, subscription *armsubscriptions.Subscription, filter string, callback chan<- func()) {
+func (j *Janitor) runResources(ctx context.Context, logger *slogger.Logger, subscription *armsubscriptions.Subscription, filter *ListFilter, callback chan<- func()) error {
 	contextLogger := logger.With(slog.String("task", "resource"))
 
-	client, err := armresources.NewClient(*subscription.SubscriptionID, j.Azure.Client.GetCred(), j.Azure.Client.NewArmClientOptions())
+	client, err := armresources.NewClient(*subscription.SubscriptionID, j.Azure.ClientProvider.GetCred(), j.Azure.ClientProvider.NewArmClientOptions())
+	if err != nil {
+		return err
+	}
+
+	tagsClient, err := armresources.NewTagsClient(*subscription.SubscriptionID, j.Azure.ClientProvider.GetCred(), j.Azure.ClientProvider.NewArmClientOptions())
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	resourceTtl := prometheusCommon.NewMetricsList()
 
-	pager := client.NewListPager(nil)
-	for pager.More() {
-		result, err := pager.NextPage(ctx)
-		if err != nil {
-			panic(err)
+	// expired resources are deleted after the listing (ordered by dependencies)
+	deletions := []orderedDeletion{}
+
+	err = j.forEachResource(ctx, contextLogger, subscription, client, filter, func(resource *armresources.GenericResourceExpanded) {
+		resourceType := *resource.Type
+		azureResource, _ := armclient.ParseResourceId(*resource.ID)
+
+		if !filter.Matches(FilterObject{
+			Name:          to.String(resource.Name),
+			ResourceType:  resourceType,
+			Location:      to.String(resource.Location),
+			ResourceGroup: azureResource.ResourceGroup,
+			Tags:          resource.Tags,
+		}) || !j.resourceSelector.Matches(resource) {
+			return
 		}
 
-		for _, resource := range result.Value {
-			resourceType := *resource.Type
-			resourceTypeApiVersion := j.getAzureApiVersionForResourceType(*subscription.SubscriptionID, to.String(resource.Location), resourceType)
+		resourceTypeApiVersion := j.getAzureApiVersionForResourceType(ctx, contextLogger, *subscription.SubscriptionID, to.String(resource.Location), resourceType)
 
-			resourceLogger := contextLogger.With(
-				slog.String("resource", to.String(resource.ID)),
-				slog.String("location", to.String(resource.Location)),
-				slog.String("apiVersion", resourceTypeApiVersion),
-			)
+		resourceLogger := contextLogger.With(
+			slog.String("resource", to.String(resource.ID)),
+			slog.String("location", to.String(resource.Location)),
+			slog.String("apiVersion", resourceTypeApiVersion),
+		)
 
-			if resourceTypeApiVersion == "" {
-				resourceLogger.Errorf("unable to detect apiVersion for Azure resource, cannot delete resource (please report this issue as bug)")
+		rule := j.Policy.Match(to.String(subscription.SubscriptionID), azureResource.ResourceGroup, resourceType, to.String(resource.Location))
+		if rule == nil {
+			resourceLogger.Debug("no matching policy rule found")
+			return
+		}
+		resourceLogger = resourceLogger.With(slog.String("rule", rule.Name))
 
-				j.Prometheus.MetricErrors.With(prometheus.Labels{
-					"subscriptionID": to.StringLower(subscription.SubscriptionID),
-					"resourceType":   strings.ToLower(resourceType),
-				}).Inc()
+		if resource.Tags == nil {
+			resource.Tags = map[string]*string{}
+		}
+		originalTags := maps.Clone(resource.Tags)
 
-				continue
-			}
+		resourceExpiryTime, resourceExpired, resourceTagUpdateNeeded := j.checkAzureResourceExpiry(resourceLogger, rule, resourceType, *resource.ID, resource.CreatedTime, &resource.Tags)
 
-			if resource.Tags != nil {
-				resourceExpiryTime, resourceExpired, resourceTagUpdateNeeded := j.checkAzureResourceExpiry(resourceLogger, resourceType, *resource.ID, &resource.Tags)
+		// age limits of rule win if they expire earlier
+		resourceExpiryReason := PlanReasonTtlExpired
+		timestamps := resourceTimestamps{CreatedTime: resource.CreatedTime, ChangedTime: resource.ChangedTime}
+		if ageExpiryTime, ageReason := j.checkAzureResourceAge(resourceLogger, rule, *resource.ID, timestamps); ageExpiryTime != nil && (resourceExpiryTime == nil || ageExpiryTime.Before(*resourceExpiryTime)) {
+			resourceExpiryTime = ageExpiryTime
+			resourceExpired = ageExpiryTime.Before(time.Now())
+			resourceExpiryReason = ageReason
+		}
 
-				azureResource, _ := armclient.ParseResourceId(*resource.ID)
+		if resourceExpiryTime != nil {
+			labels := prometheus.Labels{
+				"subscriptionID": to.StringLower(subscription.SubscriptionID),
+				"resourceID":     to.StringLower(resource.ID),
+				"resourceGroup":  azureResource.ResourceGroup,
+				"resourceType":   azureResource.ResourceType,
+			}
+			labels = j.addResourceTagsToPrometheusLabels(ctx, labels, *resource.ID)
+			resourceTtl.AddTime(labels, *resourceExpiryTime)
+		}
 
-				if resourceExpiryTime != nil {
-					labels := prometheus.Labels{
-						"subscriptionID": to.StringLower(subscription.SubscriptionID),
-						"resourceID":     to.StringLower(resource.ID),
-						"resourceGroup":  azureResource.ResourceGroup,
-						"resourceType":   azureResource.ResourceType,
-					}
-					labels = j.Azure.ResourceTagManager.AddResourceTagsToPrometheusLabels(ctx, labels, *resource.ID)
-					resourceTtl.AddTime(labels, *resourceExpiryTime)
-				}
+		if resourceExpiryTime != nil && !resourceExpired && rule.Action == config.PolicyActionDelete && !j.hasProtectionTag(resource.Tags) {
+			j.addExpiryWarning(ExpiryWarning{
+				ResourceID:     to.String(resource.ID),
+				Kind:           PlanKindResource,
+				SubscriptionID: to.String(subscription.SubscriptionID),
+				Rule:           rule.Name,
+				ExpiryTime:     *resourceExpiryTime,
+			}, resource.Tags)
+		}
 
-				if !j.Conf.DryRun && resourceTagUpdateNeeded {
-					resourceLogger.Infof("tag update needed, updating resource")
-					resourceOpts := armresources.GenericResource{
-						Name: resource.Name,
-						Tags: resource.Tags,
-					}
-
-					if _, err := client.BeginUpdateByID(ctx, *resource.ID, resourceTypeApiVersion, resourceOpts, nil); err == nil {
-						// successfully deleted
-						resourceLogger.Infof("successfully updated")
-					} else {
-						// failed delete
-						resourceLogger.Errorf("ERROR %s", err)
-
-						j.Prometheus.MetricErrors.With(prometheus.Labels{
-							"subscriptionID": *subscription.SubscriptionID,
-							"resourceType":   resourceType,
-						}).Inc()
-					}
+		if resourceTagUpdateNeeded && rule.Action == config.PolicyActionDelete && !j.hasProtectionTag(resource.Tags) {
+			tagUpdateItem := PlanItem{
+				ResourceID:     to.String(resource.ID),
+				Kind:           PlanKindResource,
+				SubscriptionID: to.String(subscription.SubscriptionID),
+				Rule:           rule.Name,
+				Reason:         PlanReasonTtlDuration,
+				ExpiryTime:     resourceExpiryTime,
+				Action:         PlanActionUpdateTags,
+			}
+			j.plan.Add(tagUpdateItem)
+
+			if j.Conf.DryRun {
+				j.writeAuditEvent(ctx, resourceLogger, tagUpdateItem, resource.Tags, AuditResultSkipped, AuditSkipReasonDryRun)
+			} else {
+				resourceLogger.Infof("tag update needed, updating resource")
+				if err := j.updateTagsAtScope(ctx, tagsClient, *resource.ID, originalTags, resource.Tags); err == nil {
+					// successfully updated
+					resourceLogger.Infof("successfully updated")
+					j.writeAuditEvent(ctx, resourceLogger, tagUpdateItem, resource.Tags, AuditResultSuccess, "")
+				} else {
+					// failed update
+					resourceLogger.Errorf("ERROR %s", err)
+					j.writeAuditEvent(ctx, resourceLogger, tagUpdateItem, resource.Tags, AuditResultFailed, err.Error())
+
+					j.Prometheus.MetricErrors.With(prometheus.Labels{
+						"subscriptionID": *subscription.SubscriptionID,
+						"resourceType":   resourceType,
+					}).Inc()
 				}
+			}
+		}
 
-				if !j.Conf.DryRun && resourceExpired {
-					resourceLogger.Infof("expired, trying to delete")
-					if _, err := client.BeginDeleteByID(ctx, *resource.ID, resourceTypeApiVersion, nil); err == nil {
-						// successfully deleted
-						resourceLogger.Infof("successfully deleted")
-
-						j.Prometheus.MetricDeletedResource.With(prometheus.Labels{
-							"subscriptionID": *subscription.SubscriptionID,
-							"resourceType":   resourceType,
-						}).Inc()
-					} else {
-						// failed delete
-						resourceLogger.Errorf("ERROR %s", err)
-
-						j.Prometheus.MetricErrors.With(prometheus.Labels{
-							"subscriptionID": *subscription.SubscriptionID,
-							"resourceType":   resourceType,
-						}).Inc()
-					}
-				}
+		if resourceExpired {
+			expiredItem := PlanItem{
+				ResourceID:     to.String(resource.ID),
+				Kind:           PlanKindResource,
+				SubscriptionID: to.String(subscription.SubscriptionID),
+				Rule:           rule.Name,
+				Reason:         resourceExpiryReason,
+				ExpiryTime:     resourceExpiryTime,
+				Action:         planActionForRule(rule),
+			}
+			j.protectPlanItem(ctx, resourceLogger, &expiredItem, resource.Tags)
+			j.plan.Add(expiredItem)
+
+			switch {
+			case expiredItem.Action == PlanActionProtected:
+				resourceLogger.Infof("expired, but protected by %s", expiredItem.Protection)
+				j.writeAuditEvent(ctx, resourceLogger, expiredItem, resource.Tags, AuditResultSkipped, AuditSkipReasonProtected)
+			case j.Conf.DryRun:
+				resourceLogger.Infof("expired, but dryrun active")
+				j.writeAuditEvent(ctx, resourceLogger, expiredItem, resource.Tags, AuditResultSkipped, AuditSkipReasonDryRun)
+			case rule.Action == config.PolicyActionReport:
+				resourceLogger.Infof("expired, but rule action is report only")
+				j.writeAuditEvent(ctx, resourceLogger, expiredItem, resource.Tags, AuditResultSkipped, AuditSkipReasonReportOnly)
+			case resourceTypeApiVersion == "":
+				resourceLogger.Errorf("unable to detect apiVersion for Azure resource, cannot delete resource (please report this issue as bug)")
+				j.writeAuditEvent(ctx, resourceLogger, expiredItem, resource.Tags, AuditResultFailed, "unable to detect apiVersion")
+
+				j.Prometheus.MetricErrors.With(prometheus.Labels{
+					"subscriptionID": to.StringLower(subscription.SubscriptionID),
+					"resourceType":   strings.ToLower(resourceType),
+				}).Inc()
+			default:
+				resourceLogger.Infof("expired, queued for deletion")
+				deletions = append(deletions, orderedDeletion{logger: resourceLogger, deletion: deletion{
+					subscriptionID: *subscription.SubscriptionID,
+					resourceType:   resourceType,
+					planItem:       expiredItem,
+					tags:           resource.Tags,
+					begin: func(ctx context.Context) (func(ctx context.Context) error, error) {
+						poller, err := client.BeginDeleteByID(ctx, *resource.ID, resourceTypeApiVersion, nil)
+						if err != nil {
+							return nil, err
+						}
+						return waitForPoller(j, poller), nil
+					},
+				}})
 			}
 		}
+	})
+	if err != nil {
+		return err
 	}
 
+	j.runOrderedDeletions(ctx, deletions)
+
 	callback <- func() {
 		resourceTtl.GaugeSet(j.Prometheus.MetricTtlResources)
 	}
+
+	return nil
 }
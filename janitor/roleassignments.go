@@ -3,7 +3,9 @@ package janitor
 import (
 	"context"
 	"log/slog"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	armauthorization "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
@@ -15,115 +17,327 @@ import (
 	"github.com/webdevops/go-common/utils/to"
 )
 
-func (j *Janitor) runRoleAssignments(ctx context.Context, logger *slogger.Logger, subscription *armsubscriptions.Subscription, filter string, callback chan<- func()) {
+const (
+	// roleAssignmentManagementGroupScopePrefix is the (lowercase) scope prefix of management groups
+	roleAssignmentManagementGroupScopePrefix = "/providers/microsoft.management/managementgroups/"
+)
+
+type (
+	// scopedRoleAssignment is a roleAssignment and the scope it was listed on
+	scopedRoleAssignment struct {
+		scope          string
+		roleAssignment *armauthorization.RoleAssignment
+	}
+
+	// roleAssignmentSet contains the roleAssignments processed in the current run (by lowercase id), shared by all
+	// subscriptions and management group scopes as their listings overlap (eg. inherited roleAssignments)
+	roleAssignmentSet struct {
+		lock sync.Mutex
+		ids  map[string]struct{}
+	}
+)
+
+func newRoleAssignmentSet() *roleAssignmentSet {
+	return &roleAssignmentSet{
+		ids: map[string]struct{}{},
+	}
+}
+
+// add marks the roleAssignment as processed, returns false if it has already been processed in the current run
+func (s *roleAssignmentSet) add(roleAssignmentId string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	roleAssignmentId = strings.ToLower(roleAssignmentId)
+	if _, exists := s.ids[roleAssignmentId]; exists {
+		return false
+	}
+	s.ids[roleAssignmentId] = struct{}{}
+	return true
+}
+
+func (j *Janitor) runRoleAssignments(ctx context.Context, logger *slogger.Logger, subscription *armsubscriptions.Subscription, filter string, callback chan<- func()) error {
 	contextLogger := logger.With(slog.String("task", "roleAssignment"))
 
-	resourceTtl := prometheusCommon.NewMetricsList()
-	resourceType := "Microsoft.Authorization/roleAssignments"
+	scopes := j.roleAssignmentSubscriptionScopes(subscription)
+	if len(scopes) == 0 {
+		contextLogger.Debug("no roleAssignment scopes configured for subscription, skipping")
+		return nil
+	}
 
-	client, err := armauthorization.NewRoleAssignmentsClient(*subscription.SubscriptionID, j.Azure.Client.GetCred(), j.Azure.Client.NewArmClientOptions())
+	client, err := armauthorization.NewRoleAssignmentsClient(*subscription.SubscriptionID, j.Azure.ClientProvider.GetCred(), j.Azure.ClientProvider.NewArmClientOptions())
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	pager := client.NewListForScopePager(*subscription.ID, nil)
-	for pager.More() {
-		result, err := pager.NextPage(ctx)
+	// scopes might overlap (eg. subscription and resourceGroup or inherited roleAssignments of other subscriptions and
+	// management groups), each roleAssignment is only processed once per run
+	roleAssignments := []scopedRoleAssignment{}
+	for _, scope := range scopes {
+		err = j.forEachRoleAssignment(ctx, subscription, client, scope, func(roleAssignment *armauthorization.RoleAssignment) {
+			if !j.processedRoleAssignments.add(to.String(roleAssignment.ID)) {
+				return
+			}
+			roleAssignments = append(roleAssignments, scopedRoleAssignment{scope: scope, roleAssignment: roleAssignment})
+		})
 		if err != nil {
-			panic(err)
+			return err
 		}
+	}
 
-		for _, roleAssignment := range result.Value {
-			if roleAssignment.Properties.RoleDefinitionID == nil || roleAssignment.Properties.CreatedOn == nil {
-				continue
+	return j.processRoleAssignments(ctx, contextLogger, to.String(subscription.SubscriptionID), client, roleAssignments, callback)
+}
+
+// runScopeRoleAssignments cleans up the roleAssignments of the configured management group scopes
+// (once per run, independent of subscriptions and before them, so roleAssignments of management groups are handled
+// on their own scope and not as inherited roleAssignments of subscriptions). Failures are recorded per scope.
+func (j *Janitor) runScopeRoleAssignments(ctx context.Context, logger *slogger.Logger, callback chan<- func()) {
+	scopes := []string{}
+	for _, scope := range j.Conf.Janitor.RoleAssignments.Scopes {
+		if strings.HasPrefix(strings.ToLower(scope), roleAssignmentManagementGroupScopePrefix) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return
+	}
+
+	contextLogger := logger.With(slog.String("task", "roleAssignment"))
+	resourceType := "Microsoft.Authorization/roleAssignments"
+
+	client, err := armauthorization.NewRoleAssignmentsClient("", j.Azure.ClientProvider.GetCred(), j.Azure.ClientProvider.NewArmClientOptions())
+	if err != nil {
+		j.recordRunError(contextLogger, "", PlanKindRoleAssignment, resourceType, err)
+		return
+	}
+
+	roleAssignments := []scopedRoleAssignment{}
+	for _, scope := range scopes {
+		scopeRoleAssignments := []scopedRoleAssignment{}
+		pager := client.NewListForScopePager(scope, nil)
+		for pager.More() {
+			result, err := pager.NextPage(ctx)
+			if err != nil {
+				j.recordRunError(contextLogger.With(slog.String("roleAssignmentScope", scope)), "", PlanKindRoleAssignment, resourceType, err)
+				scopeRoleAssignments = nil
+				break
 			}
 
-			azureResource, _ := armclient.ParseResourceId(*roleAssignment.Properties.Scope)
-
-			roleAssignmentLogger := contextLogger.With(
-				slog.String("roleAssignmentId", to.StringLower(roleAssignment.ID)),
-				slog.String("scope", to.StringLower(roleAssignment.Properties.Scope)),
-				slog.String("principalId", to.StringLower(roleAssignment.Properties.PrincipalID)),
-				slog.String("principalType", strings.ToLower(string(*roleAssignment.Properties.PrincipalType))),
-				slog.String("roleDefinitionId", to.StringLower(roleAssignment.Properties.RoleDefinitionID)),
-				slog.String("subscriptionID", to.StringLower(subscription.SubscriptionID)),
-				slog.String("resourceGroup", azureResource.ResourceGroup),
-			)
-
-			// check if roleAssignment is allowed for cleanup
-			// do not want to touch other RoleAssignments
-			if j.isRoleAssignmentCleanupAllowed(roleAssignment) {
-				var roleAssignmentTtl *time.Duration
-				roleAssignmentLogger.Debug("checking ttl")
-
-				// detect ttl from description
-				if j.Conf.Janitor.RoleAssignments.DescriptionTtlRegExp != nil && roleAssignment.Properties.Description != nil {
-					descriptionTtlMatch := j.Conf.Janitor.RoleAssignments.DescriptionTtlRegExp.FindSubmatch([]byte(*roleAssignment.Properties.Description))
-
-					if len(descriptionTtlMatch) >= 2 {
-						if v, err := j.parseExpiryDuration(string(descriptionTtlMatch[1])); err == nil {
-							roleAssignmentTtl = v
-						}
-					}
-				}
-
-				// use default ttl if no ttl was detected or ttl is higher then default
-				if roleAssignmentTtl == nil || roleAssignmentTtl.Seconds() > j.Conf.Janitor.RoleAssignments.Ttl.Seconds() {
-					roleAssignmentTtl = &j.Conf.Janitor.RoleAssignments.Ttl
-				}
-
-				// calculate expiry and check if already expired
-				roleAssignmentExpiry := roleAssignment.Properties.CreatedOn.UTC().Add(*roleAssignmentTtl)
-				roleAssignmentExpired := time.Now().After(roleAssignmentExpiry)
-
-				roleAssignmentLogger.Debugf("detected ttl %v", roleAssignmentTtl.String())
-
-				resourceTtl.AddTime(prometheus.Labels{
-					"roleAssignmentId": to.StringLower(roleAssignment.ID),
-					"scope":            to.StringLower(roleAssignment.Properties.Scope),
-					"principalId":      to.StringLower(roleAssignment.Properties.PrincipalID),
-					"principalType":    to.StringLower(roleAssignment.Type),
-					"roleDefinitionId": to.StringLower(roleAssignment.Properties.RoleDefinitionID),
-					"subscriptionID":   to.StringLower(subscription.SubscriptionID),
-					"resourceGroup":    azureResource.ResourceGroup,
-				}, roleAssignmentExpiry)
-
-				if roleAssignmentExpired {
-					if !j.Conf.DryRun {
-						roleAssignmentLogger.Infof("expired, trying to delete")
-						if _, err := client.DeleteByID(ctx, to.String(roleAssignment.ID), nil); err == nil {
-							// successfully deleted
-							roleAssignmentLogger.Infof("successfully deleted")
-
-							j.Prometheus.MetricDeletedResource.With(prometheus.Labels{
-								"subscriptionID": to.StringLower(subscription.SubscriptionID),
-								"resourceType":   strings.ToLower(resourceType),
-							}).Inc()
-						} else {
-							// failed delete
-							roleAssignmentLogger.Error(err.Error())
-
-							j.Prometheus.MetricErrors.With(prometheus.Labels{
-								"subscriptionID": to.StringLower(subscription.SubscriptionID),
-								"resourceType":   strings.ToLower(resourceType),
-							}).Inc()
-						}
-					} else {
-						roleAssignmentLogger.Infof("expired, but dryrun active")
-					}
-				} else {
-					roleAssignmentLogger.Debug("NOT expired")
-				}
+			for _, roleAssignment := range result.Value {
+				scopeRoleAssignments = append(scopeRoleAssignments, scopedRoleAssignment{scope: scope, roleAssignment: roleAssignment})
 			}
 		}
+
+		for _, item := range scopeRoleAssignments {
+			if j.processedRoleAssignments.add(to.String(item.roleAssignment.ID)) {
+				roleAssignments = append(roleAssignments, item)
+			}
+		}
+	}
+
+	if err := j.processRoleAssignments(ctx, contextLogger, "", client, roleAssignments, callback); err != nil {
+		j.recordRunError(contextLogger, "", PlanKindRoleAssignment, resourceType, err)
+	}
+}
+
+// processRoleAssignments runs the ttl cleanup and the orphaned roleAssignment detection (if enabled) for the
+// listed roleAssignments and sends the metrics to the callback
+func (j *Janitor) processRoleAssignments(ctx context.Context, logger *slogger.Logger, subscriptionId string, client *armauthorization.RoleAssignmentsClient, roleAssignments []scopedRoleAssignment, callback chan<- func()) error {
+	var err error
+
+	resourceTtl := prometheusCommon.NewMetricsList()
+	orphanedMetric := prometheusCommon.NewMetricsList()
+
+	// roleAssignments deleted because of their ttl are not checked again
+	expired := map[string]bool{}
+	if j.Conf.Janitor.RoleAssignments.Enable {
+		for _, item := range roleAssignments {
+			scopeLogger := logger.With(slog.String("roleAssignmentScope", item.scope))
+			if j.processRoleAssignment(ctx, scopeLogger, subscriptionId, item.scope, client, item.roleAssignment, resourceTtl) {
+				expired[to.StringLower(item.roleAssignment.ID)] = true
+			}
+		}
+	}
+
+	if j.Conf.Janitor.RoleAssignmentsOrphaned.Enable {
+		candidates := []scopedRoleAssignment{}
+		for _, item := range roleAssignments {
+			if !expired[to.StringLower(item.roleAssignment.ID)] {
+				candidates = append(candidates, item)
+			}
+		}
+		err = j.processOrphanedRoleAssignments(ctx, logger, subscriptionId, client, candidates, orphanedMetric)
 	}
 
 	callback <- func() {
-		resourceTtl.GaugeSet(j.Prometheus.MetricTtlRoleAssignments)
+		if j.Conf.Janitor.RoleAssignments.Enable {
+			resourceTtl.GaugeSet(j.Prometheus.MetricTtlRoleAssignments)
+		}
+		if j.Conf.Janitor.RoleAssignmentsOrphaned.Enable {
+			orphanedMetric.GaugeSet(j.Prometheus.MetricOrphanedRoleAssignments)
+		}
 	}
+
+	return err
 }
 
-func (j *Janitor) isRoleAssignmentCleanupAllowed(roleAssignment *armauthorization.RoleAssignment) bool {
+// roleAssignmentSubscriptionScopes returns the scopes for listing the roleAssignments of the subscription:
+// the subscription itself if no scopes are configured, otherwise the configured scopes inside the subscription
+func (j *Janitor) roleAssignmentSubscriptionScopes(subscription *armsubscriptions.Subscription) []string {
+	if len(j.Conf.Janitor.RoleAssignments.Scopes) == 0 {
+		return []string{to.String(subscription.ID)}
+	}
+
+	scopes := []string{}
+	for _, scope := range j.Conf.Janitor.RoleAssignments.Scopes {
+		if isScopeWithin(to.String(subscription.ID), scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// processRoleAssignment calculates the expiry of the roleAssignment (listed on scope) and deletes it if expired,
+// returns true if the roleAssignment is expired
+func (j *Janitor) processRoleAssignment(ctx context.Context, logger *slogger.Logger, subscriptionId, scope string, client *armauthorization.RoleAssignmentsClient, roleAssignment *armauthorization.RoleAssignment, resourceTtl *prometheusCommon.MetricList) bool {
+	resourceType := "Microsoft.Authorization/roleAssignments"
+
+	if roleAssignment.Properties == nil || roleAssignment.Properties.RoleDefinitionID == nil || roleAssignment.Properties.CreatedOn == nil {
+		return false
+	}
+
+	azureResource, _ := armclient.ParseResourceId(to.String(roleAssignment.Properties.Scope))
+
+	roleAssignmentLogger := logger.With(
+		slog.String("roleAssignmentId", to.StringLower(roleAssignment.ID)),
+		slog.String("scope", to.StringLower(roleAssignment.Properties.Scope)),
+		slog.String("principalId", to.StringLower(roleAssignment.Properties.PrincipalID)),
+		slog.String("principalType", strings.ToLower(roleAssignmentPrincipalType(roleAssignment))),
+		slog.String("roleDefinitionId", to.StringLower(roleAssignment.Properties.RoleDefinitionID)),
+		slog.String("subscriptionID", strings.ToLower(subscriptionId)),
+		slog.String("resourceGroup", azureResource.ResourceGroup),
+	)
+
+	// check if roleAssignment is allowed for cleanup
+	// do not want to touch other RoleAssignments
+	if !j.isRoleAssignmentCleanupAllowed(roleAssignment, scope) {
+		return false
+	}
+
+	var roleAssignmentTtl *time.Duration
+	roleAssignmentLogger.Debug("checking ttl")
+
+	// detect ttl from description
+	if j.Conf.Janitor.RoleAssignments.DescriptionTtlRegExp != nil && roleAssignment.Properties.Description != nil {
+		descriptionTtlMatch := j.Conf.Janitor.RoleAssignments.DescriptionTtlRegExp.FindSubmatch([]byte(*roleAssignment.Properties.Description))
+
+		if len(descriptionTtlMatch) >= 2 {
+			if v, err := j.parseExpiryDuration(string(descriptionTtlMatch[1])); err == nil {
+				roleAssignmentTtl = v
+			}
+		}
+	}
+
+	// use default ttl if no ttl was detected or ttl is higher then default
+	if roleAssignmentTtl == nil || roleAssignmentTtl.Seconds() > j.Conf.Janitor.RoleAssignments.Ttl.Seconds() {
+		roleAssignmentTtl = &j.Conf.Janitor.RoleAssignments.Ttl
+	}
+
+	// calculate expiry and check if already expired
+	roleAssignmentExpiry := roleAssignment.Properties.CreatedOn.UTC().Add(*roleAssignmentTtl)
+	roleAssignmentExpired := time.Now().After(roleAssignmentExpiry)
+
+	roleAssignmentLogger.Debugf("detected ttl %v", roleAssignmentTtl.String())
+
+	resourceTtl.AddTime(prometheus.Labels{
+		"roleAssignmentId": to.StringLower(roleAssignment.ID),
+		"scope":            to.StringLower(roleAssignment.Properties.Scope),
+		"principalId":      to.StringLower(roleAssignment.Properties.PrincipalID),
+		"principalType":    to.StringLower(roleAssignment.Type),
+		"roleDefinitionId": to.StringLower(roleAssignment.Properties.RoleDefinitionID),
+		"subscriptionID":   strings.ToLower(subscriptionId),
+		"resourceGroup":    azureResource.ResourceGroup,
+	}, roleAssignmentExpiry)
+
+	if roleAssignmentExpired {
+		roleAssignmentItem := PlanItem{
+			ResourceID:     to.String(roleAssignment.ID),
+			Kind:           PlanKindRoleAssignment,
+			SubscriptionID: subscriptionId,
+			Reason:         PlanReasonRoleAssignmentTtl,
+			ExpiryTime:     &roleAssignmentExpiry,
+			Action:         PlanActionDelete,
+		}
+		j.plan.Add(roleAssignmentItem)
+
+		if !j.Conf.DryRun {
+			roleAssignmentLogger.Infof("expired, trying to delete")
+			j.runDeletion(ctx, roleAssignmentLogger, deletion{
+				subscriptionID: strings.ToLower(subscriptionId),
+				resourceType:   strings.ToLower(resourceType),
+				planItem:       roleAssignmentItem,
+				begin: func(ctx context.Context) (func(ctx context.Context) error, error) {
+					// role assignments are deleted synchronously
+					_, err := client.DeleteByID(ctx, to.String(roleAssignment.ID), nil)
+					return nil, err
+				},
+			})
+		} else {
+			roleAssignmentLogger.Infof("expired, but dryrun active")
+			j.writeAuditEvent(ctx, roleAssignmentLogger, roleAssignmentItem, nil, AuditResultSkipped, AuditSkipReasonDryRun)
+		}
+	} else {
+		roleAssignmentLogger.Debug("NOT expired")
+
+		j.addExpiryWarning(ExpiryWarning{
+			ResourceID:     to.String(roleAssignment.ID),
+			Kind:           PlanKindRoleAssignment,
+			SubscriptionID: subscriptionId,
+			ExpiryTime:     roleAssignmentExpiry,
+		}, nil)
+	}
+
+	return roleAssignmentExpired
+}
+
+// isRoleAssignmentCleanupAllowed checks the roleDefinition, the principal filters and (if enabled) if the
+// roleAssignment was made directly at the listed scope
+func (j *Janitor) isRoleAssignmentCleanupAllowed(roleAssignment *armauthorization.RoleAssignment, scope string) bool {
+	return j.isRoleAssignmentSelected(roleAssignment, scope) && j.isRoleAssignmentRoleDefinitionAllowed(roleAssignment)
+}
+
+// isRoleAssignmentSelected checks the principal filters and (if enabled) if the roleAssignment was made directly
+// at the listed scope
+func (j *Janitor) isRoleAssignmentSelected(roleAssignment *armauthorization.RoleAssignment, scope string) bool {
+	conf := j.Conf.Janitor.RoleAssignments
+
+	if conf.AtScope && !strings.EqualFold(strings.TrimSuffix(to.String(roleAssignment.Properties.Scope), "/"), strings.TrimSuffix(scope, "/")) {
+		return false
+	}
+
+	if len(conf.PrincipalTypes) > 0 && !slices.ContainsFunc(conf.PrincipalTypes, func(principalType string) bool {
+		return strings.EqualFold(principalType, roleAssignmentPrincipalType(roleAssignment))
+	}) {
+		return false
+	}
+
+	principalID := to.StringLower(roleAssignment.Properties.PrincipalID)
+	if len(conf.PrincipalIds) > 0 && !slices.ContainsFunc(conf.PrincipalIds, func(check string) bool {
+		return strings.EqualFold(check, principalID)
+	}) {
+		return false
+	}
+	if slices.ContainsFunc(conf.PrincipalIdsExcluded, func(check string) bool {
+		return strings.EqualFold(check, principalID)
+	}) {
+		return false
+	}
+
+	return true
+}
+
+// isRoleAssignmentRoleDefinitionAllowed checks if the roleDefinition is one of the configured roleDefinitions
+func (j *Janitor) isRoleAssignmentRoleDefinitionAllowed(roleAssignment *armauthorization.RoleAssignment) bool {
 	roleDefinitionID := to.StringLower(roleAssignment.Properties.RoleDefinitionID)
 	for _, check := range j.Conf.Janitor.RoleAssignments.RoleDefintionIds {
 		// sanity check, do not allow empty IDs
@@ -138,3 +352,18 @@ func (j *Janitor) isRoleAssignmentCleanupAllowed(roleAssignment *armauthorizatio
 
 	return false
 }
+
+// roleAssignmentPrincipalType returns the principal type (eg. ServicePrincipal, User, Group) or empty if unknown
+func roleAssignmentPrincipalType(roleAssignment *armauthorization.RoleAssignment) string {
+	if roleAssignment.Properties == nil || roleAssignment.Properties.PrincipalType == nil {
+		return ""
+	}
+	return string(*roleAssignment.Properties.PrincipalType)
+}
+
+// isScopeWithin checks if the scope is the parent scope itself or one of its child scopes (case insensitive)
+func isScopeWithin(parent, scope string) bool {
+	parent = strings.TrimSuffix(strings.ToLower(parent), "/")
+	scope = strings.TrimSuffix(strings.ToLower(scope), "/")
+	return scope == parent || strings.HasPrefix(scope, parent+"/")
+}
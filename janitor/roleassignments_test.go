@@ -0,0 +1,127 @@
+package janitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	armauthorization "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/webdevops/go-common/utils/to"
+)
+
+func TestRoleAssignmentCleanupAllowed(t *testing.T) {
+	j := buildJanitorObj()
+	j.Conf.Janitor.RoleAssignments.RoleDefintionIds = []string{testRoleDefinitionId}
+
+	scope := "/subscriptions/" + testSubscriptionId
+	newRoleAssignment := func(scope, principalId string, principalType armauthorization.PrincipalType) *armauthorization.RoleAssignment {
+		return &armauthorization.RoleAssignment{
+			Properties: &armauthorization.RoleAssignmentProperties{
+				Scope:            to.StringPtr(scope),
+				PrincipalID:      to.StringPtr(principalId),
+				PrincipalType:    &principalType,
+				RoleDefinitionID: to.StringPtr(testRoleDefinitionId),
+			},
+		}
+	}
+
+	user := newRoleAssignment(scope, "user-1", armauthorization.PrincipalTypeUser)
+	group := newRoleAssignment(scope, "group-1", armauthorization.PrincipalTypeGroup)
+	child := newRoleAssignment(scope+"/resourceGroups/rg-test", "user-2", armauthorization.PrincipalTypeUser)
+
+	assumeState(t, "user allowed without filters", true, j.isRoleAssignmentCleanupAllowed(user, scope))
+	assumeState(t, "child scope allowed without atscope", true, j.isRoleAssignmentCleanupAllowed(child, scope))
+
+	j.Conf.Janitor.RoleAssignments.PrincipalTypes = []string{"user"}
+	assumeState(t, "user allowed by principal type", true, j.isRoleAssignmentCleanupAllowed(user, scope))
+	assumeState(t, "group allowed by principal type", false, j.isRoleAssignmentCleanupAllowed(group, scope))
+
+	j.Conf.Janitor.RoleAssignments.PrincipalIds = []string{"USER-1", "user-2"}
+	j.Conf.Janitor.RoleAssignments.PrincipalIdsExcluded = []string{"user-2"}
+	assumeState(t, "allowed principal", true, j.isRoleAssignmentCleanupAllowed(user, scope))
+	assumeState(t, "excluded principal", false, j.isRoleAssignmentCleanupAllowed(child, scope))
+
+	j.Conf.Janitor.RoleAssignments.PrincipalIdsExcluded = nil
+	j.Conf.Janitor.RoleAssignments.AtScope = true
+	assumeState(t, "assignment at scope allowed with atscope", true, j.isRoleAssignmentCleanupAllowed(user, scope+"/"))
+	assumeState(t, "child scope allowed with atscope", false, j.isRoleAssignmentCleanupAllowed(child, scope))
+}
+
+func TestRunRoleAssignmentsScopes(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddManagementGroup("mg-test", "")
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+	server.AddResourceGroup(testSubscriptionId, "rg-other", nil)
+
+	expired := time.Now().Add(-12 * time.Hour)
+	subscriptionScope := "/subscriptions/" + testSubscriptionId
+	managementGroupScope := "/providers/Microsoft.Management/managementGroups/mg-test"
+
+	groupId := server.AddRoleAssignment(managementGroupScope, "group", testRoleDefinitionId, armauthorization.PrincipalTypeServicePrincipal, expired, "")
+	resourceGroupId := server.AddRoleAssignment(subscriptionScope+"/resourceGroups/rg-test", "rg", testRoleDefinitionId, armauthorization.PrincipalTypeServicePrincipal, expired, "")
+	otherResourceGroupId := server.AddRoleAssignment(subscriptionScope+"/resourceGroups/rg-other", "rg-other", testRoleDefinitionId, armauthorization.PrincipalTypeServicePrincipal, expired, "")
+	childId := server.AddRoleAssignment(subscriptionScope+"/resourceGroups/rg-test/providers/Microsoft.Storage/storageAccounts/storage", "child", testRoleDefinitionId, armauthorization.PrincipalTypeServicePrincipal, expired, "")
+	inheritedId := server.AddRoleAssignment(subscriptionScope, "inherited", testRoleDefinitionId, armauthorization.PrincipalTypeServicePrincipal, expired, "")
+	userId := server.AddRoleAssignment(subscriptionScope+"/resourceGroups/rg-test", "user", testRoleDefinitionId, armauthorization.PrincipalTypeUser, expired, "")
+	excludedId := server.AddRoleAssignment(subscriptionScope+"/resourceGroups/rg-test", "excluded", testRoleDefinitionId, armauthorization.PrincipalTypeServicePrincipal, expired, "")
+	server.SetRoleAssignmentPrincipal(excludedId, "excluded-principal")
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.RoleAssignments.Enable = true
+	j.Conf.Janitor.RoleAssignments.Ttl = 6 * time.Hour
+	j.Conf.Janitor.RoleAssignments.RoleDefintionIds = []string{testRoleDefinitionId}
+	j.Conf.Janitor.RoleAssignments.Scopes = []string{managementGroupScope, subscriptionScope + "/resourceGroups/rg-test"}
+	j.Conf.Janitor.RoleAssignments.AtScope = true
+	j.Conf.Janitor.RoleAssignments.PrincipalTypes = []string{"ServicePrincipal"}
+	j.Conf.Janitor.RoleAssignments.PrincipalIdsExcluded = []string{"excluded-principal"}
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "managementGroup roleAssignment exists", false, server.Exists(groupId))
+	assumeState(t, "resourceGroup roleAssignment exists", false, server.Exists(resourceGroupId))
+	assumeState(t, "roleAssignment of other resourceGroup exists", true, server.Exists(otherResourceGroupId))
+	assumeState(t, "child roleAssignment exists", true, server.Exists(childId))
+	assumeState(t, "inherited roleAssignment exists", true, server.Exists(inheritedId))
+	assumeState(t, "user roleAssignment exists", true, server.Exists(userId))
+	assumeState(t, "excluded roleAssignment exists", true, server.Exists(excludedId))
+}
+
+func TestRunRoleAssignmentsOverlappingScopes(t *testing.T) {
+	secondSubscriptionId := "00000000-0000-0000-0000-000000000002"
+
+	server := buildFakeArmEnvironment(t)
+	server.AddSubscription(secondSubscriptionId, "second-subscription")
+	server.AddManagementGroup("mg-test", "")
+	server.SetSubscriptionManagementGroup(testSubscriptionId, "mg-test")
+	server.SetSubscriptionManagementGroup(secondSubscriptionId, "mg-test")
+
+	expired := time.Now().Add(-12 * time.Hour)
+	managementGroupScope := "/providers/Microsoft.Management/managementGroups/mg-test"
+	groupId := server.AddRoleAssignment(managementGroupScope, "group", testRoleDefinitionId, armauthorization.PrincipalTypeServicePrincipal, expired, "")
+	subscriptionId := server.AddRoleAssignment("/subscriptions/"+testSubscriptionId, "subscription", testRoleDefinitionId, armauthorization.PrincipalTypeServicePrincipal, expired, "")
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.RoleAssignments.Enable = true
+	j.Conf.Janitor.RoleAssignments.Ttl = 6 * time.Hour
+	j.Conf.Janitor.RoleAssignments.RoleDefintionIds = []string{testRoleDefinitionId}
+	j.Conf.Janitor.RoleAssignments.Scopes = []string{
+		managementGroupScope,
+		"/subscriptions/" + testSubscriptionId,
+		"/subscriptions/" + secondSubscriptionId,
+	}
+
+	// inherited roleAssignment is listed on all scopes, but only processed once
+	j.Conf.DryRun = true
+	j.runJanitor(context.Background(), j.Logger)
+	if val := j.GetPlan().ItemsByAction(PlanActionDelete); len(val) != 2 {
+		t.Fatalf(`expected 2 planned deletions, got: %v`, val)
+	}
+
+	j.Conf.DryRun = false
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "managementGroup roleAssignment exists", false, server.Exists(groupId))
+	assumeState(t, "subscription roleAssignment exists", false, server.Exists(subscriptionId))
+	if val := server.Requests("DELETE"); len(val) != 2 {
+		t.Fatalf(`expected 2 delete requests, got: %v`, val)
+	}
+}
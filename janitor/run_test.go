@@ -0,0 +1,379 @@
+package janitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	armauthorization "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/webdevops/azure-janitor/config"
+)
+
+const (
+	testSubscriptionId   = "00000000-0000-0000-0000-000000000001"
+	testRoleDefinitionId = "/subscriptions/00000000-0000-0000-0000-000000000001/providers/Microsoft.Authorization/roleDefinitions/00000000-0000-0000-0000-00000000abcd"
+)
+
+func buildFakeArmEnvironment(t *testing.T) *fakeArmServer {
+	t.Helper()
+
+	server := newFakeArmServer(t)
+	server.AddSubscription(testSubscriptionId, "test-subscription")
+	server.AddProvider(testSubscriptionId, "Microsoft.Storage", "storageAccounts", "2023-01-01")
+	return server
+}
+
+func TestRunResources(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	expiredId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "expired", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+	validId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "valid", map[string]string{
+		"ttl": time.Now().Add(1 * time.Hour).Format(time.RFC3339),
+	})
+	relativeId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "relative", map[string]string{
+		"ttl": "5d",
+	})
+	untaggedId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "untagged", nil)
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "expired resource exists", false, server.Exists(expiredId))
+	assumeState(t, "valid resource exists", true, server.Exists(validId))
+	assumeState(t, "relative resource exists", true, server.Exists(relativeId))
+	assumeState(t, "untagged resource exists", true, server.Exists(untaggedId))
+
+	if _, exists := server.Tags(relativeId)["ttl_expiry"]; !exists {
+		t.Fatalf(`expected tag "ttl_expiry" to be written for relative ttl, got: %v`, server.Tags(relativeId))
+	}
+
+	if val := testutil.CollectAndCount(j.Prometheus.MetricTtlResources); val != 3 {
+		t.Fatalf(`expected 3 resource ttl metrics, got: %v`, val)
+	}
+
+	if val := testutil.ToFloat64(j.Prometheus.MetricDeletedResource); val != 1 {
+		t.Fatalf(`expected 1 deleted resource, got: %v`, val)
+	}
+}
+
+func TestRunResourcesExtendExpiry(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	extendedId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "extended", map[string]string{
+		"ttl":        time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+		"ttl_extend": "1d",
+	})
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "extended resource exists", true, server.Exists(extendedId))
+
+	tags := server.Tags(extendedId)
+	if _, exists := tags["ttl_extend"]; exists {
+		t.Fatalf(`expected tag "ttl_extend" to be removed, got: %v`, tags)
+	}
+	if _, exists := tags["ttl_expiry"]; !exists {
+		t.Fatalf(`expected tag "ttl_expiry" to be written for extension, got: %v`, tags)
+	}
+
+	if val := len(j.GetPlan().ItemsByAction(PlanActionUpdateTags)); val != 1 {
+		t.Fatalf(`expected 1 tag update in plan, got: %v`, val)
+	}
+}
+
+func TestRunResourcesDryRun(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	expiredId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "expired", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.DryRun = true
+	j.Conf.Janitor.Resources.Enable = true
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "expired resource exists", true, server.Exists(expiredId))
+	if val := len(server.Requests("DELETE")); val != 0 {
+		t.Fatalf(`expected no DELETE requests in dry-run, got: %v`, val)
+	}
+
+	plan := j.GetPlan()
+	deletions := plan.ItemsByAction(PlanActionDelete)
+	if len(deletions) != 1 || deletions[0].ResourceID != expiredId || deletions[0].Reason != PlanReasonTtlExpired {
+		t.Fatalf(`expected plan with deletion of "%v", got: %v`, expiredId, deletions)
+	}
+}
+
+func TestRunDryRunPlanFile(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+	server.AddDeployment(testSubscriptionId, "rg-test", "first", time.Now().Add(-1*time.Hour))
+	limitId := server.AddDeployment(testSubscriptionId, "rg-test", "second", time.Now().Add(-2*time.Hour))
+	ageId := server.AddDeployment(testSubscriptionId, "", "old", time.Now().Add(-48*time.Hour))
+
+	planFile := filepath.Join(t.TempDir(), "plan.json")
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.DryRun = true
+	j.Conf.Janitor.Plan.File = planFile
+	j.Conf.Janitor.Deployments.Enable = true
+	j.Conf.Janitor.Deployments.Limit = 2
+	j.Conf.Janitor.Deployments.Ttl = 24 * time.Hour
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "deployment over limit exists", true, server.Exists(limitId))
+	assumeState(t, "expired deployment exists", true, server.Exists(ageId))
+
+	content, err := os.ReadFile(planFile) // #nosec G304 -- test file
+	assumeNotError(t, "plan file", err)
+
+	plan := Plan{}
+	assumeNotError(t, "plan file parsing", json.Unmarshal(content, &plan))
+	assumeState(t, "plan dryrun", true, plan.DryRun)
+
+	reasons := map[string]string{}
+	for _, item := range plan.Items {
+		reasons[item.ResourceID] = item.Reason
+	}
+
+	if reasons[limitId] != PlanReasonDeploymentLimit {
+		t.Fatalf(`expected reason "%v" for "%v", got: "%v"`, PlanReasonDeploymentLimit, limitId, reasons[limitId])
+	}
+
+	if reasons[ageId] != PlanReasonDeploymentAge {
+		t.Fatalf(`expected reason "%v" for "%v", got: "%v"`, PlanReasonDeploymentAge, ageId, reasons[ageId])
+	}
+}
+
+func TestRunResourceGroups(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-expired", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+	server.AddResourceGroup(testSubscriptionId, "rg-relative", map[string]string{
+		"ttl": "1d",
+	})
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.ResourceGroups.Enable = true
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "expired resourceGroup exists", false, server.Exists("/subscriptions/"+testSubscriptionId+"/resourceGroups/rg-expired"))
+	assumeState(t, "relative resourceGroup exists", true, server.Exists("/subscriptions/"+testSubscriptionId+"/resourceGroups/rg-relative"))
+
+	if _, exists := server.Tags("/subscriptions/" + testSubscriptionId + "/resourceGroups/rg-relative")["ttl_expiry"]; !exists {
+		t.Fatal(`expected tag "ttl_expiry" to be written for relative ttl`)
+	}
+}
+
+func TestRunDeployments(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	oldId := server.AddDeployment(testSubscriptionId, "", "old", time.Now().Add(-48*time.Hour))
+	newId := server.AddDeployment(testSubscriptionId, "", "new", time.Now().Add(-1*time.Hour))
+	rgOldId := server.AddDeployment(testSubscriptionId, "rg-test", "old", time.Now().Add(-48*time.Hour))
+	rgNewId := server.AddDeployment(testSubscriptionId, "rg-test", "new", time.Now().Add(-1*time.Hour))
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Deployments.Enable = true
+	j.Conf.Janitor.Deployments.Limit = 100
+	j.Conf.Janitor.Deployments.Ttl = 24 * time.Hour
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "old subscription deployment exists", false, server.Exists(oldId))
+	assumeState(t, "new subscription deployment exists", true, server.Exists(newId))
+	assumeState(t, "old resourceGroup deployment exists", false, server.Exists(rgOldId))
+	assumeState(t, "new resourceGroup deployment exists", true, server.Exists(rgNewId))
+}
+
+func TestRunRoleAssignments(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+
+	scope := "/subscriptions/" + testSubscriptionId
+	expiredId := server.AddRoleAssignment(scope, "expired", testRoleDefinitionId, armauthorization.PrincipalTypeUser, time.Now().Add(-12*time.Hour), "")
+	validId := server.AddRoleAssignment(scope, "valid", testRoleDefinitionId, armauthorization.PrincipalTypeUser, time.Now().Add(-1*time.Hour), "")
+	otherRoleId := server.AddRoleAssignment(scope, "other", "/providers/Microsoft.Authorization/roleDefinitions/other", armauthorization.PrincipalTypeUser, time.Now().Add(-12*time.Hour), "")
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.RoleAssignments.Enable = true
+	j.Conf.Janitor.RoleAssignments.Ttl = 6 * time.Hour
+	j.Conf.Janitor.RoleAssignments.RoleDefintionIds = []string{testRoleDefinitionId}
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "expired roleAssignment exists", false, server.Exists(expiredId))
+	assumeState(t, "valid roleAssignment exists", true, server.Exists(validId))
+	assumeState(t, "other roleAssignment exists", true, server.Exists(otherRoleId))
+}
+
+func TestRunResourcesPolicy(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddProvider(testSubscriptionId, "Microsoft.Compute", "disks", "2023-01-01")
+	server.AddResourceGroup(testSubscriptionId, "rg-dev-test", nil)
+	server.AddResourceGroup(testSubscriptionId, "rg-prod", nil)
+
+	expired := map[string]string{
+		"lifetime": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	}
+	devDiskId := server.AddResource(testSubscriptionId, "rg-dev-test", "Microsoft.Compute/disks", "disk", expired)
+	devStorageId := server.AddResource(testSubscriptionId, "rg-dev-test", "Microsoft.Storage/storageAccounts", "storage", expired)
+	devUntaggedId := server.AddResource(testSubscriptionId, "rg-dev-test", "Microsoft.Compute/disks", "untagged", nil)
+	devOldUntaggedId := server.AddResource(testSubscriptionId, "rg-dev-test", "Microsoft.Compute/disks", "old-untagged", nil)
+	server.SetCreatedTime(devOldUntaggedId, time.Now().Add(-30*24*time.Hour))
+	prodDiskId := server.AddResource(testSubscriptionId, "rg-prod", "Microsoft.Compute/disks", "disk", expired)
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.Policy = &config.Policy{
+		Rules: []*config.PolicyRule{
+			{
+				Name: "dev-compute",
+				Scope: config.PolicyRuleScope{
+					ResourceGroups: []string{"rg-dev-*"},
+					ResourceTypes:  []string{"Microsoft.Compute/*"},
+				},
+				DefaultTtl: "7d",
+			},
+			{
+				Name: "prod",
+				Scope: config.PolicyRuleScope{
+					ResourceGroups: []string{"rg-prod"},
+				},
+				Action: config.PolicyActionReport,
+			},
+		},
+	}
+	j.Policy.ApplyDefaults("lifetime", "lifetime_expiry")
+	j.initFilters()
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "dev disk exists", false, server.Exists(devDiskId))
+	assumeState(t, "dev storage (no rule) exists", true, server.Exists(devStorageId))
+	assumeState(t, "dev untagged resource exists", true, server.Exists(devUntaggedId))
+	assumeState(t, "dev old untagged resource (default ttl, grace period) exists", true, server.Exists(devOldUntaggedId))
+	assumeState(t, "prod disk (report only) exists", true, server.Exists(prodDiskId))
+
+	if _, exists := server.Tags(devUntaggedId)["lifetime_expiry"]; !exists {
+		t.Fatalf(`expected default ttl to be written to untagged resource, got: %v`, server.Tags(devUntaggedId))
+	}
+
+	if expiryTime, err := time.Parse(time.RFC3339, server.Tags(devOldUntaggedId)["lifetime_expiry"]); err != nil || !expiryTime.After(time.Now()) {
+		t.Fatalf(`expected grace period to be written to old untagged resource, got: %v`, server.Tags(devOldUntaggedId))
+	}
+
+	reports := j.GetPlan().ItemsByAction(PlanActionReport)
+	if len(reports) != 1 || reports[0].ResourceID != prodDiskId || reports[0].Rule != "prod" {
+		t.Fatalf(`expected report for "%v", got: %v`, prodDiskId, reports)
+	}
+}
+
+func TestRunConcurrent(t *testing.T) {
+	server := newFakeArmServer(t)
+
+	resourceIds := []string{}
+	for num := 0; num < 6; num++ {
+		subscriptionId := fmt.Sprintf("00000000-0000-0000-0000-%012d", num+10)
+		server.AddSubscription(subscriptionId, fmt.Sprintf("subscription-%d", num))
+		server.AddProvider(subscriptionId, "Microsoft.Storage", "storageAccounts", "2023-01-01")
+		server.AddResourceGroup(subscriptionId, "rg-test", map[string]string{
+			"ttl": time.Now().Add(1 * time.Hour).Format(time.RFC3339),
+		})
+		server.AddDeployment(subscriptionId, "rg-test", "deployment", time.Now())
+
+		for resourceNum := 0; resourceNum < 3; resourceNum++ {
+			resourceIds = append(resourceIds, server.AddResource(subscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", fmt.Sprintf("expired%d", resourceNum), map[string]string{
+				"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+			}))
+		}
+	}
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Concurrency.Subscriptions = 3
+	j.Conf.Janitor.Concurrency.Tasks = 3
+	j.Conf.Janitor.Concurrency.Deletions = 2
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.ResourceGroups.Enable = true
+	j.Conf.Janitor.Deployments.Enable = true
+	j.Conf.Janitor.Deployments.Limit = 100
+	j.Conf.Janitor.Deployments.Ttl = time.Hour
+	j.runJanitor(context.Background(), j.Logger)
+
+	for _, resourceId := range resourceIds {
+		assumeState(t, "expired resource exists", false, server.Exists(resourceId))
+	}
+
+	// ttl metrics for all resourceGroups and (deleted) resources
+	if val := testutil.CollectAndCount(j.Prometheus.MetricTtlResources); val != 6+len(resourceIds) {
+		t.Fatalf(`expected %v resource ttl metrics, got: %v`, 6+len(resourceIds), val)
+	}
+
+	// subscription and resourceGroup deployment counts of all subscriptions
+	if val := testutil.CollectAndCount(j.Prometheus.MetricDeployment); val != 12 {
+		t.Fatalf(`expected 12 deployment metrics, got: %v`, val)
+	}
+	if val := testutil.CollectAndCount(j.Prometheus.MetricDeploymentState); val != 24 {
+		t.Fatalf(`expected 24 deployment state metrics, got: %v`, val)
+	}
+
+	if val := len(j.GetPlan().ItemsByAction(PlanActionDelete)); val != len(resourceIds) {
+		t.Fatalf(`expected %v planned deletions, got: %v`, len(resourceIds), val)
+	}
+}
+
+func TestRunDeploymentsDryRun(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	oldId := server.AddDeployment(testSubscriptionId, "", "old", time.Now().Add(-48*time.Hour))
+	newId := server.AddDeployment(testSubscriptionId, "", "new", time.Now().Add(-1*time.Hour))
+	rgIds := []string{}
+	for num, name := range []string{"a", "b", "c"} {
+		rgIds = append(rgIds, server.AddDeployment(testSubscriptionId, "rg-test", name, time.Now().Add(-time.Duration(num+1)*time.Hour)))
+	}
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.DryRun = true
+	j.Conf.Janitor.Deployments.Enable = true
+	j.Conf.Janitor.Deployments.Limit = 3
+	j.Conf.Janitor.Deployments.Ttl = 24 * time.Hour
+	j.runJanitor(context.Background(), j.Logger)
+
+	for _, resourceId := range append([]string{oldId, newId}, rgIds...) {
+		assumeState(t, "deployment exists", true, server.Exists(resourceId))
+	}
+
+	reasons := map[string]string{}
+	for _, item := range j.GetPlan().ItemsByAction(PlanActionDelete) {
+		reasons[item.ResourceID] = item.Reason
+	}
+	if len(reasons) != 2 || reasons[oldId] != PlanReasonDeploymentAge || reasons[rgIds[2]] != PlanReasonDeploymentLimit {
+		t.Fatalf(`expected planned deletions for old and over limit deployment, got: %v`, reasons)
+	}
+
+	expectedMetrics := map[[2]string]float64{
+		{"", DeploymentStateRemaining}:          1,
+		{"", DeploymentStateWouldDelete}:        1,
+		{"rg-test", DeploymentStateRemaining}:   2,
+		{"rg-test", DeploymentStateWouldDelete}: 1,
+	}
+	for labels, expected := range expectedMetrics {
+		if val := testutil.ToFloat64(j.Prometheus.MetricDeploymentState.WithLabelValues(testSubscriptionId, "", labels[0], labels[1])); val != expected {
+			t.Fatalf(`expected deployment metric %v to be %v, got: %v`, labels, expected, val)
+		}
+	}
+}
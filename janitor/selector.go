@@ -0,0 +1,250 @@
+package janitor
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/webdevops/go-common/azuresdk/armclient"
+	"github.com/webdevops/go-common/utils/to"
+)
+
+type (
+	// ResourceSelector is a client side selector for resources, all terms must match (and).
+	//
+	// Supported terms (prefix "!" negates a term, values can be quoted):
+	//
+	//	type=<glob>[,<glob>...]      resource type (glob, eg Microsoft.Compute/*)
+	//	name~<regex>                 resource name
+	//	rg~<regex>                   resourceGroup name (alias resourceGroup~)
+	//	location=<name>[,<name>...]  location
+	//	sku=<name>[,<name>...]       sku name
+	//	tag:<name>                   tag is set
+	//	tag:<name>=<value>           tag value (case insensitive)
+	//	tag:<name>~<regex>           tag value regex
+	ResourceSelector struct {
+		expression string
+		terms      []selectorTerm
+	}
+
+	selectorTerm struct {
+		negate bool
+		match  func(resource selectorResource) bool
+	}
+
+	selectorResource struct {
+		*armresources.GenericResourceExpanded
+		resourceGroup string
+	}
+)
+
+// ParseResourceSelector parses the selector expression, returns nil if the expression is empty
+func ParseResourceSelector(expression string) (*ResourceSelector, error) {
+	tokens, err := splitSelectorExpression(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	selector := &ResourceSelector{expression: expression}
+	for _, token := range tokens {
+		term, err := parseSelectorTerm(token)
+		if err != nil {
+			return nil, fmt.Errorf(`invalid selector term "%s": %w`, token, err)
+		}
+		selector.terms = append(selector.terms, term)
+	}
+
+	return selector, nil
+}
+
+// Matches checks if the resource matches all terms of the selector, a nil selector matches everything
+func (s *ResourceSelector) Matches(resource *armresources.GenericResourceExpanded) bool {
+	if s == nil {
+		return true
+	}
+
+	obj := selectorResource{GenericResourceExpanded: resource}
+	if azureResource, err := armclient.ParseResourceId(to.String(resource.ID)); err == nil {
+		obj.resourceGroup = azureResource.ResourceGroup
+	}
+
+	for _, term := range s.terms {
+		if term.match(obj) == term.negate {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *ResourceSelector) String() string {
+	if s == nil {
+		return ""
+	}
+	return s.expression
+}
+
+func parseSelectorTerm(token string) (selectorTerm, error) {
+	term := selectorTerm{}
+	if strings.HasPrefix(token, "!") {
+		term.negate = true
+		token = strings.TrimPrefix(token, "!")
+	}
+
+	// tag terms: tag:name, tag:name=value, tag:name~regex
+	if strings.HasPrefix(strings.ToLower(token), "tag:") {
+		token = token[len("tag:"):]
+		tagName, value, operator := cutSelectorOperator(token)
+		if tagName == "" {
+			return term, fmt.Errorf("tag name missing")
+		}
+
+		switch operator {
+		case "":
+			term.match = func(resource selectorResource) bool {
+				name, _ := findTag(resource.Tags, tagName)
+				return name != ""
+			}
+		case "=":
+			term.match = func(resource selectorResource) bool {
+				_, tagValue := findTag(resource.Tags, tagName)
+				return tagValue != nil && strings.EqualFold(*tagValue, value)
+			}
+		case "~":
+			regex, err := regexp.Compile(value)
+			if err != nil {
+				return term, err
+			}
+			term.match = func(resource selectorResource) bool {
+				_, tagValue := findTag(resource.Tags, tagName)
+				return tagValue != nil && regex.MatchString(*tagValue)
+			}
+		}
+		return term, nil
+	}
+
+	field, value, operator := cutSelectorOperator(token)
+	if operator == "" {
+		return term, fmt.Errorf(`expected "field=value" or "field~regex"`)
+	}
+
+	switch strings.ToLower(field) + operator {
+	case "type=":
+		patterns := splitSelectorList(value)
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return term, err
+			}
+		}
+		term.match = func(resource selectorResource) bool {
+			resourceType := strings.ToLower(to.String(resource.Type))
+			for _, pattern := range patterns {
+				if matched, _ := path.Match(pattern, resourceType); matched {
+					return true
+				}
+			}
+			return false
+		}
+	case "name~", "rg~", "resourcegroup~":
+		regex, err := regexp.Compile(value)
+		if err != nil {
+			return term, err
+		}
+		isName := strings.EqualFold(field, "name")
+		term.match = func(resource selectorResource) bool {
+			if isName {
+				return regex.MatchString(to.String(resource.Name))
+			}
+			return regex.MatchString(resource.resourceGroup)
+		}
+	case "location=":
+		locations := splitSelectorList(value)
+		term.match = func(resource selectorResource) bool {
+			return selectorListContains(locations, to.String(resource.Location))
+		}
+	case "sku=":
+		skus := splitSelectorList(value)
+		term.match = func(resource selectorResource) bool {
+			return resource.SKU != nil && selectorListContains(skus, to.String(resource.SKU.Name))
+		}
+	default:
+		return term, fmt.Errorf(`unsupported field "%s%s"`, field, operator)
+	}
+
+	return term, nil
+}
+
+// cutSelectorOperator splits the term at the first "=" or "~" and returns field, value and operator
+func cutSelectorOperator(token string) (field, value, operator string) {
+	if pos := strings.IndexAny(token, "=~"); pos >= 0 {
+		return token[:pos], token[pos+1:], token[pos : pos+1]
+	}
+	return token, "", ""
+}
+
+// splitSelectorList splits comma separated values (lowercase)
+func splitSelectorList(value string) []string {
+	ret := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			ret = append(ret, strings.ToLower(item))
+		}
+	}
+	return ret
+}
+
+func selectorListContains(list []string, value string) bool {
+	value = strings.ToLower(value)
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// splitSelectorExpression splits the expression at whitespace, single or double quotes can be used for values with whitespace
+func splitSelectorExpression(expression string) ([]string, error) {
+	tokens := []string{}
+	token := strings.Builder{}
+	inToken := false
+	var quote rune
+
+	for _, char := range expression {
+		switch {
+		case quote != 0 && char == quote:
+			quote = 0
+		case quote != 0:
+			token.WriteRune(char)
+		case char == '"' || char == '\'':
+			quote = char
+			inToken = true
+		case unicode.IsSpace(char):
+			if inToken {
+				tokens = append(tokens, token.String())
+				token.Reset()
+				inToken = false
+			}
+		default:
+			token.WriteRune(char)
+			inToken = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf(`unterminated quote in selector "%s"`, expression)
+	}
+
+	if inToken {
+		tokens = append(tokens, token.String())
+	}
+
+	return tokens, nil
+}
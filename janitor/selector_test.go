@@ -0,0 +1,99 @@
+package janitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/webdevops/go-common/utils/to"
+)
+
+func TestResourceSelector(t *testing.T) {
+	resource := &armresources.GenericResourceExpanded{
+		ID:       to.StringPtr("/subscriptions/00000000-0000-0000-0000-000000000001/resourceGroups/rg-dev-test/providers/Microsoft.Compute/disks/disk1"),
+		Name:     to.StringPtr("disk1"),
+		Type:     to.StringPtr("Microsoft.Compute/disks"),
+		Location: to.StringPtr("westeurope"),
+		SKU:      &armresources.SKU{Name: to.StringPtr("Premium_LRS")},
+		Tags: map[string]*string{
+			"Env":   to.StringPtr("dev-1"),
+			"owner": to.StringPtr("team a"),
+		},
+	}
+
+	testCases := map[string]bool{
+		"type=Microsoft.Compute/* rg~^rg-dev- !tag:keep":   true,
+		"type=microsoft.storage/*,microsoft.compute/disks": true,
+		"type=Microsoft.Storage/*":                         false,
+		"name~^disk[0-9]+$":                                true,
+		"resourceGroup~^rg-prod":                           false,
+		"location=northeurope,WestEurope":                  true,
+		"!location=westeurope":                             false,
+		"tag:env":                                          true,
+		"tag:keep":                                         false,
+		"tag:env~^dev-":                                    true,
+		"tag:env=DEV-1":                                    true,
+		"tag:owner='team a'":                               true,
+		`tag:owner="team b"`:                               false,
+		"sku=standard_lrs,premium_lrs":                     true,
+		"sku=Standard_LRS":                                 false,
+		"type=Microsoft.Compute/* tag:env~^prod location=westeurope": false,
+	}
+
+	for expression, expected := range testCases {
+		selector, err := ParseResourceSelector(expression)
+		assumeNotError(t, expression, err)
+		assumeState(t, expression, expected, selector.Matches(resource))
+	}
+
+	invalidExpressions := []string{
+		"type",
+		"name=disk",
+		"unknown=value",
+		"name~[",
+		"tag:",
+		"tag:env~(",
+		"type=[",
+		"tag:owner='team",
+	}
+	for _, expression := range invalidExpressions {
+		_, err := ParseResourceSelector(expression)
+		assumeError(t, expression, err)
+	}
+
+	selector, err := ParseResourceSelector("  ")
+	assumeNotError(t, "empty selector", err)
+	assumeState(t, "empty selector matches", true, selector.Matches(resource))
+}
+
+func TestRunResourcesSelector(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddProvider(testSubscriptionId, "Microsoft.Compute", "disks", "2023-01-01")
+	server.AddResourceGroup(testSubscriptionId, "rg-dev-test", nil)
+	server.AddResourceGroup(testSubscriptionId, "rg-prod", nil)
+
+	expired := func(tags map[string]string) map[string]string {
+		tags["ttl"] = time.Now().Add(-1 * time.Hour).Format(time.RFC3339)
+		return tags
+	}
+	devDiskId := server.AddResource(testSubscriptionId, "rg-dev-test", "Microsoft.Compute/disks", "disk", expired(map[string]string{}))
+	server.SetSku(devDiskId, "Standard_LRS")
+	keepDiskId := server.AddResource(testSubscriptionId, "rg-dev-test", "Microsoft.Compute/disks", "keep", expired(map[string]string{"keep": "true"}))
+	premiumDiskId := server.AddResource(testSubscriptionId, "rg-dev-test", "Microsoft.Compute/disks", "premium", expired(map[string]string{}))
+	server.SetSku(premiumDiskId, "Premium_LRS")
+	devStorageId := server.AddResource(testSubscriptionId, "rg-dev-test", "Microsoft.Storage/storageAccounts", "storage", expired(map[string]string{}))
+	prodDiskId := server.AddResource(testSubscriptionId, "rg-prod", "Microsoft.Compute/disks", "disk", expired(map[string]string{}))
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.Resources.Selector = "type=Microsoft.Compute/* rg~^rg-dev- !tag:keep !sku=Premium_LRS"
+	j.initFilters()
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "dev disk exists", false, server.Exists(devDiskId))
+	assumeState(t, "dev disk with keep tag exists", true, server.Exists(keepDiskId))
+	assumeState(t, "dev premium disk exists", true, server.Exists(premiumDiskId))
+	assumeState(t, "dev storage exists", true, server.Exists(devStorageId))
+	assumeState(t, "prod disk exists", true, server.Exists(prodDiskId))
+}
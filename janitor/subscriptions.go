@@ -0,0 +1,146 @@
+package janitor
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/managementgroups/armmanagementgroups"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armsubscriptions"
+	"github.com/webdevops/go-common/log/slogger"
+	"github.com/webdevops/go-common/utils/to"
+)
+
+// resolveSubscriptions lists all visible subscriptions and selects the subscriptions matching all configured
+// criteria (subscription ids, management groups, tags and display name), ordered by subscription id.
+// Subscriptions are resolved on every run (uncached), so new subscriptions are picked up without restart.
+func (j *Janitor) resolveSubscriptions(ctx context.Context, logger *slogger.Logger) ([]*armsubscriptions.Subscription, error) {
+	subscriptionList, err := j.Azure.ClientProvider.ListSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// subscriptions below the management groups (recursive)
+	var managementGroupSubscriptions map[string]struct{}
+	if len(j.Azure.SubscriptionManagementGroup) > 0 {
+		managementGroupSubscriptions = map[string]struct{}{}
+		for _, groupId := range j.Azure.SubscriptionManagementGroup {
+			if err := j.fetchManagementGroupSubscriptions(ctx, groupId, managementGroupSubscriptions); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	ret := []*armsubscriptions.Subscription{}
+	for _, subscription := range subscriptionList {
+		subscriptionId := to.StringLower(subscription.SubscriptionID)
+		subscriptionLogger := logger.With(
+			slog.String("subscriptionID", subscriptionId),
+			slog.String("subscriptionName", to.String(subscription.DisplayName)),
+		)
+
+		if len(j.Azure.Subscription) > 0 && !slices.ContainsFunc(j.Azure.Subscription, func(val string) bool { return strings.EqualFold(val, subscriptionId) }) {
+			continue
+		}
+
+		if managementGroupSubscriptions != nil {
+			if _, exists := managementGroupSubscriptions[subscriptionId]; !exists {
+				subscriptionLogger.Debug("subscription not inside management groups, skipping")
+				continue
+			}
+		}
+
+		if !matchesSubscriptionTags(j.Azure.SubscriptionTag, subscription.Tags) {
+			subscriptionLogger.Debug("subscription tags not matching, skipping")
+			continue
+		}
+
+		if j.Azure.SubscriptionName != nil && !j.Azure.SubscriptionName.MatchString(to.String(subscription.DisplayName)) {
+			subscriptionLogger.Debug("subscription name not matching, skipping")
+			continue
+		}
+
+		ret = append(ret, subscription)
+	}
+
+	sort.Slice(ret, func(a, b int) bool {
+		return to.StringLower(ret[a].SubscriptionID) < to.StringLower(ret[b].SubscriptionID)
+	})
+
+	return ret, nil
+}
+
+// updateSubscriptions resolves the subscriptions for the current run and logs added and removed subscriptions,
+// the previous subscriptions are kept if the subscriptions cannot be resolved
+func (j *Janitor) updateSubscriptions(ctx context.Context, logger *slogger.Logger) error {
+	subscriptions, err := j.resolveSubscriptions(ctx, logger)
+	if err != nil {
+		return err
+	}
+
+	previous := map[string]bool{}
+	for _, subscription := range j.subscriptions {
+		previous[to.StringLower(subscription.SubscriptionID)] = true
+	}
+
+	for _, subscription := range subscriptions {
+		subscriptionId := to.StringLower(subscription.SubscriptionID)
+		if !previous[subscriptionId] {
+			logger.Infof(`using subscription "%s" (%s)`, to.String(subscription.DisplayName), subscriptionId)
+		}
+		delete(previous, subscriptionId)
+	}
+
+	for subscriptionId := range previous {
+		logger.Infof(`subscription "%s" not selected anymore`, subscriptionId)
+	}
+
+	j.subscriptions = subscriptions
+
+	return nil
+}
+
+// fetchManagementGroupSubscriptions adds all subscriptions below the management group (recursive) to the list (lowercase id)
+func (j *Janitor) fetchManagementGroupSubscriptions(ctx context.Context, groupId string, list map[string]struct{}) error {
+	client, err := armmanagementgroups.NewClient(j.Azure.ClientProvider.GetCred(), j.Azure.ClientProvider.NewArmClientOptions())
+	if err != nil {
+		return err
+	}
+
+	pager := client.NewGetDescendantsPager(groupId, nil)
+	for pager.More() {
+		result, err := pager.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, descendant := range result.Value {
+			// descendants contain management groups and subscriptions (type "/subscriptions")
+			if strings.HasSuffix(to.StringLower(descendant.Type), "/subscriptions") {
+				list[to.StringLower(descendant.Name)] = struct{}{}
+			}
+		}
+	}
+
+	return nil
+}
+
+// matchesSubscriptionTags checks if all tag conditions ("name" or "name=value", case insensitive) match the subscription tags
+func matchesSubscriptionTags(conditions []string, tags map[string]*string) bool {
+	for _, condition := range conditions {
+		tagName, tagValue, hasValue := strings.Cut(condition, "=")
+
+		name, value := findTag(tags, strings.TrimSpace(tagName))
+		if name == "" {
+			return false
+		}
+
+		if hasValue && (value == nil || !strings.EqualFold(*value, strings.TrimSpace(tagValue))) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,84 @@
+package janitor
+
+import (
+	"context"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/webdevops/go-common/utils/to"
+)
+
+func TestSubscriptionTags(t *testing.T) {
+	tags := map[string]*string{"Env": to.StringPtr("Dev"), "team": to.StringPtr("a")}
+
+	testCases := map[string]struct {
+		conditions []string
+		expected   bool
+	}{
+		"no conditions":     {conditions: nil, expected: true},
+		"tag set":           {conditions: []string{"env"}, expected: true},
+		"tag value":         {conditions: []string{"env=dev", "team=a"}, expected: true},
+		"wrong tag value":   {conditions: []string{"env=prod"}, expected: false},
+		"missing tag":       {conditions: []string{"owner"}, expected: false},
+		"one not matching":  {conditions: []string{"env=dev", "team=b"}, expected: false},
+		"empty tag value":   {conditions: []string{"env="}, expected: false},
+		"whitespace around": {conditions: []string{" env = dev "}, expected: true},
+	}
+
+	for name, testCase := range testCases {
+		assumeState(t, name, testCase.expected, matchesSubscriptionTags(testCase.conditions, tags))
+	}
+}
+
+func TestRunSubscriptionSelection(t *testing.T) {
+	subscriptionTeamA := "00000000-0000-0000-0000-0000000000a1"
+	subscriptionProd := "00000000-0000-0000-0000-0000000000a2"
+	subscriptionOther := "00000000-0000-0000-0000-0000000000a3"
+	subscriptionNew := "00000000-0000-0000-0000-0000000000a4"
+
+	server := newFakeArmServer(t)
+	server.AddManagementGroup("sandbox", "")
+	server.AddManagementGroup("sandbox-teams", "sandbox")
+	server.AddManagementGroup("production", "")
+
+	expiredTags := func() map[string]string {
+		return map[string]string{"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339)}
+	}
+
+	addSubscription := func(subscriptionId, displayName, managementGroup string, tags map[string]string) string {
+		server.AddSubscription(subscriptionId, displayName)
+		server.SetSubscriptionTags(subscriptionId, tags)
+		server.SetSubscriptionManagementGroup(subscriptionId, managementGroup)
+		server.AddProvider(subscriptionId, "Microsoft.Storage", "storageAccounts", "2023-01-01")
+		server.AddResourceGroup(subscriptionId, "rg-test", nil)
+		return server.AddResource(subscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "expired", expiredTags())
+	}
+
+	teamAId := addSubscription(subscriptionTeamA, "sandbox-team-a", "sandbox-teams", map[string]string{"env": "dev"})
+	prodId := addSubscription(subscriptionProd, "sandbox-prod", "sandbox", map[string]string{"env": "prod"})
+	otherId := addSubscription(subscriptionOther, "sandbox-other", "production", map[string]string{"env": "dev"})
+	wrongNameId := addSubscription("00000000-0000-0000-0000-0000000000a5", "team-b", "sandbox", map[string]string{"env": "dev"})
+
+	j := buildJanitorObj()
+	j.Conf.Janitor.Resources.Enable = true
+	j.Azure.SubscriptionManagementGroup = []string{"sandbox"}
+	j.Azure.SubscriptionTag = []string{"env=dev"}
+	j.Azure.SubscriptionName = regexp.MustCompile(`^sandbox-`)
+	j = buildFakeJanitorFromObj(t, server, j)
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "resource in selected subscription exists", false, server.Exists(teamAId))
+	assumeState(t, "resource in subscription with wrong tag exists", true, server.Exists(prodId))
+	assumeState(t, "resource in subscription outside management group exists", true, server.Exists(otherId))
+	assumeState(t, "resource in subscription with wrong name exists", true, server.Exists(wrongNameId))
+
+	// new subscription is picked up by the next run (including api-versions)
+	newId := addSubscription(subscriptionNew, "sandbox-new", "sandbox-teams", map[string]string{"env": "dev"})
+	j.runJanitor(context.Background(), j.Logger)
+
+	assumeState(t, "resource in new subscription exists", false, server.Exists(newId))
+	if failureCount := j.GetRunStatus().FailureCount(); failureCount != 0 {
+		t.Fatalf(`expected no failures, got: %v`, j.GetRunStatus().Failures)
+	}
+}
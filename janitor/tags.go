@@ -0,0 +1,58 @@
+package janitor
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/resources/armresources"
+	"github.com/webdevops/go-common/utils/to"
+)
+
+// updateTagsAtScope writes the tag changes of a resource or resourceGroup (scope = resource id) via the
+// Microsoft.Resources/tags api: removed tags (eg. applied extend tag) are deleted first, new and changed tags are
+// merged afterwards. If the merge fails the deleted tags are restored, so a failed update is retried as a whole in
+// the next run (and an extend tag is never applied twice).
+// No other property of the resource is touched and no api-version of the resource type is needed.
+func (j *Janitor) updateTagsAtScope(ctx context.Context, client *armresources.TagsClient, scope string, originalTags, tags map[string]*string) error {
+	mergeTags := map[string]*string{}
+	for tagName, tagValue := range tags {
+		if originalValue, exists := originalTags[tagName]; !exists || to.String(originalValue) != to.String(tagValue) {
+			mergeTags[tagName] = tagValue
+		}
+	}
+
+	deleteTags := map[string]*string{}
+	for tagName, tagValue := range originalTags {
+		if _, exists := tags[tagName]; !exists {
+			deleteTags[tagName] = tagValue
+		}
+	}
+
+	if len(deleteTags) > 0 {
+		if err := j.patchTagsAtScope(ctx, client, scope, armresources.TagsPatchOperationDelete, deleteTags); err != nil {
+			return err
+		}
+	}
+
+	if len(mergeTags) > 0 {
+		if err := j.patchTagsAtScope(ctx, client, scope, armresources.TagsPatchOperationMerge, mergeTags); err != nil {
+			if len(deleteTags) > 0 {
+				if restoreErr := j.patchTagsAtScope(ctx, client, scope, armresources.TagsPatchOperationMerge, deleteTags); restoreErr != nil {
+					return fmt.Errorf("%w (restore of deleted tags failed: %v)", err, restoreErr)
+				}
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// patchTagsAtScope sends one patch operation for the tags of a scope
+func (j *Janitor) patchTagsAtScope(ctx context.Context, client *armresources.TagsClient, scope string, operation armresources.TagsPatchOperation, tags map[string]*string) error {
+	_, err := client.UpdateAtScope(ctx, scope, armresources.TagsPatchResource{
+		Operation:  &operation,
+		Properties: &armresources.Tags{Tags: tags},
+	}, nil)
+	return err
+}
@@ -0,0 +1,92 @@
+package janitor
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunTagsApi(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", map[string]string{
+		"ttl":   "5d",
+		"owner": "team-a",
+	})
+
+	// resource type without api-version: tags are still updated, only the delete is not possible
+	relativeId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Unknown/things", "relative", map[string]string{
+		"ttl":   "5d",
+		"owner": "team-a",
+	})
+	extendedId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "extended", map[string]string{
+		"ttl":        time.Now().Add(1 * time.Hour).Format(time.RFC3339),
+		"ttl_extend": "1d",
+	})
+	expiredId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Unknown/things", "expired", map[string]string{
+		"ttl": time.Now().Add(-1 * time.Hour).Format(time.RFC3339),
+	})
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.Conf.Janitor.ResourceGroups.Enable = true
+	j.runJanitor(context.Background(), j.Logger)
+
+	resourceGroupId := "/subscriptions/" + testSubscriptionId + "/resourceGroups/rg-test"
+	for _, resourceId := range []string{resourceGroupId, relativeId} {
+		tags := server.Tags(resourceId)
+		if _, exists := tags["ttl_expiry"]; !exists || tags["owner"] != "team-a" || tags["ttl"] != "5d" {
+			t.Fatalf(`expected tag "ttl_expiry" to be merged into existing tags of %s, got: %v`, resourceId, tags)
+		}
+	}
+
+	if tags := server.Tags(extendedId); tags["ttl_extend"] != "" || tags["ttl_expiry"] == "" {
+		t.Fatalf(`expected tag "ttl_extend" to be deleted and "ttl_expiry" to be merged, got: %v`, tags)
+	}
+
+	assumeState(t, "expired resource without api-version exists", true, server.Exists(expiredId))
+
+	// all updates are done via tags api
+	for _, request := range server.Requests("PATCH") {
+		if !strings.HasSuffix(strings.ToLower(request), fakeArmProviderTags) {
+			t.Fatalf(`expected tag updates via tags api, got: %v`, request)
+		}
+	}
+	if val := len(server.Requests("PATCH")); val != 4 {
+		t.Fatalf(`expected 4 tags api requests (3x merge, 1x delete), got: %v`, server.Requests("PATCH"))
+	}
+}
+
+func TestRunTagsApiPartialFailure(t *testing.T) {
+	server := buildFakeArmEnvironment(t)
+	server.AddResourceGroup(testSubscriptionId, "rg-test", nil)
+
+	expiryTime := time.Now().Add(1 * time.Hour).Truncate(time.Second)
+	extendedId := server.AddResource(testSubscriptionId, "rg-test", "Microsoft.Storage/storageAccounts", "extended", map[string]string{
+		"ttl":        expiryTime.Format(time.RFC3339),
+		"ttl_extend": "1d",
+	})
+
+	// delete of extend tag succeeds, merge of new expiry time fails
+	server.FailNthRequest(http.MethodPatch, extendedId+fakeArmProviderTags, 2, http.StatusInternalServerError)
+
+	j := buildFakeJanitor(t, server)
+	j.Conf.Janitor.Resources.Enable = true
+	j.runJanitor(context.Background(), j.Logger)
+
+	if tags := server.Tags(extendedId); tags["ttl_extend"] != "1d" || tags["ttl_expiry"] != "" {
+		t.Fatalf(`expected deleted tags to be restored after failed merge, got: %v`, tags)
+	}
+
+	// next run applies the extension exactly once
+	j.runJanitor(context.Background(), j.Logger)
+
+	tags := server.Tags(extendedId)
+	if tags["ttl_extend"] != "" {
+		t.Fatalf(`expected tag "ttl_extend" to be deleted, got: %v`, tags)
+	}
+	if val := tags["ttl_expiry"]; val != expiryTime.Add(24*time.Hour).Format(time.RFC3339) {
+		t.Fatalf(`expected extension to be applied once (%v), got: %v`, expiryTime.Add(24*time.Hour).Format(time.RFC3339), val)
+	}
+}
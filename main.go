@@ -1,15 +1,22 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
 	"regexp"
 	"runtime"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 
+	armauthorization "github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/authorization/armauthorization/v2"
 	"github.com/jessevdk/go-flags"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/webdevops/go-common/azuresdk/armclient"
@@ -29,6 +36,7 @@ const (
 var (
 	argparser *flags.Parser
 	Opts      config.Opts
+	Policy    *config.Policy
 
 	AzureClient *armclient.ArmClient
 
@@ -49,22 +57,38 @@ func main() {
 	initAzureConnection()
 
 	logger.Infof("init Janitor")
+	j := &janitor.Janitor{
+		Conf:      Opts,
+		Policy:    Policy,
+		UserAgent: UserAgent + gitTag,
+		Logger:    logger,
+		Azure: janitor.JanitorAzureConfig{
+			Client:                      AzureClient,
+			Subscription:                Opts.Azure.Subscription,
+			SubscriptionManagementGroup: Opts.Azure.SubscriptionManagementGroup,
+			SubscriptionTag:             Opts.Azure.SubscriptionTag,
+			SubscriptionName:            Opts.Azure.SubscriptionNameRegExp,
+		},
+	}
 	go func() {
-		j := janitor.Janitor{
-			Conf:      Opts,
-			UserAgent: UserAgent + gitTag,
-			Logger:    logger,
-			Azure: janitor.JanitorAzureConfig{
-				Client:       AzureClient,
-				Subscription: Opts.Azure.Subscription,
-			},
-		}
 		j.Init()
 		j.Run()
 	}()
 
-	logger.Info("starting http server", slog.String("bind", Opts.Server.Bind))
-	startHttpServer()
+	go func() {
+		logger.Info("starting http server", slog.String("bind", Opts.Server.Bind))
+		startHttpServer(j)
+	}()
+
+	// wait for delete operations tracked in background (async mode) before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-ctx.Done()
+	stop()
+
+	logger.Info("shutting down", slog.Duration("timeout", Opts.Janitor.Delete.ShutdownTimeout))
+	if !j.WaitForPendingDeletions(Opts.Janitor.Delete.ShutdownTimeout) {
+		logger.Warn("delete operations still pending on shutdown, not waiting any longer")
+	}
 }
 
 // init argparser and parse/validate arguments
@@ -86,26 +110,18 @@ func initArgparser() {
 
 	initLogger()
 
-	// resourceGroup filter
-	Opts.Janitor.ResourceGroups.Filter = fmt.Sprintf(
-		"tagName eq '%s'",
-		strings.ReplaceAll(Opts.Janitor.Tag, "'", "\\'"),
-	)
-
-	// ResourceGroups: add additional filter
-	if Opts.Janitor.ResourceGroups.AdditionalFilter != nil {
-		Opts.Janitor.ResourceGroups.Filter = fmt.Sprintf(
-			"%s and %s",
-			Opts.Janitor.ResourceGroups.Filter,
-			*Opts.Janitor.ResourceGroups.AdditionalFilter,
-		)
-	}
+	// policy file
+	if Opts.Config != "" {
+		var err error
+		Policy, err = config.LoadPolicyFile(Opts.Config)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
 
-	// Resources: add additional filter
-	// resource (if we specify tagValue here we don't get the tag.. wtf?!)
-	Opts.Janitor.Resources.Filter = ""
-	if Opts.Janitor.Resources.AdditionalFilter != nil {
-		Opts.Janitor.Resources.Filter = *Opts.Janitor.Resources.AdditionalFilter
+		Policy.ApplyDefaults(Opts.Janitor.Tag, Opts.Janitor.TagTarget)
+		if err := Policy.Validate(); err != nil {
+			logger.Fatalf(`invalid policy file "%s": %v`, Opts.Config, err.Error())
+		}
 	}
 
 	if Opts.Janitor.RoleAssignments.Enable {
@@ -119,14 +135,80 @@ func initArgparser() {
 		Opts.Janitor.RoleAssignments.Filter = *Opts.Janitor.RoleAssignments.AdditionalFilter
 	}
 
-	if !Opts.Janitor.ResourceGroups.Enable && !Opts.Janitor.Resources.Enable && !Opts.Janitor.Deployments.Enable && !Opts.Janitor.RoleAssignments.Enable {
-		logger.Fatal(`no janitor task (resources, resourcegroups, deployments, roleassignments) enabled, not starting`)
+	if !Opts.Janitor.ResourceGroups.Enable && !Opts.Janitor.Resources.Enable && !Opts.Janitor.Deployments.Enable && !Opts.Janitor.RoleAssignments.Enable && !Opts.Janitor.RoleAssignmentsOrphaned.Enable {
+		logger.Fatal(`no janitor task (resources, resourcegroups, deployments, roleassignments, orphaned roleassignments) enabled, not starting`)
 	}
 
 	if Opts.Janitor.RoleAssignments.DescriptionTtl != nil {
 		Opts.Janitor.RoleAssignments.DescriptionTtlRegExp = regexp.MustCompile(*Opts.Janitor.RoleAssignments.DescriptionTtl)
 	}
 
+	if Opts.Janitor.Deployments.Prefix != nil {
+		deploymentPrefixRegExp, err := regexp.Compile(*Opts.Janitor.Deployments.Prefix)
+		if err != nil {
+			logger.Fatalf(`invalid deployment prefix regexp "%s": %v`, *Opts.Janitor.Deployments.Prefix, err.Error())
+		}
+		if deploymentPrefixRegExp.NumSubexp() < 1 {
+			logger.Fatalf(`invalid deployment prefix regexp "%s": capture group for prefix missing`, *Opts.Janitor.Deployments.Prefix)
+		}
+		Opts.Janitor.Deployments.PrefixRegExp = deploymentPrefixRegExp
+	}
+
+	if Opts.Janitor.Deployments.KeepSucceeded < 0 || Opts.Janitor.Deployments.KeepFailed < 0 {
+		logger.Fatal(`number of kept deployments must not be negative`)
+	}
+
+	if Opts.Azure.SubscriptionName != nil {
+		subscriptionNameRegExp, err := regexp.Compile(*Opts.Azure.SubscriptionName)
+		if err != nil {
+			logger.Fatalf(`invalid subscription name regexp "%s": %v`, *Opts.Azure.SubscriptionName, err.Error())
+		}
+		Opts.Azure.SubscriptionNameRegExp = subscriptionNameRegExp
+	}
+
+	for _, val := range Opts.Azure.SubscriptionTag {
+		if tagName, _, _ := strings.Cut(val, "="); strings.TrimSpace(tagName) == "" {
+			logger.Fatalf(`invalid subscription tag "%s", expected "name" or "name=value"`, val)
+		}
+	}
+
+	Opts.Janitor.ApiVersion.Overrides = map[string]string{}
+	for _, val := range Opts.Janitor.ApiVersion.Override {
+		resourceType, apiVersion, _ := strings.Cut(val, "=")
+		resourceType = strings.TrimSpace(resourceType)
+		apiVersion = strings.TrimSpace(apiVersion)
+		if !strings.Contains(resourceType, "/") || apiVersion == "" {
+			logger.Fatalf(`invalid api-version override "%s", expected "namespace/type=api-version"`, val)
+		}
+		Opts.Janitor.ApiVersion.Overrides[strings.ToLower(resourceType)] = apiVersion
+	}
+
+	if Opts.Janitor.Delete.PollInterval < time.Second {
+		logger.Fatal(`delete poll interval must be at least 1s`)
+	}
+
+	if Opts.Janitor.Delete.Timeout <= 0 {
+		logger.Fatal(`delete timeout must be greater than 0`)
+	}
+
+	if Opts.Janitor.Delete.ShutdownTimeout < 0 {
+		logger.Fatal(`delete shutdown timeout must not be negative`)
+	}
+
+	if Opts.Janitor.TagExtend.Max < 0 {
+		logger.Fatal(`maximum ttl extension must not be negative`)
+	}
+
+	if Opts.Janitor.DefaultTtl.Grace < 0 {
+		logger.Fatal(`default ttl grace period must not be negative`)
+	}
+
+	if len(Opts.Janitor.Notification.Window) > 0 {
+		if Opts.Janitor.Notification.Webhook == "" && Opts.Janitor.Notification.Slack == "" && Opts.Janitor.Notification.Teams == "" {
+			logger.Fatal(`notification window set but no notification backend (webhook, slack, teams) defined`)
+		}
+	}
+
 	for _, val := range Opts.Janitor.RoleAssignments.RoleDefintionIds {
 		val = strings.ToLower(val)
 		if !strings.Contains(val, "/providers/microsoft.authorization/roledefinitions/") {
@@ -134,6 +216,34 @@ func initArgparser() {
 		}
 	}
 
+	for num, val := range Opts.Janitor.RoleAssignments.Scopes {
+		scope := strings.TrimSuffix(strings.TrimSpace(val), "/")
+		if !strings.HasPrefix(strings.ToLower(scope), "/subscriptions/") && !strings.HasPrefix(strings.ToLower(scope), "/providers/microsoft.management/managementgroups/") {
+			logger.Fatalf(`invalid roleAssignment scope "%s", expected subscription, resourceGroup or ManagementGroup ID`, val)
+		}
+		Opts.Janitor.RoleAssignments.Scopes[num] = scope
+	}
+
+	for _, val := range Opts.Janitor.RoleAssignments.PrincipalTypes {
+		if !slices.ContainsFunc(armauthorization.PossiblePrincipalTypeValues(), func(principalType armauthorization.PrincipalType) bool {
+			return strings.EqualFold(string(principalType), val)
+		}) {
+			logger.Fatalf(`invalid roleAssignment principal type "%s"`, val)
+		}
+	}
+
+	if Opts.Janitor.RoleAssignmentsOrphaned.Enable {
+		if !strings.HasPrefix(Opts.Janitor.RoleAssignmentsOrphaned.GraphEndpoint, "https://") {
+			logger.Fatalf(`invalid Microsoft Graph endpoint "%s", expected https url`, Opts.Janitor.RoleAssignmentsOrphaned.GraphEndpoint)
+		}
+		if Opts.Janitor.RoleAssignmentsOrphaned.MinAge < 0 {
+			logger.Fatal(`minimum age of orphaned roleAssignments must not be negative`)
+		}
+		if Opts.Janitor.RoleAssignmentsOrphaned.Delete && len(Opts.Janitor.RoleAssignments.Scopes) == 0 && len(Opts.Janitor.RoleAssignments.PrincipalTypes) == 0 && len(Opts.Janitor.RoleAssignments.RoleDefintionIds) == 0 {
+			logger.Fatal(`deletion of orphaned roleAssignments needs a scope, principal type or roleDefinition filter (--janitor.roleassignments.scope, --janitor.roleassignments.principaltype or --janitor.roleassignments.roledefinitionid)`)
+		}
+	}
+
 	checkForDeprecations()
 }
 
@@ -174,7 +284,7 @@ func initAzureConnection() {
 }
 
 // start and handle prometheus handler
-func startHttpServer() {
+func startHttpServer(j *janitor.Janitor) {
 	mux := http.NewServeMux()
 
 	// healthz
@@ -191,6 +301,42 @@ func startHttpServer() {
 		}
 	})
 
+	// plan of last janitor run
+	mux.HandleFunc("/plan", func(w http.ResponseWriter, r *http.Request) {
+		plan := j.GetPlan()
+		if plan == nil {
+			http.Error(w, "no janitor run finished yet", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(plan); err != nil {
+			logger.Error(err.Error())
+		}
+	})
+
+	// status (failed subscriptions and tasks) of last janitor run
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		status := j.GetRunStatus()
+		if status == nil {
+			http.Error(w, "no janitor run finished yet", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			logger.Error(err.Error())
+		}
+	})
+
+	// api-versions of resource providers (debug)
+	mux.HandleFunc("/debug/apiversions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(j.GetApiVersions()); err != nil {
+			logger.Error(err.Error())
+		}
+	})
+
 	mux.Handle("/metrics", tracing.RegisterAzureMetricAutoClean(promhttp.Handler()))
 
 	srv := &http.Server{